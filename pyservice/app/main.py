@@ -273,6 +273,8 @@ def _normalize_entries(entries: List[Dict[str, Any]]) -> List[Dict[str, Any]]:
                 "rationale": entry.get("rationale", ""),
                 "photo_path": entry.get("photo_path"),
                 "photo_url": _photo_url(entry.get("photo_path")),
+                "answers": entry.get("answers") or {},
+                "flow": entry.get("flow"),
                 "sort_key": sort_key,
             }
         )
@@ -25,6 +25,7 @@ def client(tmp_path, monkeypatch):
                 "timestamp": "2024-01-01T12:30:00Z",
                 "verdict": True,
                 "rationale": "Lesion detected",
+                "answers": {"idade": "52", "fumante": "sim"},
             }
         ]
     }
@@ -63,6 +64,7 @@ def test_patient_detail_view(client: TestClient):
     response = client.get("/patients/usr", auth=("doctor", "doctor"))
     assert response.status_code == 200
     assert "Lesion detected" in response.text
+    assert "fumante:</strong> sim" in response.text
     assert "View photo" in response.text
 
 
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ActionRequest is what an action handler sees when a node's answer arrives.
+// Handlers run on the chat's queue, so they may read and update State directly.
+type ActionRequest struct {
+	ChatID int64
+	Node   Node
+	Answer string // trimmed and, when the node has validation rules, normalized
+	State  *ChatState
+	Locale string
+	Params map[string]string // the node's action_params
+}
+
+// ActionResult tells the engine how an action went. A failed action follows
+// the node's fail_transition unless Hold keeps the chat on the node; Reply,
+// when set, is sent first either way. A successful action with Flow set
+// continues at that flow's start instead of the success_transition.
+// Nodes with an action only store what the handler puts in Vars, so secrets
+// such as passwords never reach Answers.
+type ActionResult struct {
+	Failed bool
+	Hold   bool // stay on the node without a transition, e.g. while the user is locked out
+	Reply  string
+	Vars   map[string]string // merged into the chat's answers
+	Flow   string
+}
+
+// ActionHandler runs a node's action. An error is logged and treated as a failure.
+type ActionHandler func(ctx context.Context, req ActionRequest) (ActionResult, error)
+
+// actionHandlers is the registry of actions nodes can declare; see registerAction.
+var actionHandlers = map[string]ActionHandler{
+	"auth.username": authUsernameAction,
+	"auth.password": authPasswordAction,
+	"profile.save":  profileSaveAction,
+	"http.post":     httpPostAction,
+}
+
+// legacyActions keeps conversations written before actions existed working:
+// these node IDs used to trigger authentication on their own.
+var legacyActions = map[string]string{
+	"login_username": "auth.username",
+	"login_password": "auth.password",
+}
+
+// registerAction adds or replaces an action. Call it from an init function so
+// the registry is complete before conversations are loaded.
+func registerAction(name string, h ActionHandler) {
+	actionHandlers[name] = h
+}
+
+// nodeAction returns the action a node runs, or "" for plain answers.
+func nodeAction(n Node) string {
+	if n.Action != "" {
+		return n.Action
+	}
+	return legacyActions[n.ID]
+}
+
+// conversationSignsIn reports whether the running conversation has a sign-in step.
+func conversationSignsIn() bool {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	for _, n := range nodes {
+		if nodeAction(n) == "auth.password" {
+			return true
+		}
+	}
+	return false
+}
+
+// runAction runs n's action for answer and follows the resulting transition.
+func runAction(chatID int64, st *ChatState, n Node, name, answer string) {
+	locale := chatLocale(st)
+	h, ok := actionHandlers[name]
+	if !ok {
+		log.Printf("node %s: unknown action %q", n.ID, name)
+		applyTransition(chatID, n.ID, false)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	res, err := h(ctx, ActionRequest{ChatID: chatID, Node: n, Answer: answer, State: st, Locale: locale, Params: n.ActionParams})
+	if err != nil {
+		log.Printf("node %s: action %s failed: %v", n.ID, name, err)
+		res = ActionResult{Failed: true, Reply: msg(locale, "action.failed")}
+	}
+	fmt.Printf("[conversation] chat:%d action(%s) %s ok:%t\n", chatID, n.ID, name, !res.Failed)
+
+	for k, v := range res.Vars {
+		st.Answers[k] = v
+	}
+	if res.Reply != "" {
+		if err := sendReply(chatID, res.Reply); err != nil {
+			log.Printf("send action reply error: %v", err)
+		}
+	}
+	if res.Hold {
+		saveChatState(chatID)
+		return
+	}
+	// /back only forgets the answer to a node, not what an action did with it
+	// (sign-in, stored variables, calls to other services), so the chat cannot
+	// go back past a node whose action took effect.
+	if !res.Failed || len(res.Vars) > 0 {
+		sealHistory(st)
+	}
+	if f, ok := lookupFlow(res.Flow); ok && !res.Failed {
+		fmt.Printf("[conversation] chat:%d action(%s) continues in flow %s\n", chatID, n.ID, f.ID)
+		advanceChatState(chatID, f.Start)
+		return
+	}
+	applyTransition(chatID, n.ID, !res.Failed)
+}
+
+// authUsernameAction accepts a username listed in auth.json.
+func authUsernameAction(ctx context.Context, req ActionRequest) (ActionResult, error) {
+	if req.Answer == "" || !userExists(req.Answer) {
+		return ActionResult{Failed: true, Reply: msg(req.Locale, "login.unknown_user")}, nil
+	}
+	req.State.Username = req.Answer
+	return ActionResult{}, nil
+}
+
+// authPasswordAction signs the chat in when the password matches the username
+// given earlier, then moves a chat of the default flow to the flow of the user's role.
+func authPasswordAction(ctx context.Context, req ActionRequest) (ActionResult, error) {
+	if req.State.Username == "" {
+		return ActionResult{Failed: true, Reply: msg(req.Locale, "login.username_first")}, nil
+	}
+	user := chatUserID(req.ChatID, req.State)
+	if !verifyPassword(req.State.Username, req.Answer) {
+		if lockouts.Fail(user, clock()) {
+			log.Printf("user %d locked out after repeated failed sign-ins as %q", user, req.State.Username)
+			return ActionResult{Failed: true, Hold: true, Reply: msg(req.Locale, "login.locked", waitMinutes(lockouts.Remaining(user, clock())))}, nil
+		}
+		return ActionResult{Failed: true, Reply: msg(req.Locale, "login.bad_password")}, nil
+	}
+	lockouts.Succeed(user)
+	req.State.Authed = true
+	req.State.Role = userRole(req.State.Username)
+	res := ActionResult{Flow: signedInFlow(req.State)}
+	if req.State.Role != "" {
+		res.Vars = map[string]string{"role": req.State.Role}
+	}
+	return res, nil
+}
+
+// profileSaveAction stores the answer under the "field" param, or under the
+// node ID, and updates the patient's first name when field is "first_name".
+func profileSaveAction(ctx context.Context, req ActionRequest) (ActionResult, error) {
+	field := req.Params["field"]
+	if field == "" {
+		field = req.Node.ID
+	}
+	if field == "first_name" && req.Answer != "" {
+		req.State.FirstName = req.Answer
+	}
+	return ActionResult{Vars: map[string]string{field: req.Answer}}, nil
+}
+
+// actionHTTPClient sends http.post requests.
+var actionHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// httpPostAction posts the answer to the "url" param as JSON. A 2xx response
+// passes; a JSON object of strings in the response body becomes variables.
+// A 4xx response fails the step with the body's "message", if any.
+func httpPostAction(ctx context.Context, req ActionRequest) (ActionResult, error) {
+	target := req.Params["url"]
+	if target == "" {
+		return ActionResult{}, errors.New(`http.post needs a "url" param`)
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"chat_id":  req.ChatID,
+		"node":     req.Node.ID,
+		"answer":   req.Answer,
+		"answers":  req.State.Answers,
+		"username": req.State.Username,
+	})
+	if err != nil {
+		return ActionResult{}, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return ActionResult{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := actionHTTPClient.Do(httpReq)
+	if err != nil {
+		return ActionResult{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return ActionResult{}, err
+	}
+
+	var out map[string]interface{}
+	_ = json.Unmarshal(body, &out)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		vars := map[string]string{req.Node.ID: req.Answer}
+		for k, v := range out {
+			if s, ok := v.(string); ok {
+				vars[k] = s
+			}
+		}
+		return ActionResult{Vars: vars}, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		reply, _ := out["message"].(string)
+		return ActionResult{Failed: true, Reply: reply}, nil
+	}
+	return ActionResult{}, fmt.Errorf("%s returned %s", target, resp.Status)
+}
+
+// checkAction reports problems with a node's action declaration.
+func checkAction(m ConvMessage) []string {
+	if m.Action == "" {
+		if len(m.ActionParams) > 0 {
+			return []string{"action_params without an action"}
+		}
+		return nil
+	}
+	var problems []string
+	if _, ok := actionHandlers[m.Action]; !ok {
+		problems = append(problems, fmt.Sprintf("unknown action %q", m.Action))
+	}
+	if m.Type != "question" {
+		problems = append(problems, "actions are only supported on question nodes")
+	}
+	if m.Action == "http.post" {
+		u, err := url.Parse(m.ActionParams["url"])
+		if err != nil || !strings.HasPrefix(u.Scheme, "http") || u.Host == "" {
+			problems = append(problems, `http.post needs an absolute "url" in action_params`)
+		}
+	}
+	return problems
+}
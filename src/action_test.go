@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthActionsOnRenamedNodes(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	originalSend := sendReply
+	defer func() { sendReply = originalSend }()
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+
+	authUsers = map[string]string{"ana": "s3cret"}
+	authRoles = map[string]string{"ana": "agent"}
+	nodes = map[string]Node{
+		"user": {ID: "user", Type: "question", Text: "Username?", Action: "auth.username", SuccessTransition: strPtr("pass"), FailTransition: strPtr("user")},
+		"pass": {ID: "pass", Type: "question", Text: "Password?", Action: "auth.password", SuccessTransition: strPtr("done"), FailTransition: strPtr("user")},
+		"done": {ID: "done", Type: "question", Text: "Welcome", FailTransition: strPtr("done")},
+	}
+	const chatID = 5
+	advanceChatState(chatID, "user")
+
+	handleQuestionAnswer(chatID, "user", "bob")
+	if st := chatStateFor(chatID); st.Awaiting != "user" || st.Username != "" {
+		t.Fatalf("unknown user should stay on the username node, got %+v", st)
+	}
+	if !containsText(sent, msg("en", "login.unknown_user")) {
+		t.Fatalf("expected unknown user reply, got %v", sent)
+	}
+
+	handleQuestionAnswer(chatID, "user", " ana ")
+	handleQuestionAnswer(chatID, "pass", "s3cret")
+	st := chatStateFor(chatID)
+	if !st.Authed || st.Username != "ana" || st.Role != "agent" || st.Answers["role"] != "agent" || st.Awaiting != "done" {
+		t.Fatalf("expected signed-in chat on done, got %+v", st)
+	}
+	if _, ok := st.Answers["pass"]; ok {
+		t.Fatalf("password must not be stored in answers: %v", st.Answers)
+	}
+}
+
+func TestHTTPPostAction(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	originalSend := sendReply
+	defer func() { sendReply = originalSend }()
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		if got["answer"] == "00000" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = w.Write([]byte(`{"message":"Unknown postcode."}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"city":"Recife","score":3}`))
+	}))
+	defer srv.Close()
+
+	nodes = map[string]Node{
+		"cep":  {ID: "cep", Type: "question", Text: "Postcode?", Action: "http.post", ActionParams: map[string]string{"url": srv.URL}, SuccessTransition: strPtr("done"), FailTransition: strPtr("cep")},
+		"done": {ID: "done", Type: "question", Text: "ok", FailTransition: strPtr("done")},
+	}
+	const chatID = 6
+	advanceChatState(chatID, "cep")
+
+	handleQuestionAnswer(chatID, "cep", "00000")
+	if st := chatStateFor(chatID); st.Awaiting != "cep" || !containsText(sent, "Unknown postcode.") {
+		t.Fatalf("expected rejection with the service message, got %+v / %v", st, sent)
+	}
+
+	handleQuestionAnswer(chatID, "cep", "50000")
+	st := chatStateFor(chatID)
+	if st.Awaiting != "done" || st.Answers["cep"] != "50000" || st.Answers["city"] != "Recife" {
+		t.Fatalf("expected variables from the response, got %+v", st)
+	}
+	if _, ok := st.Answers["score"]; ok {
+		t.Fatalf("non-string values should be ignored: %v", st.Answers)
+	}
+	if got["node"] != "cep" {
+		t.Fatalf("unexpected payload %v", got)
+	}
+}
+
+func TestRegisteredActionSetsVariables(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	defer delete(actionHandlers, "test.upper")
+	registerAction("test.upper", func(ctx context.Context, req ActionRequest) (ActionResult, error) {
+		return ActionResult{Vars: map[string]string{"shout": strings.ToUpper(req.Answer)}}, nil
+	})
+	originalSend := sendReply
+	defer func() { sendReply = originalSend }()
+	sendReply = func(id int64, text string) error { return nil }
+
+	nodes = map[string]Node{
+		"q":    {ID: "q", Type: "question", Text: "Say something", Action: "test.upper", SuccessTransition: strPtr("done"), FailTransition: strPtr("q")},
+		"done": {ID: "done", Type: "question", Text: "ok", FailTransition: strPtr("done")},
+	}
+	advanceChatState(3, "q")
+	handleQuestionAnswer(3, "q", "hello")
+	if st := chatStateFor(3); st.Answers["shout"] != "HELLO" || st.Awaiting != "done" {
+		t.Fatalf("custom action not applied: %+v", st)
+	}
+}
+
+func TestCheckAction(t *testing.T) {
+	cases := []struct {
+		m    ConvMessage
+		want string
+	}{
+		{ConvMessage{Type: "question", Action: "auth.username"}, ""},
+		{ConvMessage{Type: "question", Action: "auth.magic"}, `unknown action "auth.magic"`},
+		{ConvMessage{Type: "choice", Action: "profile.save"}, "only supported on question nodes"},
+		{ConvMessage{Type: "question", Action: "http.post", ActionParams: map[string]string{"url": "/relative"}}, "absolute"},
+		{ConvMessage{Type: "question", ActionParams: map[string]string{"url": "x"}}, "without an action"},
+	}
+	for _, c := range cases {
+		got := strings.Join(checkAction(c.m), "; ")
+		if (c.want == "") != (got == "") || !strings.Contains(got, c.want) {
+			t.Errorf("checkAction(%+v) = %q, want %q", c.m, got, c.want)
+		}
+	}
+}
+
+func containsText(sent []string, want string) bool {
+	for _, s := range sent {
+		if strings.Contains(s, want) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMaxRetries is how many invalid answers a question accepts before
+// following its fail_transition when the node does not set max_retries.
+const defaultMaxRetries = 3
+
+// dateLayout turns a human date format such as "DD/MM/YYYY" into a Go layout.
+func dateLayout(format string) string {
+	if format == "" {
+		format = "YYYY-MM-DD"
+	}
+	return strings.NewReplacer("YYYY", "2006", "YY", "06", "MM", "01", "DD", "02").Replace(format)
+}
+
+// compileValidation returns a copy of a node's validation with its pattern
+// compiled. A pattern that does not compile is logged and not enforced.
+func compileValidation(nodeID string, v *AnswerValidation) *AnswerValidation {
+	if v == nil {
+		return nil
+	}
+	compiled := *v
+	if v.Pattern != "" {
+		re, err := regexp.Compile(v.Pattern)
+		if err != nil {
+			log.Printf("node %s: invalid validation pattern %q: %v", nodeID, v.Pattern, err)
+		}
+		compiled.pattern = re
+	}
+	return &compiled
+}
+
+// validateAnswer checks an answer against the node's rules and returns the
+// normalized value to store. The error text is shown to the patient.
+func validateAnswer(v *AnswerValidation, answer, locale string) (string, error) {
+	answer = strings.TrimSpace(answer)
+	if v == nil {
+		return answer, nil
+	}
+	if v.MaxLength > 0 && len([]rune(answer)) > v.MaxLength {
+		return "", errors.New(msg(locale, "validate.max_length", v.MaxLength))
+	}
+	if v.pattern != nil && !v.pattern.MatchString(answer) {
+		return "", errors.New(msg(locale, "validate.pattern"))
+	}
+
+	switch v.Type {
+	case "", "text":
+		return answer, nil
+	case "int":
+		n, err := strconv.Atoi(strings.TrimPrefix(answer, "+"))
+		if err != nil || !v.inRange(float64(n)) {
+			return "", errors.New(msg(locale, "validate.int", v.rangeHint(locale)))
+		}
+		return strconv.Itoa(n), nil
+	case "float":
+		f, err := strconv.ParseFloat(strings.Replace(answer, ",", ".", 1), 64)
+		if err != nil || !v.inRange(f) {
+			return "", errors.New(msg(locale, "validate.float", v.rangeHint(locale)))
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	case "enum":
+		for _, value := range v.Values {
+			if strings.EqualFold(answer, value) {
+				return value, nil
+			}
+		}
+		return "", errors.New(msg(locale, "validate.enum", strings.Join(v.Values, ", ")))
+	case "date":
+		t, err := time.Parse(dateLayout(v.Format), answer)
+		if err != nil {
+			format := v.Format
+			if format == "" {
+				format = "YYYY-MM-DD"
+			}
+			return "", errors.New(msg(locale, "validate.date", format))
+		}
+		return t.Format("2006-01-02"), nil
+	}
+	log.Printf("unknown validation type %q", v.Type)
+	return answer, nil
+}
+
+func (v *AnswerValidation) inRange(f float64) bool {
+	return (v.Min == nil || f >= *v.Min) && (v.Max == nil || f <= *v.Max)
+}
+
+func (v *AnswerValidation) rangeHint(locale string) string {
+	format := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+	switch {
+	case v.Min != nil && v.Max != nil:
+		return msg(locale, "validate.between", format(*v.Min), format(*v.Max))
+	case v.Min != nil:
+		return msg(locale, "validate.at_least", format(*v.Min))
+	case v.Max != nil:
+		return msg(locale, "validate.at_most", format(*v.Max))
+	}
+	return ""
+}
+
+// checkValidation reports rules that could never work, for the graph validator.
+func checkValidation(v *AnswerValidation) []string {
+	var problems []string
+	switch v.Type {
+	case "", "text", "int", "float", "date":
+	case "enum":
+		if len(v.Values) == 0 {
+			problems = append(problems, "enum validation has no values")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown validation type %q", v.Type))
+	}
+	if v.Pattern != "" {
+		if _, err := regexp.Compile(v.Pattern); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid validation pattern: %v", err))
+		}
+	}
+	if v.Min != nil && v.Max != nil && *v.Min > *v.Max {
+		problems = append(problems, "validation min is greater than max")
+	}
+	if v.Type == "date" {
+		if !strings.Contains(dateLayout(v.Format), "06") {
+			problems = append(problems, fmt.Sprintf("invalid date format %q", v.Format))
+		}
+	}
+	if v.MaxLength < 0 || v.MaxRetries < 0 {
+		problems = append(problems, "validation limits must not be negative")
+	}
+	return problems
+}
+
+// rejectAnswer asks the question again or, once the node's attempts are used
+// up, follows its exhausted_transition or fail_transition.
+func rejectAnswer(chatID int64, st *ChatState, n Node, problem error) {
+	attempts, limit := countAttempt(st, n), attemptLimit(n)
+	log.Printf("chat %d: invalid answer for %s (%d/%d): %v", chatID, n.ID, attempts, limit, problem)
+
+	if attempts >= limit {
+		if exhaustAttempts(chatID, st, n) {
+			return
+		}
+		if n.FailTransition != nil && *n.FailTransition != "" {
+			// Already counted above; follow the failure without counting it again.
+			delete(st.Attempts, n.ID)
+			followTransition(chatID, st, n, false)
+			return
+		}
+	}
+
+	msg := n.RetryMessage
+	if msg == "" {
+		msg = problem.Error()
+	}
+	replyOrLog(chatID, msg)
+	saveChatState(chatID)
+}
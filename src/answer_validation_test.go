@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func floatPtr(f float64) *float64 { return &f }
+
+func TestValidateAnswer(t *testing.T) {
+	age := &AnswerValidation{Type: "int", Min: floatPtr(0), Max: floatPtr(120)}
+	weeks := &AnswerValidation{Type: "float", Min: floatPtr(0)}
+	smoking := &AnswerValidation{Type: "enum", Values: []string{"never", "sometimes", "daily"}}
+	since := &AnswerValidation{Type: "date", Format: "DD/MM/YYYY"}
+	code := compileValidation("code", &AnswerValidation{Pattern: `^[A-Z]{2}\d{3}$`, MaxLength: 5})
+
+	cases := []struct {
+		rule    *AnswerValidation
+		in      string
+		want    string
+		wantErr string
+	}{
+		{nil, "  free text ", "free text", ""},
+		{age, " 42 ", "42", ""},
+		{age, "+7", "7", ""},
+		{age, "130", "", "between 0 and 120"},
+		{age, "forty", "", "whole number"},
+		{weeks, "1,5", "1.5", ""},
+		{weeks, "-2", "", "of at least 0"},
+		{smoking, "Daily", "daily", ""},
+		{smoking, "a lot", "", "never, sometimes, daily"},
+		{since, "03/02/2024", "2024-02-03", ""},
+		{since, "2024-02-03", "", "DD/MM/YYYY"},
+		{code, "AB123", "AB123", ""},
+		{code, "ab123", "", "expected format"},
+		{code, "AB1234", "", "under 5 characters"},
+	}
+	for _, c := range cases {
+		got, err := validateAnswer(c.rule, c.in, "en")
+		if c.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Errorf("validateAnswer(%q) error = %v, want %q", c.in, err, c.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("validateAnswer(%q) = %q, %v, want %q", c.in, got, err, c.want)
+		}
+	}
+}
+
+func TestCheckValidation(t *testing.T) {
+	problems := strings.Join(checkValidation(&AnswerValidation{Type: "enum", Pattern: "(", Min: floatPtr(5), Max: floatPtr(1)}), "\n")
+	for _, want := range []string{"enum validation has no values", "invalid validation pattern", "min is greater than max"} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("missing %q in %q", want, problems)
+		}
+	}
+	if p := checkValidation(&AnswerValidation{Type: "date", Format: "DD/MM"}); len(p) != 1 {
+		t.Errorf("expected yearless date format to be rejected, got %v", p)
+	}
+	if p := checkValidation(&AnswerValidation{Type: "number"}); len(p) != 1 {
+		t.Errorf("expected unknown type to be rejected, got %v", p)
+	}
+}
+
+func TestQuestionRetriesThenFails(t *testing.T) {
+	resetGlobals()
+	originalSend := sendReply
+	defer func() { sendReply = originalSend }()
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+
+	nodes = map[string]Node{
+		"start": {ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("age")},
+		"age": {ID: "age", Type: "question", Text: "How old are you?", SuccessTransition: strPtr("done"), FailTransition: strPtr("help"),
+			Validation: &AnswerValidation{Type: "int", Min: floatPtr(0), Max: floatPtr(120), MaxRetries: 2}},
+		"weeks": {ID: "weeks", Type: "question", Text: "For how many weeks?", RetryMessage: "Just the number of weeks, please.",
+			Validation: &AnswerValidation{Type: "int"}},
+		"help": {ID: "help", Type: "question", Text: "Let's try differently. Describe your age in words."},
+		"done": {ID: "done", Type: "question", Text: "Thanks!"},
+	}
+	startNodeID = "start"
+	chat := Chat{ID: 3}
+	send := func(text string) {
+		sent = nil
+		captureOutput(t, func() { printMessage(&Message{Chat: chat, Text: text}) })
+	}
+
+	send("hello")
+	send("old enough")
+	if st := chatStateFor(3); st.Awaiting != "age" || st.Attempts["age"] != 1 {
+		t.Fatalf("expected a retry on age, got %+v", st)
+	}
+	if len(sent) != 1 || !strings.Contains(sent[0], "between 0 and 120") {
+		t.Fatalf("unexpected retry message %q", sent)
+	}
+	send("200")
+	st := chatStateFor(3)
+	if st.Awaiting != "help" || len(st.Attempts) != 0 {
+		t.Fatalf("expected fail transition after retries, got %+v", st)
+	}
+
+	// A valid answer is stored normalized and clears the counter.
+	st.Awaiting = "age"
+	send("abc")
+	send(" 034 ")
+	if st := chatStateFor(3); st.Answers["age"] != "34" || st.Awaiting != "done" || st.Attempts["age"] != 0 {
+		t.Fatalf("expected normalized answer, got %+v", st)
+	}
+
+	// The node's retry_message replaces the generated hint.
+	st.Awaiting = "weeks"
+	send("a few")
+	if len(sent) != 1 || sent[0] != "Just the number of weeks, please." {
+		t.Fatalf("unexpected custom retry %q", sent)
+	}
+}
+
+func TestBuildConversationCompilesPatterns(t *testing.T) {
+	rule := &AnswerValidation{Pattern: `^\d{5}$`}
+	g := buildConversation(&ConversationFile{Messages: []ConvMessage{
+		{ID: "zip", Type: "question", Text: "ZIP?", Validation: rule},
+		{ID: "bad", Type: "question", Text: "?", Validation: &AnswerValidation{Pattern: "("}},
+	}})
+	zip := g.nodes["zip"].Validation
+	if zip.pattern == nil || rule.pattern != nil {
+		t.Fatalf("expected the node's own compiled copy, got %+v", zip)
+	}
+	if _, err := validateAnswer(zip, "1234", "en"); err == nil {
+		t.Fatal("expected the compiled pattern to be enforced")
+	}
+	if got, err := validateAnswer(g.nodes["bad"].Validation, "anything", "en"); err != nil || got != "anything" {
+		t.Fatalf("a pattern that does not compile should not block answers, got %q, %v", got, err)
+	}
+}
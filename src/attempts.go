@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// adminRole is the auth.json role allowed to run /unlock.
+const adminRole = "admin"
+
+// attemptLimit is how many failed attempts n accepts before giving up:
+// max_attempts, else the question's max_retries, else defaultMaxRetries.
+func attemptLimit(n Node) int {
+	if n.MaxAttempts > 0 {
+		return n.MaxAttempts
+	}
+	if n.Validation != nil && n.Validation.MaxRetries > 0 {
+		return n.Validation.MaxRetries
+	}
+	return defaultMaxRetries
+}
+
+// countAttempt records a failed attempt at n and returns how many there were.
+func countAttempt(st *ChatState, n Node) int {
+	if st.Attempts == nil {
+		st.Attempts = make(map[string]int)
+	}
+	st.Attempts[n.ID]++
+	return st.Attempts[n.ID]
+}
+
+// exhaustAttempts handles a node whose attempts are used up: it starts the
+// node's cooldown and follows its exhausted_transition, or keeps the chat on
+// the node until the cooldown ends. It returns false when the node sets
+// neither, leaving the caller's own handling in place.
+func exhaustAttempts(chatID int64, st *ChatState, n Node) bool {
+	var cooldown time.Duration
+	if n.Cooldown != nil {
+		cooldown = n.Cooldown.Duration
+	}
+	hasTarget := n.ExhaustedTransition != nil && *n.ExhaustedTransition != ""
+	if !hasTarget && cooldown <= 0 {
+		return false
+	}
+	delete(st.Attempts, n.ID)
+	log.Printf("chat %d: attempts at %s used up", chatID, n.ID)
+	if cooldown > 0 {
+		st.CooldownUntil = clock().Add(cooldown)
+		replyOrLog(chatID, msg(chatLocale(st), "attempts.cooldown", waitMinutes(cooldown)))
+	}
+	if hasTarget {
+		st.Awaiting = ""
+		advanceChatState(chatID, *n.ExhaustedTransition)
+		return true
+	}
+	// Retry the same node once the cooldown is over.
+	st.Awaiting = n.ID
+	saveChatState(chatID)
+	return true
+}
+
+// blockedFor returns how long the chat must wait before it is served again,
+// because of a node cooldown or a login lockout of its user.
+func blockedFor(chatID int64, st *ChatState) time.Duration {
+	now := clock()
+	wait := lockouts.Remaining(chatUserID(chatID, st), now)
+	if !st.CooldownUntil.IsZero() {
+		if d := st.CooldownUntil.Sub(now); d <= 0 {
+			st.CooldownUntil = time.Time{}
+		} else if d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// waitMinutes rounds a wait up to whole minutes for messages.
+func waitMinutes(d time.Duration) int {
+	return int((d + time.Minute - 1) / time.Minute)
+}
+
+// loginLockout locks Telegram users out after repeated failed sign-ins. With a
+// store, every change is written through so a restart does not lift lockouts.
+type loginLockout struct {
+	mu          sync.Mutex
+	maxFailures int // 0 disables lockouts
+	period      time.Duration
+	store       LockoutStore           // nil keeps lockouts in memory only
+	users       map[int64]lockoutState // read from the store on first use
+}
+
+// lockouts is the running login lockout policy; main configures it from the environment.
+var lockouts = newLoginLockout(5, 15*time.Minute)
+
+func newLoginLockout(maxFailures int, period time.Duration) *loginLockout {
+	return &loginLockout{
+		maxFailures: maxFailures,
+		period:      period,
+		users:       make(map[int64]lockoutState),
+	}
+}
+
+// loginLockoutFromEnv reads LOGIN_MAX_FAILURES (default 5, 0 disables) and
+// LOGIN_LOCKOUT (default 15m), keeping the lockouts in store.
+func loginLockoutFromEnv(store LockoutStore) (*loginLockout, error) {
+	maxFailures, period := 5, 15*time.Minute
+	if v := os.Getenv("LOGIN_MAX_FAILURES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid LOGIN_MAX_FAILURES %q", v)
+		}
+		maxFailures = n
+	}
+	if v := os.Getenv("LOGIN_LOCKOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid LOGIN_LOCKOUT %q", v)
+		}
+		period = d
+	}
+	l := newLoginLockout(maxFailures, period)
+	l.store = store
+	return l, nil
+}
+
+// userLocked returns the user's state, loading it from the store the first time.
+func (l *loginLockout) userLocked(userID int64) lockoutState {
+	st, ok := l.users[userID]
+	if !ok && l.store != nil {
+		loaded, err := l.store.Load(userID)
+		if err != nil {
+			log.Printf("load login lockout for user %d: %v", userID, err)
+		}
+		st = loaded
+		l.users[userID] = st
+	}
+	return st
+}
+
+// setLocked replaces the user's state and writes it through to the store; a
+// zero state deletes it.
+func (l *loginLockout) setLocked(userID int64, st lockoutState) {
+	l.users[userID] = st
+	if l.store == nil {
+		return
+	}
+	var err error
+	if st == (lockoutState{}) {
+		err = l.store.Delete(userID)
+	} else {
+		err = l.store.Save(userID, st)
+	}
+	if err != nil {
+		log.Printf("save login lockout for user %d: %v", userID, err)
+	}
+}
+
+// Fail records a failed sign-in and reports whether it locked the user out.
+func (l *loginLockout) Fail(userID int64, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxFailures <= 0 {
+		return false
+	}
+	st := l.userLocked(userID)
+	st.Failures++
+	st.Expires = now.Add(l.period)
+	locked := st.Failures >= l.maxFailures
+	if locked {
+		st.Failures = 0
+		st.Until = st.Expires
+	}
+	l.setLocked(userID, st)
+	return locked
+}
+
+// Succeed forgets the user's failed sign-ins.
+func (l *loginLockout) Succeed(userID int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st := l.userLocked(userID)
+	if st.Failures == 0 {
+		return
+	}
+	st.Failures = 0
+	if st.Until.IsZero() {
+		st = lockoutState{}
+	}
+	l.setLocked(userID, st)
+}
+
+// Remaining returns how long the user is still locked out, 0 when not.
+func (l *loginLockout) Remaining(userID int64, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st := l.userLocked(userID)
+	if st.Until.IsZero() {
+		return 0
+	}
+	if d := st.Until.Sub(now); d > 0 {
+		return d
+	}
+	st.Until = time.Time{}
+	if st.Failures == 0 {
+		st = lockoutState{}
+	}
+	l.setLocked(userID, st)
+	return 0
+}
+
+// Unlock lifts the user's lockout and forgets their failed sign-ins.
+func (l *loginLockout) Unlock(userID int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setLocked(userID, lockoutState{})
+}
+
+// lockoutState is one user's failed sign-ins and lockout as persisted.
+type lockoutState struct {
+	Failures int       `json:"failures,omitempty"`
+	Until    time.Time `json:"until,omitempty"`   // locked out until then
+	Expires  time.Time `json:"expires,omitempty"` // the store may forget the state after this
+}
+
+// LockoutStore persists login lockouts by Telegram user ID. Load returns a
+// zero state when the user has none or it has expired.
+type LockoutStore interface {
+	Load(userID int64) (lockoutState, error)
+	Save(userID int64, st lockoutState) error
+	Delete(userID int64) error
+}
+
+// redisLockoutPrefix namespaces the lockout keys in Redis.
+const redisLockoutPrefix = "diagnosis:lockout:"
+
+// fileLockoutStore keeps every lockout in a single JSON file keyed by user ID.
+type fileLockoutStore struct {
+	mu    sync.Mutex
+	path  string
+	users map[int64]lockoutState
+}
+
+// newFileLockoutStore opens (or creates) the lockout file at path, dropping expired entries.
+func newFileLockoutStore(path string) (*fileLockoutStore, error) {
+	s := &fileLockoutStore{path: path, users: make(map[int64]lockoutState)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.users); err != nil {
+			return nil, fmt.Errorf("decode lockouts: %w", err)
+		}
+	}
+	now := time.Now()
+	for userID, st := range s.users {
+		if now.After(st.Expires) {
+			delete(s.users, userID)
+		}
+	}
+	return s, nil
+}
+
+func (s *fileLockoutStore) Load(userID int64) (lockoutState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.users[userID], nil
+}
+
+func (s *fileLockoutStore) Save(userID int64, st lockoutState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[userID] = st
+	return s.persistLocked()
+}
+
+func (s *fileLockoutStore) Delete(userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[userID]; !ok {
+		return nil
+	}
+	delete(s.users, userID)
+	return s.persistLocked()
+}
+
+func (s *fileLockoutStore) persistLocked() error {
+	data, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// redisLockoutStore keeps each lockout under its own key, expiring with it.
+type redisLockoutStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func (s redisLockoutStore) key(userID int64) string {
+	return s.prefix + strconv.FormatInt(userID, 10)
+}
+
+func (s redisLockoutStore) Load(userID int64) (lockoutState, error) {
+	var st lockoutState
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data, err := s.client.Get(ctx, s.key(userID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(data, &st)
+	return st, err
+}
+
+func (s redisLockoutStore) Save(userID int64, st lockoutState) error {
+	ttl := time.Until(st.Expires)
+	if ttl <= 0 {
+		return s.Delete(userID)
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.client.Set(ctx, s.key(userID), data, ttl).Err()
+}
+
+func (s redisLockoutStore) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.client.Del(ctx, s.key(userID)).Err()
+}
+
+// lockoutStoreFromEnv keeps lockouts next to the sessions: SESSION_STORE "file"
+// uses LOCKOUT_FILE (default configs/lockouts.json), "redis" the Redis at
+// REDIS_ADDR and "memory" nothing.
+func lockoutStoreFromEnv() (LockoutStore, error) {
+	switch kind := os.Getenv("SESSION_STORE"); kind {
+	case "", "file":
+		path := os.Getenv("LOCKOUT_FILE")
+		if path == "" {
+			path = "configs/lockouts.json"
+		}
+		return newFileLockoutStore(path)
+	case "redis":
+		client := redis.NewClient(&redis.Options{Addr: redisAddr()})
+		return redisLockoutStore{client: client, prefix: redisLockoutPrefix}, nil
+	case "memory":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown SESSION_STORE %q", kind)
+	}
+}
+
+// submitChatJob runs a job on another chat's queue; main routes it through the dispatcher.
+var submitChatJob = func(chatID int64, job func()) { job() }
+
+// handleUnlock lets a signed-in admin lift a user's login lockout and the
+// cooldown of their chat: /unlock <telegram user id>.
+func handleUnlock(chatID int64, args string) {
+	st := chatStateFor(chatID)
+	locale := chatLocale(st)
+	if !st.Authed || st.Role != adminRole {
+		replyOrLog(chatID, msg(locale, "command.unknown"))
+		return
+	}
+	userID, err := strconv.ParseInt(strings.TrimSpace(args), 10, 64)
+	if err != nil || userID == 0 {
+		replyOrLog(chatID, msg(locale, "unlock.usage"))
+		return
+	}
+	lockouts.Unlock(userID)
+	// In a private chat the chat ID is the user's ID.
+	submitChatJob(userID, func() { clearCooldown(userID) })
+	log.Printf("chat %d: admin %s unlocked user %d", chatID, st.Username, userID)
+	replyOrLog(chatID, msg(locale, "unlock.done", userID))
+}
+
+// clearCooldown ends a chat's cooldown and forgets its failed attempts.
+func clearCooldown(chatID int64) {
+	st := chatStateFor(chatID)
+	if st.CooldownUntil.IsZero() && len(st.Attempts) == 0 {
+		return
+	}
+	st.CooldownUntil = time.Time{}
+	st.Attempts = nil
+	saveChatState(chatID)
+}
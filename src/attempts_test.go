@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// attemptsConversation signs in, then asks a validated question with a
+// cooldown and a photo with limited attempts.
+var attemptsConversation = []ConvMessage{
+	{ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("user")},
+	{ID: "user", Type: "question", Text: "Username?", Action: "auth.username", SuccessTransition: strPtr("pass"), FailTransition: strPtr("user")},
+	{ID: "pass", Type: "question", Text: "Password?", Action: "auth.password", SuccessTransition: strPtr("age"), FailTransition: strPtr("user")},
+	{ID: "age", Type: "question", Text: "Age?", SuccessTransition: strPtr("photo"), FailTransition: strPtr("age"),
+		Validation: &AnswerValidation{Type: "int", MaxRetries: 2}, Cooldown: &configDuration{10 * time.Minute}},
+	{ID: "photo", Type: "start_message", Text: "Photo please", ExpectPhoto: true, SuccessTransition: strPtr("end"),
+		FailTransition: strPtr("photo"), MaxAttempts: 2, ExhaustedTransition: strPtr("nurse")},
+	{ID: "nurse", Type: "end_message", Text: "A nurse will contact you."},
+	{ID: "end", Type: "end_message", Text: "bye"},
+}
+
+func sendText(chatID int64, text string) {
+	printMessage(&Message{Chat: Chat{ID: chatID}, From: &User{ID: int(chatID)}, Text: text})
+}
+
+func TestPhotoAttemptsFollowExhaustedTransition(t *testing.T) {
+	sent, _ := setupChatTest(t, attemptsConversation...)
+	classifyPhoto = func(ctx context.Context, path string) (bool, string, error) { return false, "", errors.New("blurry") }
+	const chatID = 41
+	st := resetChatState(chatID, true)
+	st.Awaiting = "photo"
+
+	printMessage(&Message{Chat: Chat{ID: chatID}, Photo: []PhotoSize{{FileID: "p"}}})
+	if st.Awaiting != "photo" || st.Attempts["photo"] != 1 {
+		t.Fatalf("expected a retry of the photo, got %q / %v", st.Awaiting, st.Attempts)
+	}
+	printMessage(&Message{Chat: Chat{ID: chatID}, Photo: []PhotoSize{{FileID: "p"}}})
+	if !containsText(*sent, "A nurse will contact you.") {
+		t.Fatalf("expected the exhausted transition, got %v", *sent)
+	}
+}
+
+func TestQuestionCooldown(t *testing.T) {
+	sent, now := setupChatTest(t, attemptsConversation...)
+	const chatID = 42
+	st := resetChatState(chatID, true)
+	st.Awaiting = "age"
+
+	sendText(chatID, "old")
+	sendText(chatID, "very old")
+	if !containsText(*sent, msg("en", "attempts.cooldown", 10)) || st.Awaiting != "age" {
+		t.Fatalf("expected a cooldown on age, got %q / %v", st.Awaiting, *sent)
+	}
+
+	// Neither answers nor /restart get through during the cooldown.
+	*now = now.Add(4 * time.Minute)
+	*sent = nil
+	sendText(chatID, "/restart")
+	sendText(chatID, "40")
+	st = chatStateFor(chatID)
+	if st.Awaiting != "age" || len(*sent) != 2 || (*sent)[1] != msg("en", "attempts.wait", 6) {
+		t.Fatalf("expected to be told to wait, got %q / %v", st.Awaiting, *sent)
+	}
+
+	*now = now.Add(6 * time.Minute)
+	sendText(chatID, "40")
+	if st.Answers["age"] != "40" || st.Awaiting != "photo" || !st.CooldownUntil.IsZero() {
+		t.Fatalf("expected the answer once the cooldown ended, got %+v", st)
+	}
+}
+
+func TestLoginLockoutAndUnlock(t *testing.T) {
+	sent, now := setupChatTest(t, attemptsConversation...)
+	authUsers = map[string]string{"ana": "1", "root": "toor"}
+	authRoles = map[string]string{"root": adminRole}
+	lockouts = newLoginLockout(2, 30*time.Minute)
+	const patient, admin = 43, 44
+
+	sendText(patient, "hi")
+	for i := 0; i < 2; i++ {
+		sendText(patient, "ana")
+		sendText(patient, "wrong")
+	}
+	st := chatStateFor(patient)
+	if st.Awaiting != "pass" || !containsText(*sent, msg("en", "login.locked", 30)) {
+		t.Fatalf("expected a lockout on the password, got %q / %v", st.Awaiting, *sent)
+	}
+	*now = now.Add(time.Minute)
+	*sent = nil
+	sendText(patient, "1")
+	if st.Authed || !containsText(*sent, msg("en", "attempts.wait", 29)) {
+		t.Fatalf("locked user signed in: %v", *sent)
+	}
+
+	// Only a signed-in admin can unlock.
+	sendText(admin, "hi")
+	*sent = nil
+	sendText(admin, "/unlock 43")
+	if !containsText(*sent, msg("en", "command.unknown")) || lockouts.Remaining(patient, clock()) == 0 {
+		t.Fatalf("unlock allowed before signing in: %v", *sent)
+	}
+	sendText(admin, "root")
+	sendText(admin, "toor")
+	sendText(admin, "/unlock 43")
+	if !containsText(*sent, msg("en", "unlock.done", 43)) {
+		t.Fatalf("expected the unlock to be confirmed, got %v", *sent)
+	}
+
+	sendText(patient, "1")
+	if !st.Authed || st.Awaiting != "age" {
+		t.Fatalf("expected the user to sign in after the unlock, got %+v", st)
+	}
+}
+
+func TestLoginNodeAttemptsAreExhausted(t *testing.T) {
+	sent, _ := setupChatTest(t, attemptsConversation...)
+	authUsers = map[string]string{"ana": "1"}
+	lockouts = newLoginLockout(0, time.Minute)
+	pass := nodes["pass"]
+	pass.MaxAttempts, pass.ExhaustedTransition = 2, strPtr("nurse")
+	nodes["pass"] = pass
+	const chatID = 45
+
+	sendText(chatID, "hi")
+	sendText(chatID, "ana")
+	sendText(chatID, "wrong")
+	if st := chatStateFor(chatID); st.Attempts["pass"] != 1 || st.Awaiting != "user" {
+		t.Fatalf("expected one failed sign-in counted, got %+v", st)
+	}
+	sendText(chatID, "ana")
+	sendText(chatID, "wrong again")
+	if !containsText(*sent, "A nurse will contact you.") {
+		t.Fatalf("expected the exhausted transition after two wrong passwords, got %v", *sent)
+	}
+}
+
+func TestRetriesUsedUpAreCountedOnce(t *testing.T) {
+	setupChatTest(t, attemptsConversation...)
+	nodes["age"] = Node{ID: "age", Type: "question", Text: "Age?", SuccessTransition: strPtr("photo"), FailTransition: strPtr("age"),
+		Validation: &AnswerValidation{Type: "int"}, MaxAttempts: 2}
+	const chatID = 46
+	st := resetChatState(chatID, true)
+	st.Awaiting = "age"
+
+	sendText(chatID, "old")
+	sendText(chatID, "very old")
+	if st.Awaiting != "age" || st.Attempts["age"] != 0 {
+		t.Fatalf("expected the question asked again with a fresh count, got %q / %v", st.Awaiting, st.Attempts)
+	}
+}
+
+func TestValidateAttemptSettings(t *testing.T) {
+	cf := &ConversationFile{Messages: []ConvMessage{
+		{ID: "start", Type: "start_message", Text: "hi", ExpectPhoto: true, SuccessTransition: strPtr("q"),
+			ExhaustedTransition: strPtr("nowhere")},
+		{ID: "q", Type: "question", Text: "?", SuccessTransition: strPtr("start"), FailTransition: strPtr("q"),
+			MaxAttempts: -1, Cooldown: &configDuration{-time.Minute}},
+	}}
+	issues := strings.Join(validateConversation(cf), "\n")
+	for _, want := range []string{
+		`node "start": exhausted_transition points to unknown node "nowhere"`,
+		`node "start": exhausted_transition and cooldown need max_attempts`,
+		`node "q": max_attempts must not be negative`,
+		`node "q": cooldown must not be negative`,
+	} {
+		if !strings.Contains(issues, want) {
+			t.Errorf("missing issue %q in:\n%s", want, issues)
+		}
+	}
+}
+
+func TestLoginLockoutSurvivesReloadingTheStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lockouts.json")
+	open := func() *loginLockout {
+		store, err := newFileLockoutStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := newLoginLockout(2, 30*time.Minute)
+		l.store = store
+		return l
+	}
+	now := time.Now()
+
+	l := open()
+	l.Fail(7, now)
+	// A restart between two wrong passwords keeps the first one counted.
+	l = open()
+	if !l.Fail(7, now) {
+		t.Fatal("the failure before the restart was forgotten")
+	}
+	l = open()
+	if got := l.Remaining(7, now.Add(time.Minute)); got != 29*time.Minute {
+		t.Fatalf("lockout lifted by the restart, %s left", got)
+	}
+
+	l.Unlock(7)
+	if got := open().Remaining(7, now.Add(time.Minute)); got != 0 {
+		t.Fatalf("unlock not persisted, %s left", got)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+)
+
+// backCallbackPrefix marks callback data produced by Back buttons.
+const backCallbackPrefix = "back:"
+
+// pushHistory records that the chat now waits on n, so /back can return to it.
+// Irreversible nodes start a new history: nothing before them can be revisited.
+func pushHistory(st *ChatState, n Node) {
+	if n.Irreversible {
+		st.History = nil
+	}
+	if l := len(st.History); l > 0 && st.History[l-1] == n.ID {
+		return // retrying the same node
+	}
+	st.History = append(st.History, n.ID)
+}
+
+// sealHistory makes everything the chat answered so far irreversible, e.g.
+// once a photo has been classified or an action took effect.
+func sealHistory(st *ChatState) {
+	st.History = nil
+}
+
+// canGoBack reports whether the chat has an earlier node to return to.
+func canGoBack(st *ChatState) bool {
+	l := len(st.History)
+	return st.Started && l >= 2 && st.History[l-1] == st.Awaiting
+}
+
+// handleBack returns the chat to the node it answered before the current one
+// and forgets that answer.
+func handleBack(chatID int64) {
+	st := chatStateFor(chatID)
+	if !canGoBack(st) {
+		replyOrLog(chatID, msg(chatLocale(st), "back.unavailable"))
+		return
+	}
+	l := len(st.History)
+	prev := st.History[l-2]
+	if _, ok := lookupNode(prev); !ok {
+		replyOrLog(chatID, msg(chatLocale(st), "back.unavailable"))
+		return
+	}
+	st.History = st.History[:l-2]
+	delete(st.Answers, prev)
+	delete(st.Attempts, prev)
+	st.Awaiting = ""
+	advanceChatState(chatID, prev)
+}
+
+// withBackButton adds a Back button to markup when n asks for one and the
+// chat can go back; markup may be nil.
+func withBackButton(st *ChatState, n Node, markup *InlineKeyboardMarkup) *InlineKeyboardMarkup {
+	if !n.BackButton || !canGoBack(st) {
+		return markup
+	}
+	if markup == nil {
+		markup = &InlineKeyboardMarkup{}
+	}
+	markup.InlineKeyboard = append(markup.InlineKeyboard, []InlineKeyboardButton{{
+		Text:         msg(chatLocale(st), "back.button"),
+		CallbackData: backCallbackPrefix + n.ID,
+	}})
+	return markup
+}
+
+// parseBackCallback returns the node a Back button was shown on.
+func parseBackCallback(data string) (string, bool) {
+	if !strings.HasPrefix(data, backCallbackPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(data, backCallbackPrefix), true
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+)
+
+// backConversation asks two questions around a choice with a back button.
+var backConversation = []ConvMessage{
+	{ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("age")},
+	{ID: "age", Type: "question", Text: "Age?", SuccessTransition: strPtr("pain"), FailTransition: strPtr("age")},
+	{ID: "pain", Type: "choice", Text: "Pain?", BackButton: true, SuccessTransition: strPtr("photo"),
+		Options: []ConvOption{{Label: "Yes"}, {Label: "No"}}},
+	{ID: "photo", Type: "start_message", Text: "Photo please", ExpectPhoto: true, SuccessTransition: strPtr("smoker"), FailTransition: strPtr("photo")},
+	{ID: "smoker", Type: "question", Text: "Do you smoke?", SuccessTransition: strPtr("end"), FailTransition: strPtr("smoker")},
+	{ID: "end", Type: "end_message", Text: "bye"},
+}
+
+func TestBackReturnsToPreviousQuestion(t *testing.T) {
+	sent, _ := setupChatTest(t, backConversation...)
+	const chatID = 11
+	printMessage(&Message{Chat: Chat{ID: chatID}, Text: "hi"})
+	printMessage(&Message{Chat: Chat{ID: chatID}, Text: "42"})
+	st := chatStateFor(chatID)
+	if st.Awaiting != "pain" || st.Answers["age"] != "42" {
+		t.Fatalf("expected to wait on pain with age stored, got %+v", st)
+	}
+
+	printMessage(&Message{Chat: Chat{ID: chatID}, Text: "/back"})
+	if st.Awaiting != "age" {
+		t.Fatalf("expected /back to return to age, got %q", st.Awaiting)
+	}
+	if _, ok := st.Answers["age"]; ok {
+		t.Fatalf("stale answer kept: %v", st.Answers)
+	}
+
+	printMessage(&Message{Chat: Chat{ID: chatID}, Text: "24"})
+	if st.Answers["age"] != "24" || st.Awaiting != "pain" {
+		t.Fatalf("expected the new answer, got %+v", st)
+	}
+
+	// The Back button under the choice does the same.
+	handleCallbackQuery(&CallbackQuery{ID: "1", Message: &Message{Chat: Chat{ID: chatID}}, Data: backCallbackPrefix + "pain"})
+	if st.Awaiting != "age" {
+		t.Fatalf("expected Back button to return to age, got %q", st.Awaiting)
+	}
+
+	// Nothing before the first question.
+	*sent = nil
+	printMessage(&Message{Chat: Chat{ID: chatID}, Text: "/back"})
+	if st.Awaiting != "age" || !containsText(*sent, msg("en", "back.unavailable")) {
+		t.Fatalf("expected back to be refused, got %q / %v", st.Awaiting, *sent)
+	}
+}
+
+func TestBackCannotRewindVerdict(t *testing.T) {
+	sent, _ := setupChatTest(t, backConversation...)
+	const chatID = 12
+	printMessage(&Message{Chat: Chat{ID: chatID}, Text: "hi"})
+	printMessage(&Message{Chat: Chat{ID: chatID}, Text: "42"})
+	printMessage(&Message{Chat: Chat{ID: chatID}, Text: "No"})
+	printMessage(&Message{Chat: Chat{ID: chatID}, Photo: []PhotoSize{{FileID: "p"}}})
+	st := chatStateFor(chatID)
+	if st.Awaiting != "smoker" {
+		t.Fatalf("expected to wait on smoker, got %q", st.Awaiting)
+	}
+
+	*sent = nil
+	printMessage(&Message{Chat: Chat{ID: chatID}, Text: "/back"})
+	if st.Awaiting != "smoker" || st.Answers["pain"] != "No" || !containsText(*sent, msg("en", "back.unavailable")) {
+		t.Fatalf("verdict should not be rewound, got %+v / %v", st, *sent)
+	}
+}
+
+func TestBackButtonOnlyWhenPossible(t *testing.T) {
+	setupChatTest(t, backConversation...)
+	n := nodes["pain"]
+	st := &ChatState{Started: true, Awaiting: "pain", History: []string{"pain"}}
+	if m := withBackButton(st, n, nil); m != nil {
+		t.Fatalf("no Back button expected on the first question, got %+v", m)
+	}
+	st.History = []string{"age", "pain"}
+	m := withBackButton(st, n, choiceKeyboard(n, "en"))
+	if len(m.InlineKeyboard) != 3 || m.InlineKeyboard[2][0].CallbackData != "back:pain" {
+		t.Fatalf("expected a Back row after the options, got %+v", m.InlineKeyboard)
+	}
+	if m := withBackButton(st, nodes["age"], nil); m != nil {
+		t.Fatalf("nodes without back_button get no button, got %+v", m)
+	}
+}
+
+func TestIrreversibleNodeStartsNewHistory(t *testing.T) {
+	st := &ChatState{History: []string{"a", "b"}}
+	pushHistory(st, Node{ID: "c", Irreversible: true})
+	pushHistory(st, Node{ID: "d"})
+	pushHistory(st, Node{ID: "d"})
+	if len(st.History) != 2 || st.History[0] != "c" || st.History[1] != "d" {
+		t.Fatalf("unexpected history %v", st.History)
+	}
+}
+
+func TestBackCannotUndoAnAction(t *testing.T) {
+	sent, _ := setupChatTest(t, backConversation...)
+	authUsers = map[string]string{"ana": "1"}
+	nodes["start"] = Node{ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("user")}
+	nodes["user"] = Node{ID: "user", Type: "question", Text: "Username?", Action: "auth.username", SuccessTransition: strPtr("pass"), FailTransition: strPtr("user")}
+	nodes["pass"] = Node{ID: "pass", Type: "question", Text: "Password?", Action: "auth.password", SuccessTransition: strPtr("age"), FailTransition: strPtr("user")}
+	const chatID = 14
+	printMessage(&Message{Chat: Chat{ID: chatID}, Text: "hi"})
+	printMessage(&Message{Chat: Chat{ID: chatID}, Text: "ana"})
+	printMessage(&Message{Chat: Chat{ID: chatID}, Text: "1"})
+	st := chatStateFor(chatID)
+	if st.Awaiting != "age" || !st.Authed {
+		t.Fatalf("expected a signed-in chat on age, got %+v", st)
+	}
+
+	*sent = nil
+	printMessage(&Message{Chat: Chat{ID: chatID}, Text: "/back"})
+	if st.Awaiting != "age" || !containsText(*sent, msg("en", "back.unavailable")) {
+		t.Fatalf("/back went past the sign-in: %q / %v", st.Awaiting, *sent)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// condition is a parsed branch expression evaluated against a chat's answers.
+type condition interface {
+	eval(answers map[string]string) bool
+}
+
+// compareCond compares one answer with a literal using ==, !=, <, <=, > or >=.
+type compareCond struct {
+	key, op, value string
+}
+
+// inCond checks that an answer is one of a list of literals.
+type inCond struct {
+	key    string
+	values []string
+}
+
+// logicCond combines two conditions with "and" or "or".
+type logicCond struct {
+	op          string
+	left, right condition
+}
+
+// notCond negates a condition.
+type notCond struct {
+	inner condition
+}
+
+func (c compareCond) eval(answers map[string]string) bool {
+	answer := answers[c.key]
+	switch c.op {
+	case "==":
+		return valuesEqual(answer, c.value)
+	case "!=":
+		return !valuesEqual(answer, c.value)
+	}
+	a, errA := strconv.ParseFloat(answer, 64)
+	b, errB := strconv.ParseFloat(c.value, 64)
+	if errA != nil || errB != nil {
+		return false
+	}
+	switch c.op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	}
+	return false
+}
+
+func (c inCond) eval(answers map[string]string) bool {
+	for _, v := range c.values {
+		if valuesEqual(answers[c.key], v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c logicCond) eval(answers map[string]string) bool {
+	if c.op == "and" {
+		return c.left.eval(answers) && c.right.eval(answers)
+	}
+	return c.left.eval(answers) || c.right.eval(answers)
+}
+
+func (c notCond) eval(answers map[string]string) bool {
+	return !c.inner.eval(answers)
+}
+
+// valuesEqual compares numbers numerically and anything else case-insensitively.
+func valuesEqual(a, b string) bool {
+	x, errX := strconv.ParseFloat(a, 64)
+	y, errY := strconv.ParseFloat(b, 64)
+	if errX == nil && errY == nil {
+		return x == y
+	}
+	return strings.EqualFold(a, b)
+}
+
+// parseCondition parses expressions such as
+//
+//	smoker == 'yes' and (age < 18 or guardian in ['mother', 'father'])
+//
+// Identifiers name answers (node IDs); literals are quoted strings, numbers or bare words.
+func parseCondition(src string) (condition, error) {
+	toks, err := tokenizeCondition(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &condParser{toks: toks}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos].text)
+	}
+	return c, nil
+}
+
+// condToken is a lexical element of a branch expression; quoted marks string literals.
+type condToken struct {
+	text   string
+	quoted bool
+}
+
+func tokenizeCondition(src string) ([]condToken, error) {
+	var toks []condToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(src[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string starting at %d", i)
+			}
+			toks = append(toks, condToken{text: src[i+1 : i+1+end], quoted: true})
+			i += end + 2
+		case strings.ContainsRune("()[],", rune(c)):
+			toks = append(toks, condToken{text: string(c)})
+			i++
+		case strings.ContainsRune("=!<>", rune(c)):
+			op := string(c)
+			if i+1 < len(src) && src[i+1] == '=' {
+				op += "="
+			}
+			if op == "=" || op == "!" {
+				return nil, fmt.Errorf("unknown operator %q at %d", op, i)
+			}
+			toks = append(toks, condToken{text: op})
+			i += len(op)
+		default:
+			start := i
+			for i < len(src) && (unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i])) || strings.ContainsRune("_-.+", rune(src[i])) || src[i] >= 0x80) {
+				i++
+			}
+			if start == i {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+			toks = append(toks, condToken{text: src[start:i]})
+		}
+	}
+	return toks, nil
+}
+
+type condParser struct {
+	toks []condToken
+	pos  int
+}
+
+// keyword reports whether the next token is the unquoted word kw and consumes it.
+func (p *condParser) keyword(kw string) bool {
+	if p.pos < len(p.toks) && !p.toks[p.pos].quoted && strings.EqualFold(p.toks[p.pos].text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *condParser) next() (condToken, error) {
+	if p.pos >= len(p.toks) {
+		return condToken{}, fmt.Errorf("unexpected end of expression")
+	}
+	t := p.toks[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *condParser) parseOr() (condition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicCond{op: "or", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *condParser) parseAnd() (condition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = logicCond{op: "and", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *condParser) parseNot() (condition, error) {
+	if p.keyword("not") {
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notCond{inner: inner}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *condParser) parsePrimary() (condition, error) {
+	if p.keyword("(") {
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return c, nil
+	}
+
+	key, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if key.quoted || strings.ContainsAny(key.text, "()[],=!<>") {
+		return nil, fmt.Errorf("expected an answer name, got %q", key.text)
+	}
+	if p.keyword("in") {
+		if !p.keyword("[") {
+			return nil, fmt.Errorf("expected [ after in")
+		}
+		var values []string
+		for {
+			v, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			if p.keyword("]") {
+				break
+			}
+			if !p.keyword(",") {
+				return nil, fmt.Errorf("expected , or ] in list")
+			}
+		}
+		return inCond{key: key.text, values: values}, nil
+	}
+
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch op.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return nil, fmt.Errorf("expected a comparison after %q, got %q", key.text, op.text)
+	}
+	value, err := p.literal()
+	if err != nil {
+		return nil, err
+	}
+	if op.text != "==" && op.text != "!=" {
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return nil, fmt.Errorf("%s needs a number, got %q", op.text, value)
+		}
+	}
+	return compareCond{key: key.text, op: op.text, value: value}, nil
+}
+
+func (p *condParser) literal() (string, error) {
+	t, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if !t.quoted && (t.text == "" || strings.ContainsAny(t.text, "()[],=!<>")) {
+		return "", fmt.Errorf("expected a value, got %q", t.text)
+	}
+	return t.text, nil
+}
+
+// compileBranches returns a copy of a node's branches with their conditions
+// parsed. A condition that does not parse is logged and never matches.
+func compileBranches(nodeID string, branches []ConvBranch) []ConvBranch {
+	if len(branches) == 0 {
+		return nil
+	}
+	compiled := make([]ConvBranch, len(branches))
+	for i, b := range branches {
+		c, err := parseCondition(b.When)
+		if err != nil {
+			log.Printf("node %s: branch %q is never taken: %v", nodeID, b.When, err)
+		}
+		b.cond = c
+		compiled[i] = b
+	}
+	return compiled
+}
+
+// branchTarget returns the transition of the first branch whose condition
+// holds, falling back to the node's success_transition.
+func branchTarget(n Node, answers map[string]string) string {
+	for _, b := range n.Branches {
+		if b.cond != nil && b.cond.eval(answers) {
+			return b.Transition
+		}
+	}
+	if n.SuccessTransition != nil {
+		return *n.SuccessTransition
+	}
+	return ""
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseConditionEval(t *testing.T) {
+	answers := map[string]string{"smoker": "yes", "age": "16", "guardian": "Mother", "city": "São Paulo"}
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{"smoker == 'yes'", true},
+		{"smoker == YES", true},
+		{"smoker != yes", false},
+		{"age < 18", true},
+		{"age >= 18", false},
+		{"age == 16.0", true},
+		{"guardian in ['mother', 'father']", true},
+		{"guardian in [aunt]", false},
+		{"smoker == yes and age >= 18", false},
+		{"smoker == yes and (age >= 18 or guardian in [mother])", true},
+		{"not smoker == no", true},
+		{"missing == ''", true},
+		{"missing > 3", false},
+		{`city == "São Paulo"`, true},
+		{"age < 18 or age > 65 and smoker == no", true},
+	}
+	for _, c := range cases {
+		cond, err := parseCondition(c.expr)
+		if err != nil {
+			t.Errorf("parseCondition(%q) error: %v", c.expr, err)
+			continue
+		}
+		if got := cond.eval(answers); got != c.want {
+			t.Errorf("%q = %v, want %v", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestParseConditionErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"smoker = yes",
+		"smoker == ",
+		"age < old",
+		"(age < 18",
+		"smoker in [yes",
+		"'smoker' == yes",
+		"smoker == yes extra",
+		"smoker == 'yes",
+	} {
+		if _, err := parseCondition(expr); err == nil {
+			t.Errorf("parseCondition(%q) succeeded, want error", expr)
+		}
+	}
+}
+
+func TestBranchNodeRoutesByAnswers(t *testing.T) {
+	resetGlobals()
+	originalSend := sendReply
+	defer func() { sendReply = originalSend }()
+	sendReply = func(id int64, text string) error { return nil }
+
+	g := buildConversation(&ConversationFile{Messages: []ConvMessage{
+		{ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("age")},
+		{ID: "age", Type: "question", Text: "Age?", SuccessTransition: strPtr("smoker")},
+		{ID: "smoker", Type: "question", Text: "Smoke?", SuccessTransition: strPtr("route")},
+		{ID: "route", Type: "branch", SuccessTransition: strPtr("photo"), Branches: []ConvBranch{
+			{When: "age < 18", Transition: "guardian"},
+			{When: "smoker in [yes, sometimes]", Transition: "tobacco"},
+		}},
+		{ID: "guardian", Type: "question", Text: "Guardian consent?"},
+		{ID: "tobacco", Type: "question", Text: "How many years?"},
+		{ID: "photo", Type: "question", Text: "Photo please"},
+	}})
+	g.install()
+
+	for _, c := range []struct {
+		chat       int64
+		age, smoke string
+		want       string
+	}{
+		{1, "15", "yes", "guardian"},
+		{2, "40", "Yes", "tobacco"},
+		{3, "40", "no", "photo"},
+	} {
+		for _, text := range []string{"hello", c.age, c.smoke} {
+			captureOutput(t, func() { printMessage(&Message{Chat: Chat{ID: c.chat}, Text: text}) })
+		}
+		if got := chatStateFor(c.chat).Awaiting; got != c.want {
+			t.Errorf("chat %d: routed to %q, want %q", c.chat, got, c.want)
+		}
+	}
+}
+
+func TestValidateConversationChecksBranches(t *testing.T) {
+	cf := &ConversationFile{Messages: []ConvMessage{
+		{ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("route")},
+		{ID: "route", Type: "branch", Branches: []ConvBranch{
+			{When: "age <", Transition: "q"},
+			{When: "age > 1", Transition: "ghost"},
+			{When: "age > 2", Transition: "again"},
+		}},
+		{ID: "again", Type: "start_message", Text: "again", SuccessTransition: strPtr("route")},
+		{ID: "q", Type: "question", Text: "?", FailTransition: strPtr("q")},
+		{ID: "empty", Type: "branch"},
+	}}
+	issues := strings.Join(validateConversation(cf), "\n")
+	for _, want := range []string{
+		`node "route": invalid branch condition "age <"`,
+		`node "route": branch "age > 1" transition points to unknown node "ghost"`,
+		"nodes route -> again -> route loop without waiting for input",
+		`node "empty": branch has no branches and no success_transition`,
+	} {
+		if !strings.Contains(issues, want) {
+			t.Errorf("missing issue %q in:\n%s", want, issues)
+		}
+	}
+}
+
+func TestBranchConditionsAreCompiledOnce(t *testing.T) {
+	branches := []ConvBranch{{When: "age < 18", Transition: "minor"}, {When: "age <", Transition: "broken"}}
+	g := buildConversation(&ConversationFile{Messages: []ConvMessage{
+		{ID: "route", Type: "branch", SuccessTransition: strPtr("adult"), Branches: branches},
+	}})
+	route := g.nodes["route"]
+	if route.Branches[0].cond == nil || route.Branches[1].cond != nil || branches[0].cond != nil {
+		t.Fatalf("expected the node's own compiled copy, got %+v", route.Branches)
+	}
+	if got := branchTarget(route, map[string]string{"age": "12"}); got != "minor" {
+		t.Fatalf("routed to %q, want minor", got)
+	}
+	if got := branchTarget(route, map[string]string{"age": "30"}); got != "adult" {
+		t.Fatalf("routed to %q, want adult", got)
+	}
+}
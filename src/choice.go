@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// choiceCallbackPrefix marks callback data produced by choice node buttons.
+const choiceCallbackPrefix = "choice:"
+
+// maxCallbackData is the most bytes Telegram accepts as a button's callback data.
+const maxCallbackData = 64
+
+// choiceKeyboard renders a choice node's options as one inline button per row.
+func choiceKeyboard(n Node, locale string) *InlineKeyboardMarkup {
+	markup := &InlineKeyboardMarkup{}
+	for i, opt := range n.Options {
+		markup.InlineKeyboard = append(markup.InlineKeyboard, []InlineKeyboardButton{{
+			Text:         optionLabel(opt, locale),
+			CallbackData: choiceCallbackData(n.ID, i),
+		}})
+	}
+	return markup
+}
+
+// choiceCallbackData encodes the node and option index into a button payload.
+// Telegram limits callback data to 64 bytes, so the option is referenced by index.
+func choiceCallbackData(nodeID string, index int) string {
+	return choiceCallbackPrefix + nodeID + ":" + strconv.Itoa(index)
+}
+
+// parseChoiceCallback decodes data produced by choiceCallbackData.
+func parseChoiceCallback(data string) (string, int, bool) {
+	if !strings.HasPrefix(data, choiceCallbackPrefix) {
+		return "", 0, false
+	}
+	rest := strings.TrimPrefix(data, choiceCallbackPrefix)
+	sep := strings.LastIndex(rest, ":")
+	if sep <= 0 {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(rest[sep+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	return rest[:sep], index, true
+}
+
+// optionValue returns the value stored in Answers when an option is picked.
+func optionValue(opt ConvOption) string {
+	if opt.Value != "" {
+		return opt.Value
+	}
+	return opt.Label
+}
+
+// handleCallbackQuery answers a button press and applies it to the awaiting choice node.
+func handleCallbackQuery(cq *CallbackQuery) {
+	if cq.Message == nil {
+		if err := answerCallback(cq.ID, ""); err != nil {
+			log.Printf("answer callback error: %v", err)
+		}
+		return
+	}
+	chatID := cq.Message.Chat.ID
+	fmt.Printf("[callback] chat:%d data:%s\n", chatID, strconv.Quote(cq.Data))
+
+	nodeID, index, ok := parseChoiceCallback(cq.Data)
+	st := chatStateFor(chatID)
+	touchChat(st)
+	if cq.From != nil {
+		rememberSender(st, cq.From)
+	}
+	if wait := blockedFor(chatID, st); wait > 0 {
+		if err := answerCallback(cq.ID, msg(chatLocale(st), "attempts.wait", waitMinutes(wait))); err != nil {
+			log.Printf("answer callback error: %v", err)
+		}
+		return
+	}
+	// The node this chat was waiting on may have been removed by a reload.
+	if st.Awaiting != "" {
+		if _, ok := lookupNode(st.Awaiting); !ok {
+			if err := answerCallback(cq.ID, msg(chatLocale(st), "choice.stale")); err != nil {
+				log.Printf("answer callback error: %v", err)
+			}
+			relocateChat(chatID, st)
+			return
+		}
+	}
+	if consentNode, accepted, isConsent := parseConsentCallback(cq.Data); isConsent {
+		n, known := lookupNode(consentNode)
+		text := ""
+		if !known || st.Awaiting != consentNode {
+			text = msg(chatLocale(st), "choice.stale")
+		}
+		if err := answerCallback(cq.ID, text); err != nil {
+			log.Printf("answer callback error: %v", err)
+		}
+		if text == "" {
+			answerConsent(chatID, n, accepted)
+		}
+		return
+	}
+	if backFrom, isBack := parseBackCallback(cq.Data); isBack {
+		text := ""
+		if st.Awaiting != backFrom {
+			text = msg(chatLocale(st), "choice.stale")
+		}
+		if err := answerCallback(cq.ID, text); err != nil {
+			log.Printf("answer callback error: %v", err)
+		}
+		if text == "" {
+			handleBack(chatID)
+		}
+		return
+	}
+	node, known := lookupNode(nodeID)
+	if !ok || !known || st.Awaiting != nodeID || index < 0 || index >= len(node.Options) {
+		if err := answerCallback(cq.ID, msg(chatLocale(st), "choice.stale")); err != nil {
+			log.Printf("answer callback error: %v", err)
+		}
+		return
+	}
+
+	if err := answerCallback(cq.ID, ""); err != nil {
+		log.Printf("answer callback error: %v", err)
+	}
+	applyChoice(chatID, node, node.Options[index])
+}
+
+// handleChoiceText accepts a typed answer matching one of the option labels or values,
+// otherwise repeats the keyboard.
+func handleChoiceText(chatID int64, n Node, text string) {
+	locale := chatLocale(chatStateFor(chatID))
+	text = strings.TrimSpace(text)
+	for _, opt := range n.Options {
+		if text != "" && (strings.EqualFold(text, opt.Label) || strings.EqualFold(text, optionLabel(opt, locale)) || strings.EqualFold(text, optionValue(opt))) {
+			applyChoice(chatID, n, opt)
+			return
+		}
+	}
+	if err := sendReplyWith(chatID, msg(locale, "choice.prompt"), ReplyOptions{ReplyMarkup: choiceKeyboard(n, locale), ListButton: msg(locale, "choice.list_button")}); err != nil {
+		log.Printf("send choice reminder error: %v", err)
+	}
+}
+
+// applyChoice stores the selected option and follows its transition, falling back
+// to the node's success transition.
+func applyChoice(chatID int64, n Node, opt ConvOption) {
+	st := chatStateFor(chatID)
+	st.Answers[n.ID] = optionValue(opt)
+	fmt.Printf("[conversation] chat:%d chose(%s): %s\n", chatID, n.ID, optionValue(opt))
+
+	if opt.Transition == nil || *opt.Transition == "" {
+		if !applyTransition(chatID, n.ID, true) {
+			log.Printf("no success transition defined for node %s", n.ID)
+		}
+		return
+	}
+	if st.Awaiting == n.ID {
+		st.Awaiting = ""
+	}
+	advanceChatState(chatID, *opt.Transition)
+}
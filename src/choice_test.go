@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestChoiceNodeCallbackFlow(t *testing.T) {
+	resetGlobals()
+	originalSend, originalSendWith, originalAnswer := sendReply, sendReplyWith, answerCallback
+	defer func() { sendReply, sendReplyWith, answerCallback = originalSend, originalSendWith, originalAnswer }()
+
+	var sent []string
+	var keyboards []*InlineKeyboardMarkup
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+	sendReplyWith = func(id int64, text string, opts ReplyOptions) error {
+		sent = append(sent, text)
+		keyboards = append(keyboards, opts.ReplyMarkup)
+		return nil
+	}
+	answered := map[string]string{}
+	answerCallback = func(id, text string) error {
+		answered[id] = text
+		return nil
+	}
+
+	nodes = map[string]Node{
+		"start": {ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("smoker")},
+		"smoker": {ID: "smoker", Type: "choice", Text: "Do you smoke?", SuccessTransition: strPtr("done"), Options: []ConvOption{
+			{Label: "Yes", Value: "yes", Transition: strPtr("tobacco")},
+			{Label: "No", Value: "no"},
+		}},
+		"tobacco": {ID: "tobacco", Type: "question", Text: "How many per day?"},
+		"done":    {ID: "done", Type: "question", Text: "Anything else?"},
+	}
+	startNodeID = "start"
+
+	chat := Chat{ID: 77}
+	captureOutput(t, func() { printMessage(&Message{Chat: chat, Text: "hello"}) })
+	if len(keyboards) != 1 || keyboards[0] == nil || len(keyboards[0].InlineKeyboard) != 2 {
+		t.Fatalf("expected a two-button keyboard, got %#v", keyboards)
+	}
+	if got := keyboards[0].InlineKeyboard[0][0].CallbackData; got != "choice:smoker:0" {
+		t.Fatalf("unexpected callback data %q", got)
+	}
+
+	captureOutput(t, func() {
+		handleUpdate(Update{CallbackQuery: &CallbackQuery{ID: "cb1", Message: &Message{Chat: chat}, Data: "choice:smoker:0"}})
+	})
+	st := chatStateFor(77)
+	if st.Answers["smoker"] != "yes" {
+		t.Fatalf("expected answer yes, got %q", st.Answers["smoker"])
+	}
+	if st.Awaiting != "tobacco" {
+		t.Fatalf("expected option transition to tobacco, got %q", st.Awaiting)
+	}
+	if text, ok := answered["cb1"]; !ok || text != "" {
+		t.Fatalf("callback not answered cleanly: %v", answered)
+	}
+
+	// Pressing the old button again is rejected with a notice.
+	captureOutput(t, func() {
+		handleUpdate(Update{CallbackQuery: &CallbackQuery{ID: "cb2", Message: &Message{Chat: chat}, Data: "choice:smoker:1"}})
+	})
+	if answered["cb2"] == "" {
+		t.Fatalf("expected stale press to be answered with a notice")
+	}
+	if chatStateFor(77).Awaiting != "tobacco" {
+		t.Fatalf("stale press changed the conversation")
+	}
+}
+
+func TestChoiceNodeAcceptsTypedOption(t *testing.T) {
+	resetGlobals()
+	originalSend, originalSendWith := sendReply, sendReplyWith
+	defer func() { sendReply, sendReplyWith = originalSend, originalSendWith }()
+
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+	sendReplyWith = func(id int64, text string, opts ReplyOptions) error {
+		sent = append(sent, text)
+		return nil
+	}
+	nodes = map[string]Node{
+		"start": {ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("pain")},
+		"pain": {ID: "pain", Type: "choice", Text: "Any pain?", SuccessTransition: strPtr("done"), Options: []ConvOption{
+			{Label: "Yes"}, {Label: "No"},
+		}},
+		"done": {ID: "done", Type: "question", Text: "Thanks"},
+	}
+	startNodeID = "start"
+
+	chat := Chat{ID: 5}
+	captureOutput(t, func() {
+		printMessage(&Message{Chat: chat, Text: "hello"})
+		printMessage(&Message{Chat: chat, Text: "maybe"})
+	})
+	if sent[len(sent)-1] != "Please choose one of the options below." {
+		t.Fatalf("expected a reminder for unknown option, got %v", sent)
+	}
+	captureOutput(t, func() { printMessage(&Message{Chat: chat, Text: "no"}) })
+	st := chatStateFor(5)
+	if st.Answers["pain"] != "No" || st.Awaiting != "done" {
+		t.Fatalf("typed option not applied: %#v", st)
+	}
+}
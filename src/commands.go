@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// BotCommand is an entry of the command menu registered with setMyCommands.
+type BotCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+// builtinCommands lists the commands every conversation supports, in menu
+// order; their descriptions live in the catalog under "command.<name>".
+var builtinCommands = []string{"start", "restart", "back", "cancel", "status", "language", "help"}
+
+// adminCommands are handled like built-ins but left out of the menu.
+var adminCommands = []string{"unlock"}
+
+// customCommands maps conversation-defined commands to their target node.
+var customCommands map[string]ConvCommand
+
+// isBuiltinCommand reports whether name is handled by the bot itself, so a
+// conversation cannot take it over.
+func isBuiltinCommand(name string) bool {
+	for _, list := range [][]string{builtinCommands, adminCommands} {
+		for _, c := range list {
+			if c == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// commandRegistrar is implemented by transports that can publish a command menu.
+type commandRegistrar interface {
+	SetCommands(cmds []BotCommand, languageCode string) error
+}
+
+// parseCommand splits "/name@bot args" into a lower-case name and its arguments.
+func parseCommand(text string) (string, string, bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "/") || len(text) < 2 {
+		return "", "", false
+	}
+	name, args := text[1:], ""
+	if i := strings.IndexAny(name, " \t\n"); i >= 0 {
+		name, args = name[:i], strings.TrimSpace(name[i+1:])
+	}
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	if name == "" {
+		return "", "", false
+	}
+	return strings.ToLower(name), args, true
+}
+
+// allCommands returns the built-in commands followed by the conversation's own.
+func allCommands(locale string) []BotCommand {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	cmds := make([]BotCommand, 0, len(builtinCommands)+len(customCommands))
+	for _, name := range builtinCommands {
+		cmds = append(cmds, BotCommand{Command: name, Description: msg(locale, "command."+name)})
+	}
+	names := make([]string, 0, len(customCommands))
+	for name := range customCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmds = append(cmds, BotCommand{Command: name, Description: customCommands[name].Description})
+	}
+	ids := make([]string, 0, len(flows))
+	for id := range flows {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if f := flows[id]; f.Command != "" {
+			desc := f.Description
+			if desc == "" {
+				desc = f.ID
+			}
+			cmds = append(cmds, BotCommand{Command: strings.ToLower(strings.TrimPrefix(f.Command, "/")), Description: desc})
+		}
+	}
+	return cmds
+}
+
+// handleCommand runs a bot command found in m, reporting whether the message was one.
+func handleCommand(m *Message) bool {
+	name, args, ok := parseCommand(m.Text)
+	if !ok {
+		return false
+	}
+	chatID := m.Chat.ID
+	locale := chatLocale(chatStateFor(chatID))
+	fmt.Printf("[command] chat:%d /%s\n", chatID, name)
+
+	switch name {
+	case "start":
+		// "/start <payload>" comes from a t.me/<bot>?start=<payload> deep link.
+		startFlow(chatID, chooseFlow(args))
+	case "restart":
+		restartConversation(chatID)
+	case "back":
+		handleBack(chatID)
+	case "cancel":
+		resetChatState(chatID, false)
+		saveChatState(chatID)
+		replyOrLog(chatID, msg(locale, "command.cancelled"))
+	case "help":
+		var b strings.Builder
+		b.WriteString(msg(locale, "command.help_header"))
+		for _, c := range allCommands(locale) {
+			fmt.Fprintf(&b, "\n/%s - %s", c.Command, c.Description)
+		}
+		replyOrLog(chatID, b.String())
+	case "status":
+		replyOrLog(chatID, statusText(chatStateFor(chatID)))
+	case "language":
+		handleLanguageCommand(chatID, args)
+	case "unlock":
+		handleUnlock(chatID, args)
+	default:
+		configMu.RLock()
+		cmd, ok := customCommands[name]
+		configMu.RUnlock()
+		if f, isFlow := flowCommand(name); !ok && isFlow {
+			startFlow(chatID, f.ID)
+			return true
+		}
+		if !ok {
+			replyOrLog(chatID, msg(locale, "command.unknown"))
+			return true
+		}
+		// A command is a shortcut inside the conversation, not a way around
+		// its sign-in or consent.
+		st := chatStateFor(chatID)
+		if !st.Authed && conversationSignsIn() {
+			replyOrLog(chatID, msg(locale, "command.sign_in"))
+			if !st.Started {
+				startFlow(chatID, chooseFlow(""))
+			}
+			return true
+		}
+		st.Started = true
+		st.Awaiting = ""
+		if consentMissing(chatID, st) {
+			redirectToConsent(chatID, st, cmd.Node)
+			return true
+		}
+		advanceChatState(chatID, cmd.Node)
+	}
+	return true
+}
+
+// restartConversation clears the chat's progress and starts its flow again.
+func restartConversation(chatID int64) {
+	st := chatStateFor(chatID)
+	flow := st.Flow
+	if _, ok := lookupFlow(flow); !ok {
+		flow = chooseFlow("")
+	}
+	startFlow(chatID, flow)
+}
+
+// statusText describes where the chat currently is in the conversation.
+func statusText(st *ChatState) string {
+	locale := chatLocale(st)
+	if !st.Started {
+		return msg(locale, "status.idle")
+	}
+	if st.Awaiting == "" {
+		return msg(locale, "status.waiting")
+	}
+	n, ok := lookupNode(st.Awaiting)
+	if !ok {
+		return msg(locale, "status.step", st.Awaiting, "")
+	}
+	text, _ := renderNodeText(st, n)
+	status := msg(locale, "status.step", n.ID, text)
+	if st.Username != "" {
+		status += msg(locale, "status.signed_in", st.Username)
+	}
+	return status
+}
+
+// replyOrLog sends a plain reply, logging delivery failures.
+func replyOrLog(chatID int64, text string) {
+	if err := sendReply(chatID, text); err != nil {
+		log.Printf("send reply to chat %d error: %v", chatID, err)
+	}
+}
+
+// SetCommands publishes the command menu through setMyCommands.
+func (t *telegramTransport) SetCommands(cmds []BotCommand, languageCode string) error {
+	data, err := json.Marshal(cmds)
+	if err != nil {
+		return err
+	}
+	values := url.Values{}
+	values.Set("commands", string(data))
+	if languageCode != "" {
+		values.Set("language_code", languageCode)
+	}
+
+	resp, err := t.client.PostForm(t.base+"setMyCommands", values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return newAPIError("setMyCommands", resp.StatusCode, body)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	cases := []struct {
+		in, name, args string
+		ok             bool
+	}{
+		{"/start", "start", "", true},
+		{"/Help@DiagnoseBot", "help", "", true},
+		{"/start campaign-1", "start", "campaign-1", true},
+		{"hello", "", "", false},
+		{"/", "", "", false},
+		{"/@bot", "", "", false},
+	}
+	for _, c := range cases {
+		name, args, ok := parseCommand(c.in)
+		if name != c.name || args != c.args || ok != c.ok {
+			t.Errorf("parseCommand(%q) = %q, %q, %v", c.in, name, args, ok)
+		}
+	}
+}
+
+func TestCommandsRunBeforeNodeHandling(t *testing.T) {
+	resetGlobals()
+	originalSend := sendReply
+	defer func() { sendReply = originalSend }()
+
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+
+	nodes = map[string]Node{
+		"start": {ID: "start", Type: "start_message", Text: "welcome", SuccessTransition: strPtr("name")},
+		"name":  {ID: "name", Type: "question", Text: "What is your name?", SuccessTransition: strPtr("age")},
+		"age":   {ID: "age", Type: "question", Text: "How old are you?"},
+		"faq":   {ID: "faq", Type: "question", Text: "What would you like to know?"},
+	}
+	startNodeID = "start"
+	customCommands = map[string]ConvCommand{"faq": {Command: "faq", Description: "Ask a question", Node: "faq"}}
+
+	chat := Chat{ID: 5}
+	send := func(text string) {
+		sent = nil
+		captureOutput(t, func() { printMessage(&Message{Chat: chat, Text: text}) })
+	}
+
+	send("/start")
+	if st := chatStateFor(5); !st.Started || st.Awaiting != "name" {
+		t.Fatalf("expected /start to begin the flow, got %+v", st)
+	}
+	send("Ana")
+	if chatStateFor(5).Awaiting != "age" {
+		t.Fatalf("expected to advance to age")
+	}
+
+	// A command is not taken as the answer to the pending question.
+	send("/status")
+	st := chatStateFor(5)
+	if _, ok := st.Answers["age"]; ok || st.Awaiting != "age" {
+		t.Fatalf("/status was handled as an answer: %+v", st)
+	}
+	if len(sent) != 1 || !strings.Contains(sent[0], "How old are you?") {
+		t.Fatalf("unexpected status reply %q", sent)
+	}
+
+	send("/help")
+	if len(sent) != 1 || !strings.Contains(sent[0], "/faq - Ask a question") || !strings.Contains(sent[0], "/cancel") {
+		t.Fatalf("unexpected help reply %q", sent)
+	}
+
+	send("/restart")
+	if st := chatStateFor(5); st.Awaiting != "name" || len(st.Answers) != 0 {
+		t.Fatalf("expected /restart to clear answers and go back to the start, got %+v", st)
+	}
+
+	send("/faq")
+	if chatStateFor(5).Awaiting != "faq" {
+		t.Fatalf("expected custom command to jump to faq")
+	}
+
+	send("/cancel")
+	if st := chatStateFor(5); st.Started || st.Awaiting != "" {
+		t.Fatalf("expected /cancel to reset the chat, got %+v", st)
+	}
+
+	send("/bogus")
+	if len(sent) != 1 || !strings.Contains(sent[0], "Unknown command") {
+		t.Fatalf("unexpected reply to unknown command %q", sent)
+	}
+}
+
+func TestCustomCommandsCannotShadowBuiltins(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	cf := &ConversationFile{
+		Messages: []ConvMessage{
+			{ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("faq")},
+			{ID: "faq", Type: "question", Text: "?", SuccessTransition: strPtr("start"), FailTransition: strPtr("faq")},
+		},
+		Commands: []ConvCommand{
+			{Command: "/help", Description: "Our help", Node: "faq"},
+			{Command: "faq", Description: "FAQ", Node: "faq"},
+			{Command: "FAQ", Description: "FAQ again", Node: "faq"},
+		},
+	}
+	issues := strings.Join(validateConversation(cf), "\n")
+	for _, want := range []string{"command /help is a built-in command", "command /faq is defined twice"} {
+		if !strings.Contains(issues, want) {
+			t.Errorf("missing issue %q in:\n%s", want, issues)
+		}
+	}
+
+	g := buildConversation(cf)
+	g.install()
+	help := 0
+	for _, c := range allCommands("en") {
+		if c.Command == "help" {
+			help++
+			if c.Description != msg("en", "command.help") {
+				t.Errorf("menu shows the conversation's /help: %+v", c)
+			}
+		}
+	}
+	if help != 1 {
+		t.Fatalf("expected /help once in the menu, got %d", help)
+	}
+}
+
+func TestCustomCommandsKeepSignInAndConsent(t *testing.T) {
+	sent, _ := setupChatTest(t)
+	authUsers = map[string]string{"ana": "1"}
+	g := buildConversation(&ConversationFile{
+		Messages: []ConvMessage{
+			{ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("user")},
+			{ID: "user", Type: "question", Text: "Username?", Action: "auth.username", SuccessTransition: strPtr("pass"), FailTransition: strPtr("user")},
+			{ID: "pass", Type: "question", Text: "Password?", Action: "auth.password", SuccessTransition: strPtr("terms"), FailTransition: strPtr("user")},
+			{ID: "terms", Type: "consent", Text: "May we use your photos?", ConsentVersion: "v1", SuccessTransition: strPtr("photo")},
+			{ID: "photo", Type: "start_message", Text: "Photo please", ExpectPhoto: true, SuccessTransition: strPtr("end"), FailTransition: strPtr("photo")},
+			{ID: "end", Type: "end_message", Text: "bye"},
+		},
+		Commands: []ConvCommand{{Command: "photo", Description: "Send a photo", Node: "photo"}},
+	})
+	g.install()
+	const chatID = 6
+
+	sendText(chatID, "/photo")
+	st := chatStateFor(chatID)
+	if st.Awaiting != "user" || !containsText(*sent, msg("en", "command.sign_in")) || containsText(*sent, "Photo please") {
+		t.Fatalf("command skipped the sign-in: %q / %v", st.Awaiting, *sent)
+	}
+	sendText(chatID, "ana")
+	sendText(chatID, "1")
+	if st.Awaiting != "terms" {
+		t.Fatalf("expected the consent after signing in, got %q", st.Awaiting)
+	}
+
+	// Signed in but without consent, the command goes through the consent first.
+	*sent = nil
+	sendText(chatID, "/photo")
+	if st.Awaiting != "terms" || containsText(*sent, "Photo please") {
+		t.Fatalf("command skipped the consent: %q / %v", st.Awaiting, *sent)
+	}
+	sendText(chatID, "i agree")
+	if st.Awaiting != "photo" {
+		t.Fatalf("expected the command's node after consenting, got %q", st.Awaiting)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consentCallbackPrefix marks callback data produced by consent node buttons.
+const consentCallbackPrefix = "consent:"
+
+// ConsentRecord is one audited acceptance of a consent text.
+type ConsentRecord struct {
+	TelegramUserID int64  `json:"telegram_user_id"`
+	ChatID         int64  `json:"chat_id"`
+	Version        string `json:"version"`
+	AcceptedAt     string `json:"accepted_at"` // RFC3339, UTC
+}
+
+// Consent records, append-only and persisted to consentFile on every acceptance.
+var (
+	consentMu      sync.Mutex
+	consentRecords []ConsentRecord
+	consentFile    string
+)
+
+// The consent the running conversation asks for, swapped with nodes under configMu.
+var (
+	consentNodeID  string
+	consentVersion string
+)
+
+// loadConsents reads the consent log, creating the file if needed. The file
+// only becomes the log new consents are written to once it has been read, so
+// an unreadable log is never overwritten.
+func loadConsents(path string) error {
+	consentMu.Lock()
+	defer consentMu.Unlock()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) || (err == nil && len(data) == 0) {
+		if err := writeFileAtomic(path, []byte("[]\n"), 0o600); err != nil {
+			return err
+		}
+		consentRecords, consentFile = nil, path
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []ConsentRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return fmt.Errorf("decode consents: %w", err)
+	}
+	consentRecords, consentFile = records, path
+	return nil
+}
+
+// recordConsent appends rec to the consent log and writes it to disk. Without a
+// consent file (tests, the simulator) records are kept in memory only.
+func recordConsent(rec ConsentRecord) error {
+	consentMu.Lock()
+	defer consentMu.Unlock()
+	records := append(consentRecords, rec)
+	if consentFile != "" {
+		data, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(consentFile, data, 0o600); err != nil {
+			return err
+		}
+	}
+	consentRecords = records
+	return nil
+}
+
+// hasConsent reports whether userID accepted the given consent version.
+func hasConsent(userID int64, version string) bool {
+	consentMu.Lock()
+	defer consentMu.Unlock()
+	for _, r := range consentRecords {
+		if r.TelegramUserID == userID && r.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// currentConsent returns the consent node and version of the running conversation.
+func currentConsent() (string, string) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return consentNodeID, consentVersion
+}
+
+// consentMissing reports whether the conversation asks for a consent the chat's
+// user has not given for the current version.
+func consentMissing(chatID int64, st *ChatState) bool {
+	_, version := currentConsent()
+	return version != "" && !hasConsent(chatUserID(chatID, st), version)
+}
+
+// redirectToConsent refuses to go on without consent and shows the consent
+// node; after accepting, the chat resumes at the given node.
+func redirectToConsent(chatID int64, st *ChatState, resume string) {
+	node, _ := currentConsent()
+	log.Printf("chat %d has no valid consent, asking for it before going on to %q", chatID, resume)
+	replyOrLog(chatID, msg(chatLocale(st), "consent.required"))
+	if resume != "" && resume != node {
+		st.ConsentReturn = resume
+	}
+	st.Started = true
+	st.Awaiting = ""
+	advanceChatState(chatID, node)
+}
+
+// consentKeyboard renders the accept and decline buttons of a consent node.
+func consentKeyboard(n Node, locale string) *InlineKeyboardMarkup {
+	return &InlineKeyboardMarkup{InlineKeyboard: [][]InlineKeyboardButton{
+		{{Text: msg(locale, "consent.accept"), CallbackData: consentCallbackData(n.ID, true)}},
+		{{Text: msg(locale, "consent.decline"), CallbackData: consentCallbackData(n.ID, false)}},
+	}}
+}
+
+// consentCallbackData encodes a consent node and the answer into a button payload.
+func consentCallbackData(nodeID string, accepted bool) string {
+	if accepted {
+		return consentCallbackPrefix + nodeID + ":accept"
+	}
+	return consentCallbackPrefix + nodeID + ":decline"
+}
+
+// parseConsentCallback decodes data produced by consentKeyboard.
+func parseConsentCallback(data string) (nodeID string, accepted bool, ok bool) {
+	if !strings.HasPrefix(data, consentCallbackPrefix) {
+		return "", false, false
+	}
+	rest := strings.TrimPrefix(data, consentCallbackPrefix)
+	sep := strings.LastIndex(rest, ":")
+	if sep <= 0 {
+		return "", false, false
+	}
+	switch rest[sep+1:] {
+	case "accept":
+		return rest[:sep], true, true
+	case "decline":
+		return rest[:sep], false, true
+	}
+	return "", false, false
+}
+
+// showConsent sends a consent node, or moves on right away when the user
+// already accepted its version.
+func showConsent(chatID int64, st *ChatState, n Node) {
+	st.Awaiting = n.ID
+	if hasConsent(chatUserID(chatID, st), n.ConsentVersion) {
+		finishConsent(chatID, st, n)
+		return
+	}
+	text, opts := renderNodeText(st, n)
+	opts.ReplyMarkup = consentKeyboard(n, chatLocale(st))
+	fmt.Printf("[conversation] chat:%d consent(%s) version:%s\n", chatID, n.ID, n.ConsentVersion)
+	if err := sendReplyWith(chatID, text, opts); err != nil {
+		log.Printf("send consent error: %v", err)
+	}
+}
+
+// handleConsentText accepts the accept or decline label typed as text,
+// otherwise repeats the buttons.
+func handleConsentText(chatID int64, n Node, text string) {
+	st := chatStateFor(chatID)
+	locale := chatLocale(st)
+	text = strings.TrimSpace(text)
+	switch {
+	case strings.EqualFold(text, msg(locale, "consent.accept")):
+		answerConsent(chatID, n, true)
+	case strings.EqualFold(text, msg(locale, "consent.decline")):
+		answerConsent(chatID, n, false)
+	default:
+		if err := sendReplyWith(chatID, msg(locale, "consent.prompt"), ReplyOptions{ReplyMarkup: consentKeyboard(n, locale)}); err != nil {
+			log.Printf("send consent reminder error: %v", err)
+		}
+	}
+}
+
+// answerConsent records an acceptance, or handles a decline, for consent node n.
+func answerConsent(chatID int64, n Node, accepted bool) {
+	st := chatStateFor(chatID)
+	locale := chatLocale(st)
+	if !accepted {
+		fmt.Printf("[conversation] chat:%d consent(%s) declined\n", chatID, n.ID)
+		st.ConsentReturn = ""
+		if n.FailTransition != nil && *n.FailTransition != "" {
+			applyTransition(chatID, n.ID, false)
+			return
+		}
+		resetChatState(chatID, false)
+		saveChatState(chatID)
+		replyOrLog(chatID, msg(locale, "consent.declined"))
+		return
+	}
+
+	rec := ConsentRecord{
+		TelegramUserID: chatUserID(chatID, st),
+		ChatID:         chatID,
+		Version:        n.ConsentVersion,
+		AcceptedAt:     clock().UTC().Format(time.RFC3339),
+	}
+	if err := recordConsent(rec); err != nil {
+		log.Printf("record consent for chat %d: %v", chatID, err)
+		replyOrLog(chatID, msg(locale, "consent.store_failed"))
+		return
+	}
+	fmt.Printf("[conversation] chat:%d consent(%s) accepted version:%s\n", chatID, n.ID, n.ConsentVersion)
+	finishConsent(chatID, st, n)
+}
+
+// finishConsent leaves an accepted consent node, resuming where the chat was
+// sent from if it was redirected here.
+func finishConsent(chatID int64, st *ChatState, n Node) {
+	if target := st.ConsentReturn; target != "" {
+		st.ConsentReturn = ""
+		if _, ok := lookupNode(target); ok {
+			st.Awaiting = ""
+			advanceChatState(chatID, target)
+			return
+		}
+	}
+	if !applyTransition(chatID, n.ID, true) {
+		log.Printf("no success transition defined for consent node %s", n.ID)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// consentConversation asks for consent before the photo.
+var consentConversation = []ConvMessage{
+	{ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("terms")},
+	{ID: "terms", Type: "consent", Text: "May we use your photos?", ConsentVersion: "v1", SuccessTransition: strPtr("photo")},
+	{ID: "photo", Type: "start_message", Text: "Photo please", ExpectPhoto: true, SuccessTransition: strPtr("end"), FailTransition: strPtr("photo")},
+	{ID: "end", Type: "end_message", Text: "bye"},
+}
+
+func consentPress(chatID int64, userID int, data string) {
+	handleCallbackQuery(&CallbackQuery{ID: "1", From: &User{ID: userID}, Message: &Message{Chat: Chat{ID: chatID}}, Data: data})
+}
+
+func TestConsentAcceptIsRecorded(t *testing.T) {
+	sent, now := setupChatTest(t, consentConversation...)
+	*now = time.Date(2024, 5, 2, 13, 0, 0, 0, time.FixedZone("BRT", -3*3600))
+	path := filepath.Join(t.TempDir(), "consents.json")
+	if err := loadConsents(path); err != nil {
+		t.Fatal(err)
+	}
+	const chatID = 21
+	printMessage(&Message{Chat: Chat{ID: chatID}, From: &User{ID: 501}, Text: "hi"})
+	st := chatStateFor(chatID)
+	if st.Awaiting != "terms" || !containsText(*sent, "May we use your photos?") {
+		t.Fatalf("expected the consent text, got %q / %v", st.Awaiting, *sent)
+	}
+
+	consentPress(chatID, 501, "consent:terms:accept")
+	if st.Awaiting != "photo" {
+		t.Fatalf("expected to move on after accepting, got %q", st.Awaiting)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []ConsentRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		t.Fatal(err)
+	}
+	want := ConsentRecord{TelegramUserID: 501, ChatID: chatID, Version: "v1", AcceptedAt: "2024-05-02T16:00:00Z"}
+	if len(records) != 1 || records[0] != want {
+		t.Fatalf("unexpected consent log %+v", records)
+	}
+
+	// The log survives a restart.
+	consentRecords = nil
+	if err := loadConsents(path); err != nil || !hasConsent(501, "v1") {
+		t.Fatalf("consent not reloaded: %v", err)
+	}
+}
+
+func TestCorruptConsentLogIsNotOverwritten(t *testing.T) {
+	setupChatTest(t, consentConversation...)
+	path := filepath.Join(t.TempDir(), "consents.json")
+	if err := os.WriteFile(path, []byte("[{broken"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConsents(path); err == nil {
+		t.Fatal("expected a corrupt consent log to be reported")
+	}
+	if err := recordConsent(ConsentRecord{TelegramUserID: 1, Version: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "[{broken" {
+		t.Fatalf("consent log overwritten: %s", data)
+	}
+}
+
+func TestPhotoWithoutConsentIsRefused(t *testing.T) {
+	sent, _ := setupChatTest(t, consentConversation...)
+	saved := 0
+	savePhoto = func(ctx context.Context, m *Message) (string, error) {
+		saved++
+		return "/tmp/mouth.jpg", nil
+	}
+	const chatID = 22
+	st := resetChatState(chatID, true)
+	st.Awaiting = "photo"
+
+	printMessage(&Message{Chat: Chat{ID: chatID}, From: &User{ID: 502}, Photo: []PhotoSize{{FileID: "p"}}})
+	if saved != 0 {
+		t.Fatal("photo stored without consent")
+	}
+	if st.Awaiting != "terms" || !containsText(*sent, msg("en", "consent.required")) {
+		t.Fatalf("expected to be sent to the consent, got %q / %v", st.Awaiting, *sent)
+	}
+
+	// Typing the button label counts too, and the chat resumes where it was.
+	printMessage(&Message{Chat: Chat{ID: chatID}, From: &User{ID: 502}, Text: "i agree"})
+	if st.Awaiting != "photo" || !hasConsent(502, "v1") {
+		t.Fatalf("expected to return to the photo request, got %q", st.Awaiting)
+	}
+	printMessage(&Message{Chat: Chat{ID: chatID}, From: &User{ID: 502}, Photo: []PhotoSize{{FileID: "p"}}})
+	if saved != 1 {
+		t.Fatalf("photo should be analysed after consent, saved %d", saved)
+	}
+}
+
+func TestConsentVersionBumpAsksAgain(t *testing.T) {
+	sent, _ := setupChatTest(t, consentConversation...)
+	const chatID = 23
+	if err := recordConsent(ConsentRecord{TelegramUserID: 503, ChatID: chatID, Version: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	printMessage(&Message{Chat: Chat{ID: chatID}, From: &User{ID: 503}, Text: "hi"})
+	st := chatStateFor(chatID)
+	if st.Awaiting != "photo" || containsText(*sent, "May we use your photos?") {
+		t.Fatalf("an accepted version should be skipped, got %q / %v", st.Awaiting, *sent)
+	}
+
+	nodes["terms"] = Node{ID: "terms", Type: "consent", Text: "New terms", ConsentVersion: "v2", SuccessTransition: strPtr("photo")}
+	consentVersion = "v2"
+	if !consentMissing(chatID, st) {
+		t.Fatal("a new version needs a new consent")
+	}
+	printMessage(&Message{Chat: Chat{ID: chatID}, From: &User{ID: 503}, Text: "/restart"})
+	if st = chatStateFor(chatID); st.Awaiting != "terms" {
+		t.Fatalf("expected the new terms, got %q", st.Awaiting)
+	}
+}
+
+func TestConsentDecline(t *testing.T) {
+	sent, _ := setupChatTest(t, consentConversation...)
+	const chatID = 24
+	printMessage(&Message{Chat: Chat{ID: chatID}, From: &User{ID: 504}, Text: "hi"})
+	consentPress(chatID, 504, "consent:terms:decline")
+	st := chatStateFor(chatID)
+	if st.Started || hasConsent(504, "v1") || !containsText(*sent, msg("en", "consent.declined")) {
+		t.Fatalf("expected the conversation to end, got %+v / %v", st, *sent)
+	}
+	if _, _, ok := parseConsentCallback("consent:terms:maybe"); ok {
+		t.Fatal("unknown consent answers must be rejected")
+	}
+}
+
+func TestValidateConsentNodes(t *testing.T) {
+	cf := &ConversationFile{Messages: []ConvMessage{
+		{ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("a")},
+		{ID: "a", Type: "consent", Text: "ok?", ConsentVersion: "v1", SuccessTransition: strPtr("b")},
+		{ID: "b", Type: "consent", Text: "ok?", ConsentVersion: "v2", SuccessTransition: strPtr("c")},
+		{ID: "c", Type: "consent", Text: "ok?"},
+	}}
+	issues := strings.Join(validateConversation(cf), "\n")
+	for _, want := range []string{
+		`node "c": consent has no consent_version`,
+		`node "c": consent has no success_transition`,
+		"consent nodes disagree on consent_version: v1 (a), v2 (b)",
+	} {
+		if !strings.Contains(issues, want) {
+			t.Errorf("missing issue %q in:\n%s", want, issues)
+		}
+	}
+}
+
+func TestDisagreeingConsentVersionsAreNeverLoaded(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	path := filepath.Join(t.TempDir(), "conversation.json")
+	conv := `{"messages":[
+{"id":"start","type":"start_message","text":"hi","success_transition":"terms"},
+{"id":"terms","type":"consent","text":"ok?","consent_version":"v1","success_transition":"photos"},
+{"id":"photos","type":"consent","text":"photos ok?","consent_version":"v2","success_transition":"end"},
+{"id":"end","type":"end_message","text":"bye"}]}`
+	if err := os.WriteFile(path, []byte(conv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	err := loadConversation(path)
+	if err == nil || !strings.Contains(err.Error(), "consent nodes disagree on consent_version: v1 (terms), v2 (photos)") {
+		t.Fatalf("conversation with two consent versions loaded: %v", err)
+	}
+	if _, ok := lookupNode("terms"); ok {
+		t.Fatal("expected nothing installed")
+	}
+}
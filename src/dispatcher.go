@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+// dispatcher runs jobs concurrently across chats while keeping each chat's jobs
+// in submission order. At most limit jobs execute at the same time.
+type dispatcher struct {
+	mu     sync.Mutex
+	queues map[int64][]func() // pending jobs per chat; a key exists while a drainer runs
+	slots  chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newDispatcher builds a dispatcher allowing limit concurrent jobs (minimum 1).
+func newDispatcher(limit int) *dispatcher {
+	if limit < 1 {
+		limit = 1
+	}
+	return &dispatcher{
+		queues: make(map[int64][]func()),
+		slots:  make(chan struct{}, limit),
+	}
+}
+
+// Submit queues job behind any pending work for the same chat.
+func (d *dispatcher) Submit(chatID int64, job func()) {
+	d.mu.Lock()
+	q, running := d.queues[chatID]
+	d.queues[chatID] = append(q, job)
+	if !running {
+		d.wg.Add(1)
+		go d.drain(chatID)
+	}
+	d.mu.Unlock()
+}
+
+// Wait blocks until every submitted job has finished.
+func (d *dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// drain executes the jobs queued for chatID one after another until none remain.
+func (d *dispatcher) drain(chatID int64) {
+	defer d.wg.Done()
+	for {
+		d.mu.Lock()
+		q := d.queues[chatID]
+		if len(q) == 0 {
+			delete(d.queues, chatID)
+			d.mu.Unlock()
+			return
+		}
+		job := q[0]
+		d.queues[chatID] = q[1:]
+		d.mu.Unlock()
+
+		d.slots <- struct{}{}
+		d.run(chatID, job)
+		<-d.slots
+	}
+}
+
+// run executes a single job, keeping a panicking handler from killing the worker.
+func (d *dispatcher) run(chatID int64, job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic handling chat %d: %v\n%s", chatID, r, debug.Stack())
+		}
+	}()
+	job()
+}
+
+// updateChatID returns the chat an update belongs to, or 0 when it carries no chat.
+func updateChatID(u Update) int64 {
+	switch {
+	case u.Message != nil:
+		return u.Message.Chat.ID
+	case u.EditedMessage != nil:
+		return u.EditedMessage.Chat.ID
+	case u.CallbackQuery != nil && u.CallbackQuery.Message != nil:
+		return u.CallbackQuery.Message.Chat.ID
+	}
+	return 0
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatcherKeepsChatOrder(t *testing.T) {
+	d := newDispatcher(4)
+	var mu sync.Mutex
+	seen := make(map[int64][]int)
+
+	for i := 0; i < 50; i++ {
+		for _, chatID := range []int64{1, 2, 3} {
+			i, chatID := i, chatID
+			d.Submit(chatID, func() {
+				mu.Lock()
+				seen[chatID] = append(seen[chatID], i)
+				mu.Unlock()
+			})
+		}
+	}
+	d.Wait()
+
+	for chatID, got := range seen {
+		if len(got) != 50 {
+			t.Fatalf("chat %d: expected 50 jobs, got %d", chatID, len(got))
+		}
+		for i, v := range got {
+			if v != i {
+				t.Fatalf("chat %d: job %d ran out of order (%v)", chatID, v, got)
+			}
+		}
+	}
+}
+
+func TestDispatcherRunsChatsInParallel(t *testing.T) {
+	d := newDispatcher(2)
+	release := make(chan struct{})
+	started := make(chan int64, 2)
+
+	// A slow job on chat 1 must not hold up chat 2.
+	d.Submit(1, func() {
+		started <- 1
+		<-release
+	})
+	d.Submit(2, func() { started <- 2 })
+
+	got := map[int64]bool{}
+	for len(got) < 2 {
+		select {
+		case id := <-started:
+			got[id] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("chat 2 blocked behind chat 1, started: %v", got)
+		}
+	}
+	close(release)
+	d.Wait()
+}
+
+func TestDispatcherSurvivesPanics(t *testing.T) {
+	d := newDispatcher(1)
+	ran := false
+	d.Submit(5, func() { panic("boom") })
+	d.Submit(5, func() { ran = true })
+	d.Wait()
+	if !ran {
+		t.Fatalf("job after panic did not run")
+	}
+}
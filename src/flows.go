@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Flows of the running conversation, swapped together with nodes under configMu.
+var (
+	flows         map[string]ConvFlow
+	defaultFlowID string
+	flowStarts    map[string]string // start node ID to flow ID
+)
+
+// flowIDPattern matches what Telegram accepts as a /start deep-link payload.
+var flowIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// readConversationDir merges every *.json file of dir into one conversation.
+// A file that declares no flows becomes a flow named after the file, starting
+// at its first start_message.
+func readConversationDir(dir string) (*ConversationFile, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no .json flow files in %s", dir)
+	}
+	sort.Strings(paths)
+	merged := &ConversationFile{}
+	for _, path := range paths {
+		cf, err := readConversationFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		merged.Messages = append(merged.Messages, cf.Messages...)
+		merged.Commands = append(merged.Commands, cf.Commands...)
+		merged.Flows = append(merged.Flows, cf.Flows...)
+		if len(cf.Flows) == 0 && len(cf.Messages) > 0 {
+			merged.Flows = append(merged.Flows, ConvFlow{
+				ID:    strings.TrimSuffix(filepath.Base(path), ".json"),
+				Start: firstStartMessage(cf.Messages),
+			})
+		}
+		if merged.DefaultFlow == "" {
+			merged.DefaultFlow = cf.DefaultFlow
+		}
+		if merged.FallbackNode == "" {
+			merged.FallbackNode = cf.FallbackNode
+		}
+	}
+	return merged, nil
+}
+
+// firstStartMessage returns the first start_message of messages, or the first message.
+func firstStartMessage(messages []ConvMessage) string {
+	for _, m := range messages {
+		if m.Type == "start_message" {
+			return m.ID
+		}
+	}
+	if len(messages) > 0 {
+		return messages[0].ID
+	}
+	return ""
+}
+
+// lookupFlow returns the flow with the given ID from the running conversation.
+func lookupFlow(id string) (ConvFlow, bool) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	f, ok := flows[id]
+	return f, ok
+}
+
+// flowCommand returns the flow a command name opens, if any.
+func flowCommand(name string) (ConvFlow, bool) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	for _, f := range flows {
+		if f.Command != "" && strings.EqualFold(strings.TrimPrefix(f.Command, "/"), name) {
+			return f, true
+		}
+	}
+	return ConvFlow{}, false
+}
+
+// chooseFlow picks the flow a new conversation runs: the deep-link payload
+// when it names a flow, else the default flow. The flow of the user's role is
+// only known once they sign in; see signedInFlow.
+func chooseFlow(payload string) string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	if _, ok := flows[payload]; ok {
+		return payload
+	}
+	if payload != "" {
+		log.Printf("unknown /start payload %q, starting the default flow", payload)
+	}
+	return defaultFlowID
+}
+
+// signedInFlow returns the flow a chat continues in once its user signed in:
+// the first flow listing their role, when the chat is in the default flow
+// rather than one picked by a deep link or command. "" keeps the current flow.
+func signedInFlow(st *ChatState) string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	if st.Role == "" || st.Flow != defaultFlowID {
+		return ""
+	}
+	ids := make([]string, 0, len(flows))
+	for id := range flows {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, r := range flows[id].Roles {
+			if strings.EqualFold(r, st.Role) {
+				if id == st.Flow {
+					return ""
+				}
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// startFlow resets the chat and sends the start node of the given flow; an
+// empty flow ID starts the conversation's start node.
+func startFlow(chatID int64, flowID string) {
+	st := resetChatState(chatID, false)
+	st.Flow = ""
+	start := currentStartNode()
+	if f, ok := lookupFlow(flowID); ok {
+		st.Flow, start = f.ID, f.Start
+	}
+	if start == "" {
+		saveChatState(chatID)
+		return
+	}
+	fmt.Printf("[conversation] chat:%d flow:%q start:%s\n", chatID, st.Flow, start)
+	advanceChatState(chatID, start)
+}
+
+// flowStartingAt returns the flow whose start node is nodeID.
+func flowStartingAt(nodeID string) (string, bool) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	id, ok := flowStarts[nodeID]
+	return id, ok
+}
+
+// checkFlows reports problems with the flows section of a conversation.
+func checkFlows(cf *ConversationFile, byID map[string]ConvMessage) []string {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	taken := make(map[string]string) // command name to what uses it
+	for _, name := range builtinCommands {
+		taken[name] = "a built-in command"
+	}
+	for _, name := range adminCommands {
+		taken[name] = "a built-in command"
+	}
+	for _, c := range cf.Commands {
+		taken[strings.ToLower(strings.TrimPrefix(c.Command, "/"))] = "a conversation command"
+	}
+	seen := make(map[string]bool)
+	roles := make(map[string]string)
+	for _, f := range cf.Flows {
+		if !flowIDPattern.MatchString(f.ID) {
+			report("flow %q: id must be 1-64 letters, digits, _ or - to work as a /start payload", f.ID)
+		}
+		if seen[f.ID] {
+			report("flow %q: duplicate id", f.ID)
+		}
+		seen[f.ID] = true
+		if _, ok := byID[f.Start]; !ok {
+			report("flow %q: start points to unknown node %q", f.ID, f.Start)
+		}
+		if f.Command != "" {
+			name := strings.ToLower(strings.TrimPrefix(f.Command, "/"))
+			if other, ok := taken[name]; ok {
+				report("flow %q: command /%s is already %s", f.ID, name, other)
+			}
+			taken[name] = fmt.Sprintf("the command of flow %q", f.ID)
+		}
+		for _, r := range f.Roles {
+			r = strings.ToLower(r)
+			if other, ok := roles[r]; ok {
+				report("flow %q: role %q is already served by flow %q", f.ID, r, other)
+				continue
+			}
+			roles[r] = f.ID
+		}
+	}
+	if cf.DefaultFlow != "" && !seen[cf.DefaultFlow] {
+		report("default_flow points to unknown flow %q", cf.DefaultFlow)
+	}
+	return problems
+}
+
+// conversationPathFromEnv reads CONVERSATION_PATH, a conversation file or a
+// directory of flow files; it defaults to configs/conversation.json.
+func conversationPathFromEnv() string {
+	if v := os.Getenv("CONVERSATION_PATH"); v != "" {
+		return v
+	}
+	return "configs/conversation.json"
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const flowsConv = `{"default_flow":"patient","flows":[
+ {"id":"patient","start":"p_start","roles":["patient"]},
+ {"id":"agent","start":"a_start","command":"agente","description":"Community health worker intake","roles":["agent"]},
+ {"id":"followup","start":"f_start"}],
+"messages":[
+{"id":"p_start","type":"start_message","text":"Patient intake","success_transition":"p_q"},
+{"id":"p_q","type":"question","text":"Your age?","success_transition":"p_end","fail_transition":"p_q"},
+{"id":"p_end","type":"end_message","text":"done"},
+{"id":"a_start","type":"start_message","text":"Agent intake","success_transition":"a_q"},
+{"id":"a_q","type":"question","text":"Patient ID?","success_transition":"p_end","fail_transition":"a_q"},
+{"id":"f_start","type":"start_message","text":"Follow-up visit","success_transition":"p_end"}]}`
+
+func loadFlowsForTest(t *testing.T) *[]string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "conversation.json")
+	if err := os.WriteFile(path, []byte(flowsConv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConversation(path); err != nil {
+		t.Fatal(err)
+	}
+	originalSend := sendReply
+	t.Cleanup(func() { sendReply = originalSend })
+	sent := new([]string)
+	sendReply = func(id int64, text string) error {
+		*sent = append(*sent, text)
+		return nil
+	}
+	return sent
+}
+
+func TestFlowSelection(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	sent := loadFlowsForTest(t)
+
+	printMessage(&Message{Chat: Chat{ID: 1}, Text: "hello"})
+	if st := chatStateFor(1); st.Flow != "patient" || st.Awaiting != "p_q" {
+		t.Fatalf("first message should start the default flow, got %+v", st)
+	}
+
+	printMessage(&Message{Chat: Chat{ID: 2}, Text: "/start followup"})
+	if st := chatStateFor(2); st.Flow != "followup" || !containsText(*sent, "Follow-up visit") {
+		t.Fatalf("deep link should start the followup flow, got %+v / %v", st, *sent)
+	}
+
+	printMessage(&Message{Chat: Chat{ID: 3}, Text: "/agente"})
+	if st := chatStateFor(3); st.Flow != "agent" || st.Awaiting != "a_q" {
+		t.Fatalf("flow command should start the agent flow, got %+v", st)
+	}
+	printMessage(&Message{Chat: Chat{ID: 3}, Text: "/restart"})
+	if st := chatStateFor(3); st.Flow != "agent" || st.Awaiting != "a_q" {
+		t.Fatalf("restart should stay in the agent flow, got %+v", st)
+	}
+
+	printMessage(&Message{Chat: Chat{ID: 4}, Text: "/start nope"})
+	if st := chatStateFor(4); st.Flow != "patient" {
+		t.Fatalf("unknown payload should fall back to the default flow, got %+v", st)
+	}
+}
+
+const signInFlowsConv = `{"default_flow":"patient","flows":[
+ {"id":"patient","start":"p_start"},
+ {"id":"agent","start":"a_start","roles":["agent"]}],
+"messages":[
+{"id":"p_start","type":"start_message","text":"Welcome","success_transition":"user"},
+{"id":"user","type":"question","text":"Username?","action":"auth.username","success_transition":"pass","fail_transition":"user"},
+{"id":"pass","type":"question","text":"Password?","action":"auth.password","success_transition":"p_q","fail_transition":"pass"},
+{"id":"p_q","type":"question","text":"Your age?","success_transition":"p_end","fail_transition":"p_q"},
+{"id":"p_end","type":"end_message","text":"done"},
+{"id":"a_start","type":"start_message","text":"Agent intake","success_transition":"a_q"},
+{"id":"a_q","type":"question","text":"Patient ID?","success_transition":"p_end","fail_transition":"a_q"}]}`
+
+func TestRoleFlowChosenAfterSignIn(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	path := filepath.Join(t.TempDir(), "conversation.json")
+	if err := os.WriteFile(path, []byte(signInFlowsConv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConversation(path); err != nil {
+		t.Fatal(err)
+	}
+	authUsers = map[string]string{"ana": "1"}
+	authRoles = map[string]string{"ana": "agent"}
+	originalSend := sendReply
+	defer func() { sendReply = originalSend }()
+	sendReply = func(int64, string) error { return nil }
+
+	for _, text := range []string{"hi", "ana", "1"} {
+		printMessage(&Message{Chat: Chat{ID: 5}, Text: text})
+	}
+	if st := chatStateFor(5); st.Flow != "agent" || st.Awaiting != "a_q" || !st.Authed {
+		t.Fatalf("signing in as an agent should continue in the agent flow, got %+v", st)
+	}
+
+	// The role belongs to the sign-in, so it goes with /cancel and a new /start
+	// begins the default flow signed out.
+	printMessage(&Message{Chat: Chat{ID: 5}, Text: "/cancel"})
+	printMessage(&Message{Chat: Chat{ID: 5}, Text: "/start"})
+	if st := chatStateFor(5); st.Role != "" || st.Authed || st.Flow != "patient" || st.Awaiting != "user" {
+		t.Fatalf("restart after /cancel kept the previous sign-in, got %+v", st)
+	}
+}
+
+func TestFlowCommandsInMenu(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	loadFlowsForTest(t)
+	var found bool
+	for _, c := range allCommands("en") {
+		if c.Command == "agente" && c.Description == "Community health worker intake" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("flow command missing from menu: %+v", allCommands("en"))
+	}
+}
+
+func TestReadConversationDir(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	dir := t.TempDir()
+	files := map[string]string{
+		"patient.json": `{"default_flow":"patient","messages":[{"id":"p","type":"start_message","text":"patient","success_transition":"p_end"},{"id":"p_end","type":"end_message","text":"bye"}]}`,
+		"agent.json":   `{"messages":[{"id":"a","type":"start_message","text":"agent","success_transition":"p_end"}]}`,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cf, err := readConversation(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issues := validateConversation(cf); len(issues) != 0 {
+		t.Fatalf("unexpected issues: %v", issues)
+	}
+	applyConversation(cf)
+	if f, ok := lookupFlow("agent"); !ok || f.Start != "a" {
+		t.Fatalf("agent flow not derived from its file: %+v", f)
+	}
+	if currentStartNode() != "p" {
+		t.Fatalf("expected the default flow's start node, got %q", currentStartNode())
+	}
+}
+
+func TestValidateFlows(t *testing.T) {
+	cf := &ConversationFile{
+		DefaultFlow: "ghost",
+		Flows: []ConvFlow{
+			{ID: "a b", Start: "start"},
+			{ID: "x", Start: "missing", Command: "help", Roles: []string{"agent"}},
+			{ID: "y", Start: "start", Roles: []string{"Agent"}},
+		},
+		Messages: []ConvMessage{{ID: "start", Type: "start_message", Text: "hi"}},
+	}
+	issues := strings.Join(validateConversation(cf), "\n")
+	for _, want := range []string{
+		`flow "a b": id must be`,
+		`flow "x": start points to unknown node "missing"`,
+		`flow "x": command /help is already a built-in command`,
+		`flow "y": role "agent" is already served by flow "x"`,
+		`default_flow points to unknown flow "ghost"`,
+	} {
+		if !strings.Contains(issues, want) {
+			t.Errorf("missing issue %q in:\n%s", want, issues)
+		}
+	}
+}
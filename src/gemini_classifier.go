@@ -51,6 +51,10 @@ func analyzeMouthPhoto(ctx context.Context, imagePath string) (*DiagnosisReport,
 	}
 
 	prompt := "You are assessing a medical photo of the inside of a human mouth. Determine whether the photo shows signs consistent with oral or mouth cancer. Respond ONLY with JSON that matches this exact schema: {\"Answer\": boolean, \"Rationale\": string}. Set Answer to true only if the image likely shows mouth cancer."
+	// The rationale is shown to the patient as is, so ask for it in their language.
+	if locale := localeFromContext(ctx); locale != "" {
+		prompt += fmt.Sprintf(" Write the Rationale in %s.", msg(locale, "language.prompt_name"))
+	}
 
 	parts := []gemini.Part{
 		{Text: prompt},
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// graphEdge is an arrow of the exported diagram.
+type graphEdge struct {
+	From, To string
+	Label    string
+	Kind     string // "success", "fail", "option", "branch" or "entry"
+}
+
+// graphView is the running conversation laid out for export.
+type graphView struct {
+	ids     []string // node IDs in output order
+	nodes   map[string]Node
+	entries []graphEdge // flows and commands, From holds the entry's label
+	edges   []graphEdge
+	dropoff map[string]int // chats that gave up on each node, nil without a record or sessions
+}
+
+// runGraph implements the "graph" subcommand and returns the exit code.
+func runGraph(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("graph", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	format := fs.String("format", "mermaid", "output format: mermaid or dot")
+	dropoffs := fs.String("dropoffs", "", "drop-off record (DROPOFF_FILE) of the conversations the bot closed, counted per node")
+	sessions := fs.String("sessions", "", `session file (SESSION_FILE), or "redis" for the Redis store at REDIS_ADDR, whose abandoned chats are added to the count`)
+	idle := fs.Duration("idle", 0, "how long a stored chat must have waited on a node to count as a drop-off (default INACTIVITY_EXPIRE_AFTER, or SESSION_TTL when shorter)")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: telbot graph [-format mermaid|dot] [-dropoffs dropoffs.json] [-sessions sessions.json|redis [-idle 12h]] [conversation.json]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *idle == 0 {
+		d, err := dropoffIdleFromEnv()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		*idle = d
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	path := conversationPathFromEnv()
+	if fs.NArg() == 1 {
+		path = fs.Arg(0)
+	}
+	if err := loadConversation(path); err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", path, err)
+		return 1
+	}
+
+	g := newGraphView()
+	if *dropoffs != "" {
+		recorded, err := readDropoffs(*dropoffs)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", *dropoffs, err)
+			return 1
+		}
+		g.dropoff = recorded
+	}
+	if *sessions != "" {
+		all, err := storedSessions(*sessions)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", *sessions, err)
+			return 1
+		}
+		if g.dropoff == nil {
+			g.dropoff = make(map[string]int)
+		}
+		for id, n := range sessionDropoff(all, *idle, clock()) {
+			g.dropoff[id] += n
+		}
+	}
+
+	switch *format {
+	case "mermaid":
+		g.writeMermaid(stdout)
+	case "dot":
+		g.writeDOT(stdout)
+	default:
+		fmt.Fprintf(stderr, "unknown format %q (use mermaid or dot)\n", *format)
+		return 2
+	}
+	return 0
+}
+
+// newGraphView snapshots the running conversation.
+func newGraphView() *graphView {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	g := &graphView{nodes: make(map[string]Node, len(nodes))}
+	for id, n := range nodes {
+		g.nodes[id] = n
+		g.ids = append(g.ids, id)
+	}
+	sort.Strings(g.ids)
+
+	if len(flows) == 0 && startNodeID != "" {
+		g.entries = append(g.entries, graphEdge{From: "start", To: startNodeID, Kind: "entry"})
+	}
+	flowIDs := make([]string, 0, len(flows))
+	for id := range flows {
+		flowIDs = append(flowIDs, id)
+	}
+	sort.Strings(flowIDs)
+	for _, id := range flowIDs {
+		label := "flow " + id
+		if id == defaultFlowID {
+			label += " (default)"
+		}
+		g.entries = append(g.entries, graphEdge{From: label, To: flows[id].Start, Kind: "entry"})
+	}
+	cmds := make([]string, 0, len(customCommands))
+	for name := range customCommands {
+		cmds = append(cmds, name)
+	}
+	sort.Strings(cmds)
+	for _, name := range cmds {
+		g.entries = append(g.entries, graphEdge{From: "/" + name, To: customCommands[name].Node, Kind: "entry"})
+	}
+
+	for _, id := range g.ids {
+		n := g.nodes[id]
+		add := func(label, kind string, target *string) {
+			if target != nil && *target != "" {
+				g.edges = append(g.edges, graphEdge{From: id, To: *target, Label: label, Kind: kind})
+			}
+		}
+		add("", "success", n.SuccessTransition)
+		add("fail", "fail", n.FailTransition)
+		add("exhausted", "fail", n.ExhaustedTransition)
+		for i := range n.Options {
+			add(n.Options[i].Label, "option", n.Options[i].Transition)
+		}
+		for i := range n.Branches {
+			add(n.Branches[i].When, "branch", &n.Branches[i].Transition)
+		}
+	}
+	return g
+}
+
+// dropoffPathFromEnv returns DROPOFF_FILE, where the bot records drop-offs
+// (default configs/dropoffs.json).
+func dropoffPathFromEnv() string {
+	if path := os.Getenv("DROPOFF_FILE"); path != "" {
+		return path
+	}
+	return "configs/dropoffs.json"
+}
+
+// dropoffIdleFromEnv is how long the bot itself lets a chat wait before it
+// closes the conversation: INACTIVITY_EXPIRE_AFTER, or SESSION_TTL when that is
+// shorter or expiry is off. Chats the bot closed are already in the drop-off
+// record; a stored chat idle for longer was missed, e.g. across a restart.
+func dropoffIdleFromEnv() (time.Duration, error) {
+	m, err := inactivityMonitorFromEnv(nil)
+	if err != nil {
+		return 0, err
+	}
+	ttl, err := sessionTTLFromEnv()
+	if err != nil {
+		return 0, err
+	}
+	idle := m.expireAfter
+	if idle <= 0 || (ttl > 0 && ttl < idle) {
+		idle = ttl
+	}
+	if idle <= 0 {
+		idle = 24 * time.Hour
+	}
+	return idle, nil
+}
+
+// storedSessions reads every session of a session file, or of the Redis
+// store when source is "redis". Sessions are read whatever their age, since a
+// chat the bot has expired is a drop-off too.
+func storedSessions(source string) (map[int64]*ChatState, error) {
+	var store SessionStore
+	if source == "redis" {
+		store = newRedisSessionStore(redis.NewClient(&redis.Options{Addr: redisAddr()}), redisSessionPrefix, 0)
+	} else {
+		if _, err := os.Stat(source); err != nil {
+			return nil, err
+		}
+		fileStore, err := newFileSessionStore(source, 0)
+		if err != nil {
+			return nil, err
+		}
+		store = fileStore
+	}
+	return store.List()
+}
+
+// sessionDropoff counts, per node, the chats that stopped there mid-conversation
+// and have not answered for at least idle. Chats still answering and finished
+// conversations are not drop-offs.
+func sessionDropoff(sessions map[int64]*ChatState, idle time.Duration, now time.Time) map[string]int {
+	counts := make(map[string]int)
+	for _, st := range sessions {
+		if st.Started && st.Awaiting != "" && now.Sub(st.UpdatedAt) >= idle {
+			counts[st.Awaiting]++
+		}
+	}
+	return counts
+}
+
+// nodeLabel is the caption of a node: its ID, a photo mark, a short text and
+// the drop-off count when a drop-off record or sessions were given.
+func (g *graphView) nodeLabel(n Node, newline string) string {
+	label := n.ID
+	if n.ExpectPhoto {
+		label = "📷 " + label
+	}
+	if text := strings.Join(strings.Fields(n.Text), " "); text != "" {
+		if r := []rune(text); len(r) > 40 {
+			text = string(r[:39]) + "…"
+		}
+		label += newline + text
+	}
+	if g.dropoff != nil {
+		label += newline + fmt.Sprintf("stopped here: %d", g.dropoff[n.ID])
+	}
+	return label
+}
+
+// mermaidShapes wraps a node caption in the shape of its type.
+var mermaidShapes = map[string][2]string{
+	"start_message": {"([", "])"},
+	"question":      {"[", "]"},
+	"choice":        {"{{", "}}"},
+	"branch":        {"{", "}"},
+	"end_message":   {"(((", ")))"},
+	"consent":       {"[[", "]]"},
+}
+
+// writeMermaid renders the graph as a Mermaid flowchart.
+func (g *graphView) writeMermaid(w io.Writer) {
+	ref := make(map[string]string, len(g.ids))
+	for i, id := range g.ids {
+		ref[id] = fmt.Sprintf("n%d", i)
+	}
+	quote := func(s string) string {
+		return `"` + strings.ReplaceAll(s, `"`, "#quot;") + `"`
+	}
+
+	fmt.Fprintln(w, "flowchart TD")
+	for _, id := range g.ids {
+		n := g.nodes[id]
+		shape, ok := mermaidShapes[n.Type]
+		if !ok {
+			shape = mermaidShapes["question"]
+		}
+		fmt.Fprintf(w, "    %s%s%s%s\n", ref[id], shape[0], quote(g.nodeLabel(n, "<br/>")), shape[1])
+	}
+	for i, e := range g.entries {
+		fmt.Fprintf(w, "    entry%d>%s] --> %s\n", i, quote(e.From), mermaidRef(ref, e.To))
+	}
+
+	var success, fail []string
+	for i, e := range g.edges {
+		arrow := "-->"
+		if e.Kind == "fail" {
+			arrow = "-.->"
+		}
+		if e.Label != "" {
+			arrow += "|" + quote(e.Label) + "|"
+		}
+		fmt.Fprintf(w, "    %s %s %s\n", ref[e.From], arrow, mermaidRef(ref, e.To))
+		// linkStyle indexes count the entry arrows first.
+		index := fmt.Sprint(len(g.entries) + i)
+		if e.Kind == "fail" {
+			fail = append(fail, index)
+		} else {
+			success = append(success, index)
+		}
+	}
+	if len(success) > 0 {
+		fmt.Fprintf(w, "    linkStyle %s stroke:#2e7d32,stroke-width:2px\n", strings.Join(success, ","))
+	}
+	if len(fail) > 0 {
+		fmt.Fprintf(w, "    linkStyle %s stroke:#c62828,stroke-dasharray:5 5\n", strings.Join(fail, ","))
+	}
+
+	fmt.Fprintln(w, "    classDef photo fill:#fff3cd,stroke:#b7950b,stroke-width:2px")
+	fmt.Fprintln(w, "    classDef dropoff fill:#fdecea,stroke:#c62828")
+	for _, id := range g.ids {
+		switch {
+		case g.nodes[id].ExpectPhoto:
+			fmt.Fprintf(w, "    class %s photo\n", ref[id])
+		case g.dropoff[id] > 0:
+			fmt.Fprintf(w, "    class %s dropoff\n", ref[id])
+		}
+	}
+}
+
+// mermaidRef returns the diagram ID of a node, drawing unknown targets as-is.
+func mermaidRef(ref map[string]string, id string) string {
+	if r, ok := ref[id]; ok {
+		return r
+	}
+	return fmt.Sprintf("missing_%s[%q]", strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '.' {
+			return '_'
+		}
+		return r
+	}, id), "missing: "+id)
+}
+
+// dotShapes maps node types to Graphviz shapes.
+var dotShapes = map[string]string{
+	"start_message": "oval",
+	"question":      "box",
+	"choice":        "hexagon",
+	"branch":        "diamond",
+	"end_message":   "doublecircle",
+	"consent":       "note",
+}
+
+// writeDOT renders the graph in Graphviz DOT.
+func (g *graphView) writeDOT(w io.Writer) {
+	fmt.Fprintln(w, "digraph conversation {")
+	fmt.Fprintln(w, `    rankdir=TB;`)
+	fmt.Fprintln(w, `    node [fontname="Helvetica", style=rounded];`)
+	fmt.Fprintln(w, `    edge [fontname="Helvetica", fontsize=10];`)
+	for _, id := range g.ids {
+		n := g.nodes[id]
+		shape, ok := dotShapes[n.Type]
+		if !ok {
+			shape = "box"
+		}
+		attrs := fmt.Sprintf("label=%s, shape=%s", dotQuote(g.nodeLabel(n, "\n")), shape)
+		switch {
+		case n.ExpectPhoto:
+			attrs += `, style="rounded,filled,bold", fillcolor="#fff3cd", color="#b7950b"`
+		case g.dropoff[id] > 0:
+			attrs += `, style="rounded,filled", fillcolor="#fdecea"`
+		}
+		fmt.Fprintf(w, "    %s [%s];\n", dotQuote(id), attrs)
+	}
+	for i, e := range g.entries {
+		fmt.Fprintf(w, "    entry%d [label=%s, shape=plaintext];\n", i, dotQuote(e.From))
+		fmt.Fprintf(w, "    entry%d -> %s;\n", i, dotQuote(e.To))
+	}
+	for _, e := range g.edges {
+		attrs := `color="#2e7d32"`
+		if e.Kind == "fail" {
+			attrs = `color="#c62828", style=dashed`
+		}
+		if e.Label != "" {
+			attrs += ", label=" + dotQuote(e.Label)
+		}
+		fmt.Fprintf(w, "    %s -> %s [%s];\n", dotQuote(e.From), dotQuote(e.To), attrs)
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
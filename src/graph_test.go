@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const graphConv = `{"messages":[
+{"id":"start","type":"start_message","text":"Hello","success_transition":"pain"},
+{"id":"pain","type":"choice","text":"Any pain?","options":[{"label":"Yes","transition":"photo"},{"label":"No"}],"success_transition":"route"},
+{"id":"route","type":"branch","branches":[{"when":"pain == \"Yes\"","transition":"photo"}],"success_transition":"end"},
+{"id":"photo","type":"start_message","text":"Send a photo","expect_photo":true,"success_transition":"end","fail_transition":"photo"},
+{"id":"end","type":"end_message","text":"bye"}]}`
+
+func writeGraphFixtures(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	conv := filepath.Join(dir, "conversation.json")
+	sessions := filepath.Join(dir, "sessions.json")
+	if err := os.WriteFile(conv, []byte(graphConv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Chat 4 is still answering and chat 5 finished, so neither gave up.
+	recent := time.Now().UTC().Add(-time.Minute).Format(time.RFC3339)
+	data := `{"1":{"started":true,"awaiting":"photo"},"2":{"started":true,"awaiting":"photo"},"3":{"started":false,"awaiting":"pain"},` +
+		`"4":{"started":true,"awaiting":"pain","updated_at":"` + recent + `"},"5":{"started":true,"awaiting":""}}`
+	if err := os.WriteFile(sessions, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return conv, sessions
+}
+
+func TestRunGraphMermaid(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	conv, sessions := writeGraphFixtures(t)
+	var out, errOut bytes.Buffer
+	if code := runGraph([]string{"-sessions", sessions, conv}, &out, &errOut); code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut.String())
+	}
+	got := out.String()
+	for _, want := range []string{
+		"flowchart TD",
+		`n4(["start<br/>Hello<br/>stopped here: 0"])`,
+		`n1{{"pain<br/>Any pain?<br/>stopped here: 0"}}`,
+		`n3{"route<br/>stopped here: 0"}`,
+		`n0((("end<br/>bye<br/>stopped here: 0")))`,
+		`n2(["📷 photo<br/>Send a photo<br/>stopped here: 2"])`,
+		`n2 -.->|"fail"| n2`,
+		`n3 -->|"pain == #quot;Yes#quot;"| n2`,
+		"stroke:#c62828,stroke-dasharray:5 5",
+		"class n2 photo",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestRunGraphDOT(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	conv, _ := writeGraphFixtures(t)
+	var out, errOut bytes.Buffer
+	if code := runGraph([]string{"-format", "dot", conv}, &out, &errOut); code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut.String())
+	}
+	got := out.String()
+	for _, want := range []string{
+		"digraph conversation {",
+		`"route" [label="route", shape=diamond];`,
+		`"pain" [label="pain\nAny pain?", shape=hexagon];`,
+		`fillcolor="#fff3cd"`,
+		`"photo" -> "photo" [color="#c62828", style=dashed, label="fail"];`,
+		`entry0 -> "start";`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "stopped here") {
+		t.Errorf("drop-off counts shown without sessions:\n%s", got)
+	}
+}
+
+func TestRunGraphRejectsUnknownFormat(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	conv, _ := writeGraphFixtures(t)
+	var out, errOut bytes.Buffer
+	if code := runGraph([]string{"-format", "svg", conv}, &out, &errOut); code != 2 {
+		t.Fatalf("expected exit 2, got %d", code)
+	}
+}
+
+func TestRunGraphCountsRecordedDropoffs(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	conv, sessions := writeGraphFixtures(t)
+	record := filepath.Join(t.TempDir(), "dropoffs.json")
+	if err := loadDropoffs(record); err != nil {
+		t.Fatal(err)
+	}
+	// Closed by the inactivity monitor, so their sessions are gone.
+	recordDropoff("pain")
+	recordDropoff("photo")
+
+	var out, errOut bytes.Buffer
+	if code := runGraph([]string{"-dropoffs", record, "-sessions", sessions, conv}, &out, &errOut); code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut.String())
+	}
+	got := out.String()
+	for _, want := range []string{
+		`n1{{"pain<br/>Any pain?<br/>stopped here: 1"}}`,
+		`n2(["📷 photo<br/>Send a photo<br/>stopped here: 3"])`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestDropoffIdleFollowsExpirySettings(t *testing.T) {
+	for _, tc := range []struct {
+		expire, ttl string
+		want        time.Duration
+	}{
+		{"", "", 12 * time.Hour}, // the defaults: inactivity closes chats before SESSION_TTL
+		{"2h", "24h", 2 * time.Hour},
+		{"12h", "6h", 6 * time.Hour},
+		{"0", "24h", 24 * time.Hour},
+	} {
+		t.Setenv("INACTIVITY_EXPIRE_AFTER", tc.expire)
+		t.Setenv("SESSION_TTL", tc.ttl)
+		got, err := dropoffIdleFromEnv()
+		if err != nil || got != tc.want {
+			t.Errorf("expire %q, ttl %q: got %s, %v; want %s", tc.expire, tc.ttl, got, err, tc.want)
+		}
+	}
+}
+
+func TestRunGraphDefaultIdleCountsChatsBeforeTheyExpire(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	t.Setenv("INACTIVITY_EXPIRE_AFTER", "")
+	t.Setenv("SESSION_TTL", "")
+	dir := t.TempDir()
+	conv := filepath.Join(dir, "conversation.json")
+	sessions := filepath.Join(dir, "sessions.json")
+	if err := os.WriteFile(conv, []byte(graphConv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Silent for 13h: past the 12h inactivity expiry, still within the 24h SESSION_TTL.
+	quiet := time.Now().UTC().Add(-13 * time.Hour).Format(time.RFC3339)
+	data := `{"1":{"started":true,"awaiting":"photo","updated_at":"` + quiet + `"}}`
+	if err := os.WriteFile(sessions, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out, errOut bytes.Buffer
+	if code := runGraph([]string{"-sessions", sessions, conv}, &out, &errOut); code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut.String())
+	}
+	if want := "photo<br/>Send a photo<br/>stopped here: 1"; !strings.Contains(out.String(), want) {
+		t.Errorf("missing %q in:\n%s", want, out.String())
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// defaultLocale is used for chats whose language is unknown; DEFAULT_LOCALE overrides it.
+var defaultLocale = "en"
+
+// catalog holds the bot's built-in strings per locale. Entries missing from a
+// locale fall back to the default locale and then to English.
+var catalog = map[string]map[string]string{
+	"en": {
+		"language.name":        "English",
+		"language.prompt_name": "English",
+
+		"reply.text_required":        "Please reply with text so we can continue.",
+		"photo.required":             "I need a clear photo of the inside of your mouth to continue. Please try sending an image.",
+		"document.unsupported":       "I can only analyse image files (JPEG, PNG, WebP or HEIC). Please send a photo of the inside of your mouth.",
+		"document.too_large":         "That file is too large. Please send an image smaller than %d MB.",
+		"photo.analysis_failed":      "I couldn't analyse that photo. Please try again with a clearer picture or lighting.",
+		"verdict.positive":           "Yes. The image may show signs consistent with oral cancer.",
+		"verdict.negative":           "No. The image does not appear to show signs consistent with oral cancer.",
+		"verdict.reply":              "Model's assessment: %s\n\nRationale: %s\n\nThis is an AI assessment and not a medical diagnosis.\nPlease consult a qualified professional for concerns.",
+		"verdict.album":              "Analysed %d photos.\n\n%s",
+		"verdict.album_photo":        "Photo %d (%s): %s",
+		"verdict.album_photo_failed": "Photo %d: could not be analysed.",
+		"verdict.photo_positive":     "positive",
+		"verdict.photo_negative":     "negative",
+
+		"login.unknown_user":   "I couldn't find that username. Please try again.",
+		"login.username_first": "Please provide your username before sending the password.",
+		"login.bad_password":   "The password did not match. Please try again.",
+		"login.locked":         "Too many failed sign-ins. Please try again in %d min.",
+
+		"attempts.cooldown": "That was the last attempt. Please wait %d min before trying again.",
+		"attempts.wait":     "Please wait %d min before trying again.",
+
+		"unlock.usage": "Usage: /unlock <Telegram user ID>",
+		"unlock.done":  "User %d can try again now.",
+
+		"choice.prompt":      "Please choose one of the options below.",
+		"choice.stale":       "This question is no longer active.",
+		"choice.list_button": "Options",
+
+		"action.failed": "Something went wrong on our side. Please try again.",
+
+		"consent.accept":       "I agree",
+		"consent.decline":      "I do not agree",
+		"consent.prompt":       "Please tap \"I agree\" or \"I do not agree\" to continue.",
+		"consent.required":     "Before we can look at any photos we need your consent.",
+		"consent.declined":     "Understood. Without your consent we can't analyse photos. Send /start if you change your mind.",
+		"consent.store_failed": "We couldn't save your consent right now. Please try again in a moment.",
+
+		"back.button":      "⬅ Back",
+		"back.unavailable": "There is no earlier question to go back to.",
+
+		"conversation.updated": "This conversation has been updated, so we will continue from here.",
+
+		"inactivity.nudge":   "Are you still there? I'm waiting for your reply so we can continue.",
+		"inactivity.goodbye": "We haven't heard from you in a while, so this conversation has been closed. Send /start whenever you want to begin again.",
+
+		"command.start":       "Start the screening",
+		"command.restart":     "Start over from the beginning",
+		"command.back":        "Go back to the previous question",
+		"command.cancel":      "Cancel the current conversation",
+		"command.status":      "Show the current step",
+		"command.help":        "List available commands",
+		"command.language":    "Choose the bot's language",
+		"command.cancelled":   "Conversation cancelled. Send /start whenever you want to begin again.",
+		"command.unknown":     "Unknown command. Send /help to see what I can do.",
+		"command.sign_in":     "Please sign in before using this command.",
+		"command.help_header": "Available commands:",
+
+		"status.idle":      "No conversation in progress. Send /start to begin.",
+		"status.waiting":   "The conversation is in progress, nothing is pending from you right now.",
+		"status.step":      "Current step: %s\n%s",
+		"status.signed_in": "\n\nSigned in as %s.",
+
+		"language.current": "Current language: %s. Available: %s.\nSend /language <code> to change it or /language auto to follow your Telegram settings.",
+		"language.set":     "Language set to %s.",
+		"language.auto":    "I will follow your Telegram language again.",
+		"language.unknown": "I don't know the language %q. Available: %s.",
+
+		"validate.max_length": "Please keep your answer under %d characters.",
+		"validate.pattern":    "That answer is not in the expected format. Please try again.",
+		"validate.int":        "Please reply with a whole number%s.",
+		"validate.float":      "Please reply with a number%s.",
+		"validate.enum":       "Please reply with one of: %s.",
+		"validate.date":       "Please reply with a date in the format %s.",
+		"validate.between":    " between %s and %s",
+		"validate.at_least":   " of at least %s",
+		"validate.at_most":    " of at most %s",
+	},
+	"pt": {
+		"language.name":        "Português",
+		"language.prompt_name": "Brazilian Portuguese",
+
+		"reply.text_required":        "Por favor, responda com texto para continuarmos.",
+		"photo.required":             "Preciso de uma foto nítida do interior da sua boca para continuar. Tente enviar uma imagem.",
+		"document.unsupported":       "Só consigo analisar arquivos de imagem (JPEG, PNG, WebP ou HEIC). Envie uma foto do interior da sua boca.",
+		"document.too_large":         "Esse arquivo é grande demais. Envie uma imagem menor que %d MB.",
+		"photo.analysis_failed":      "Não consegui analisar essa foto. Tente novamente com uma imagem mais nítida ou com melhor iluminação.",
+		"verdict.positive":           "Sim. A imagem pode apresentar sinais compatíveis com câncer bucal.",
+		"verdict.negative":           "Não. A imagem não parece apresentar sinais compatíveis com câncer bucal.",
+		"verdict.reply":              "Avaliação do modelo: %s\n\nJustificativa: %s\n\nEsta é uma avaliação feita por IA e não um diagnóstico médico.\nProcure um profissional qualificado em caso de dúvidas.",
+		"verdict.album":              "%d fotos analisadas.\n\n%s",
+		"verdict.album_photo":        "Foto %d (%s): %s",
+		"verdict.album_photo_failed": "Foto %d: não foi possível analisar.",
+		"verdict.photo_positive":     "positiva",
+		"verdict.photo_negative":     "negativa",
+
+		"login.unknown_user":   "Não encontrei esse usuário. Tente novamente.",
+		"login.username_first": "Informe seu usuário antes de enviar a senha.",
+		"login.bad_password":   "A senha não confere. Tente novamente.",
+		"login.locked":         "Muitas tentativas de login sem sucesso. Tente novamente em %d min.",
+
+		"attempts.cooldown": "Essa foi a última tentativa. Aguarde %d min antes de tentar de novo.",
+		"attempts.wait":     "Aguarde %d min antes de tentar de novo.",
+
+		"unlock.usage": "Uso: /unlock <ID do usuário no Telegram>",
+		"unlock.done":  "O usuário %d já pode tentar de novo.",
+
+		"choice.prompt":      "Escolha uma das opções abaixo.",
+		"choice.stale":       "Esta pergunta não está mais ativa.",
+		"choice.list_button": "Opções",
+
+		"action.failed": "Algo deu errado do nosso lado. Tente novamente.",
+
+		"consent.accept":       "Concordo",
+		"consent.decline":      "Não concordo",
+		"consent.prompt":       "Toque em \"Concordo\" ou \"Não concordo\" para continuar.",
+		"consent.required":     "Antes de analisarmos qualquer foto, precisamos do seu consentimento.",
+		"consent.declined":     "Entendido. Sem o seu consentimento não podemos analisar fotos. Envie /start se mudar de ideia.",
+		"consent.store_failed": "Não conseguimos registrar seu consentimento agora. Tente novamente em instantes.",
+
+		"back.button":      "⬅ Voltar",
+		"back.unavailable": "Não há uma pergunta anterior para voltar.",
+
+		"conversation.updated": "Esta conversa foi atualizada, então vamos continuar a partir daqui.",
+
+		"inactivity.nudge":   "Você ainda está aí? Estou aguardando sua resposta para continuarmos.",
+		"inactivity.goodbye": "Como não tivemos notícias suas por um tempo, esta conversa foi encerrada. Envie /start quando quiser começar de novo.",
+
+		"command.start":       "Iniciar a triagem",
+		"command.restart":     "Recomeçar do início",
+		"command.back":        "Voltar para a pergunta anterior",
+		"command.cancel":      "Cancelar a conversa atual",
+		"command.status":      "Mostrar a etapa atual",
+		"command.help":        "Listar os comandos disponíveis",
+		"command.language":    "Escolher o idioma do bot",
+		"command.cancelled":   "Conversa cancelada. Envie /start quando quiser começar de novo.",
+		"command.unknown":     "Comando desconhecido. Envie /help para ver o que posso fazer.",
+		"command.sign_in":     "Entre com seu usuário e senha antes de usar este comando.",
+		"command.help_header": "Comandos disponíveis:",
+
+		"status.idle":      "Nenhuma conversa em andamento. Envie /start para começar.",
+		"status.waiting":   "A conversa está em andamento; no momento não há nada pendente da sua parte.",
+		"status.step":      "Etapa atual: %s\n%s",
+		"status.signed_in": "\n\nConectado como %s.",
+
+		"language.current": "Idioma atual: %s. Disponíveis: %s.\nEnvie /language <código> para mudar ou /language auto para seguir o idioma do seu Telegram.",
+		"language.set":     "Idioma alterado para %s.",
+		"language.auto":    "Voltarei a usar o idioma do seu Telegram.",
+		"language.unknown": "Não conheço o idioma %q. Disponíveis: %s.",
+
+		"validate.max_length": "Use no máximo %d caracteres na resposta.",
+		"validate.pattern":    "A resposta não está no formato esperado. Tente novamente.",
+		"validate.int":        "Responda com um número inteiro%s.",
+		"validate.float":      "Responda com um número%s.",
+		"validate.enum":       "Responda com uma das opções: %s.",
+		"validate.date":       "Responda com uma data no formato %s.",
+		"validate.between":    " entre %s e %s",
+		"validate.at_least":   " maior ou igual a %s",
+		"validate.at_most":    " menor ou igual a %s",
+	},
+}
+
+// normalizeLocale turns tags such as "pt_BR" or "PT-br" into "pt-br".
+func normalizeLocale(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "_", "-"))
+}
+
+// baseLocale strips the region from a locale: "pt-br" becomes "pt".
+func baseLocale(code string) string {
+	if i := strings.IndexByte(code, '-'); i > 0 {
+		return code[:i]
+	}
+	return code
+}
+
+// lookupLocalized returns texts[locale], trying the locale's base language
+// before giving up. Keys of texts may use any case or separator.
+func lookupLocalized(texts map[string]string, locale string) (string, bool) {
+	locale = normalizeLocale(locale)
+	for _, want := range []string{locale, baseLocale(locale)} {
+		for k, v := range texts {
+			if normalizeLocale(k) == want {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+// msg returns the catalog string key in locale, formatted with args.
+func msg(locale, key string, args ...interface{}) string {
+	format := key
+	for _, l := range []string{locale, defaultLocale, "en"} {
+		if s, ok := catalog[normalizeLocale(l)][key]; ok {
+			format = s
+			break
+		}
+		if s, ok := catalog[baseLocale(normalizeLocale(l))][key]; ok {
+			format = s
+			break
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// chatLocale picks the chat's language: its /language choice, then the
+// language_code Telegram reported, then the default locale.
+func chatLocale(st *ChatState) string {
+	switch {
+	case st.Locale != "":
+		return st.Locale
+	case st.LanguageCode != "":
+		return normalizeLocale(st.LanguageCode)
+	}
+	return defaultLocale
+}
+
+// availableLocales lists the locales of the catalog and of the running conversation.
+func availableLocales() []string {
+	set := make(map[string]bool)
+	for l := range catalog {
+		set[l] = true
+	}
+	configMu.RLock()
+	for l := range conversationLocales {
+		set[l] = true
+	}
+	configMu.RUnlock()
+	out := make([]string, 0, len(set))
+	for l := range set {
+		out = append(out, l)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// conversationLocales is the set of locales the running conversation has texts for.
+var conversationLocales map[string]bool
+
+// nodeText returns the node's text in locale, falling back to its default text.
+func nodeText(n Node, locale string) string {
+	if s, ok := lookupLocalized(n.Texts, locale); ok {
+		return s
+	}
+	return n.Text
+}
+
+// optionLabel returns the option's label in locale, falling back to its default label.
+func optionLabel(o ConvOption, locale string) string {
+	if s, ok := lookupLocalized(o.Labels, locale); ok {
+		return s
+	}
+	return o.Label
+}
+
+type localeKey struct{}
+
+// withLocale tells the classifier which language the patient reads.
+func withLocale(ctx context.Context, locale string) context.Context {
+	return context.WithValue(ctx, localeKey{}, locale)
+}
+
+// localeFromContext returns the locale set by withLocale, or "".
+func localeFromContext(ctx context.Context) string {
+	locale, _ := ctx.Value(localeKey{}).(string)
+	return locale
+}
+
+// handleLanguageCommand shows or changes the chat's language.
+func handleLanguageCommand(chatID int64, args string) {
+	st := chatStateFor(chatID)
+	available := strings.Join(availableLocales(), ", ")
+	arg := normalizeLocale(args)
+	switch arg {
+	case "":
+		replyOrLog(chatID, msg(chatLocale(st), "language.current", chatLocale(st), available))
+		return
+	case "auto":
+		st.Locale = ""
+		saveChatState(chatID)
+		replyOrLog(chatID, msg(chatLocale(st), "language.auto"))
+		return
+	}
+	for _, l := range availableLocales() {
+		if l == arg || l == baseLocale(arg) {
+			st.Locale = arg
+			saveChatState(chatID)
+			name := arg
+			if _, ok := catalog[baseLocale(arg)]; ok {
+				name = msg(arg, "language.name")
+			}
+			replyOrLog(chatID, msg(arg, "language.set", name))
+			return
+		}
+	}
+	replyOrLog(chatID, msg(chatLocale(st), "language.unknown", args, available))
+}
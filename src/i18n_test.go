@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMsgFallsBackToDefaultLocale(t *testing.T) {
+	if got := msg("pt-BR", "command.help_header"); got != "Comandos disponíveis:" {
+		t.Fatalf("expected regional tag to use the base locale, got %q", got)
+	}
+	if got := msg("es", "command.help_header"); got != "Available commands:" {
+		t.Fatalf("expected unknown locale to fall back to English, got %q", got)
+	}
+	if got := msg("pt", "document.too_large", 20); !strings.Contains(got, "20 MB") {
+		t.Fatalf("expected formatted message, got %q", got)
+	}
+	if got := msg("en", "no.such.key"); got != "no.such.key" {
+		t.Fatalf("expected missing key to be returned as is, got %q", got)
+	}
+}
+
+func TestChatLocalePriority(t *testing.T) {
+	st := &ChatState{}
+	if got := chatLocale(st); got != defaultLocale {
+		t.Fatalf("expected default locale, got %q", got)
+	}
+	st.LanguageCode = "pt-BR"
+	if got := chatLocale(st); got != "pt-br" {
+		t.Fatalf("expected Telegram language, got %q", got)
+	}
+	st.Locale = "en"
+	if got := chatLocale(st); got != "en" {
+		t.Fatalf("expected /language override, got %q", got)
+	}
+}
+
+func TestLocalizedConversation(t *testing.T) {
+	resetGlobals()
+	originalSend, originalSendWith, originalClassify := sendReply, sendReplyWith, classifyPhoto
+	defer func() { sendReply, sendReplyWith, classifyPhoto = originalSend, originalSendWith, originalClassify }()
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+	var labels []string
+	sendReplyWith = func(id int64, text string, opts ReplyOptions) error {
+		sent = append(sent, text)
+		for _, row := range opts.ReplyMarkup.InlineKeyboard {
+			labels = append(labels, row[0].Text)
+		}
+		return nil
+	}
+	var classifierLocale string
+	classifyPhoto = func(ctx context.Context, path string) (bool, string, error) {
+		classifierLocale = localeFromContext(ctx)
+		return false, "Mucosa saudável.", nil
+	}
+
+	applyConversation(&ConversationFile{Messages: []ConvMessage{
+		{ID: "start", Type: "start_message", Text: "Hello {{.User.FirstName}}!", Texts: map[string]string{"pt-BR": "Olá {{.User.FirstName}}!"}, SuccessTransition: strPtr("smoker")},
+		{ID: "smoker", Type: "choice", Text: "Do you smoke?", Texts: map[string]string{"pt": "Você fuma?"}, SuccessTransition: strPtr("photo"),
+			Options: []ConvOption{{Label: "Yes", Value: "yes", Labels: map[string]string{"pt": "Sim"}}, {Label: "No", Value: "no", Labels: map[string]string{"pt": "Não"}}}},
+		{ID: "photo", Type: "start_message", Text: "Send a photo", Texts: map[string]string{"pt": "Envie uma foto"}, ExpectPhoto: true},
+	}})
+	from := &User{ID: 1, FirstName: "Maria", LanguageCode: "pt-br"}
+	send := func(m *Message) {
+		m.Chat, m.From = Chat{ID: 8}, from
+		captureOutput(t, func() { printMessage(m) })
+	}
+
+	send(&Message{Text: "oi"})
+	if len(sent) != 2 || sent[0] != "Olá Maria!" || sent[1] != "Você fuma?" {
+		t.Fatalf("unexpected Portuguese flow %q", sent)
+	}
+	if strings.Join(labels, ",") != "Sim,Não" {
+		t.Fatalf("unexpected option labels %q", labels)
+	}
+
+	// Typed localized labels are accepted and the canonical value is stored.
+	sent = nil
+	send(&Message{Text: "não"})
+	if st := chatStateFor(8); st.Answers["smoker"] != "no" || st.Awaiting != "photo" {
+		t.Fatalf("localized label not accepted: %+v", st)
+	}
+
+	originalSave := savePhoto
+	defer func() { savePhoto = originalSave }()
+	savePhoto = func(ctx context.Context, m *Message) (string, error) { return "assets/photo.jpg", nil }
+	sent = nil
+	send(&Message{Photo: []PhotoSize{{FileID: "f"}}})
+	if classifierLocale != "pt-br" {
+		t.Fatalf("classifier did not receive the patient locale, got %q", classifierLocale)
+	}
+	if len(sent) == 0 || !strings.HasPrefix(sent[0], "Avaliação do modelo: Não.") {
+		t.Fatalf("expected Portuguese verdict, got %q", sent)
+	}
+
+	// /language overrides Telegram's language for built-in strings and node texts.
+	sent = nil
+	send(&Message{Text: "/language en"})
+	send(&Message{Text: "/status"})
+	if len(sent) != 2 || sent[0] != "Language set to English." || !strings.HasPrefix(sent[1], "The conversation is in progress") {
+		t.Fatalf("unexpected replies after /language %q", sent)
+	}
+	sent = nil
+	send(&Message{Text: "/language xx"})
+	if len(sent) != 1 || !strings.Contains(sent[0], `"xx"`) {
+		t.Fatalf("unexpected reply to unknown language %q", sent)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// configDuration is a time.Duration written as a Go duration string ("30m", "6h") in JSON.
+type configDuration struct {
+	time.Duration
+}
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30m\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d configDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+// ConvInactivity overrides the inactivity timers while a chat waits on a node.
+// A zero duration disables that step for the node.
+type ConvInactivity struct {
+	NudgeAfter   *configDuration   `json:"nudge_after,omitempty"`
+	NudgeText    string            `json:"nudge_text,omitempty"`
+	NudgeTexts   map[string]string `json:"nudge_texts,omitempty"`
+	ExpireAfter  *configDuration   `json:"expire_after,omitempty"`
+	GoodbyeText  string            `json:"goodbye_text,omitempty"`
+	GoodbyeTexts map[string]string `json:"goodbye_texts,omitempty"`
+}
+
+// inactivityMonitor nudges chats that went quiet while the bot waits for an
+// answer and closes conversations that stay silent for too long.
+type inactivityMonitor struct {
+	nudgeAfter  time.Duration // 0 disables reminders
+	expireAfter time.Duration // 0 disables expiry
+	interval    time.Duration // how often chats are checked
+	submit      func(chatID int64, job func())
+}
+
+// inactivityMonitorFromEnv reads INACTIVITY_NUDGE_AFTER (default 30m),
+// INACTIVITY_EXPIRE_AFTER (default 12h) and INACTIVITY_CHECK_INTERVAL (default 1m).
+func inactivityMonitorFromEnv(submit func(chatID int64, job func())) (*inactivityMonitor, error) {
+	m := &inactivityMonitor{
+		nudgeAfter:  30 * time.Minute,
+		expireAfter: 12 * time.Hour,
+		interval:    time.Minute,
+		submit:      submit,
+	}
+	for _, e := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"INACTIVITY_NUDGE_AFTER", &m.nudgeAfter},
+		{"INACTIVITY_EXPIRE_AFTER", &m.expireAfter},
+		{"INACTIVITY_CHECK_INTERVAL", &m.interval},
+	} {
+		v := os.Getenv(e.name)
+		if v == "" {
+			continue
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid %s %q", e.name, v)
+		}
+		*e.dst = d
+	}
+	if m.interval <= 0 {
+		m.interval = time.Minute
+	}
+	return m, nil
+}
+
+// Run checks every chat once per interval until ctx is cancelled.
+func (m *inactivityMonitor) Run(ctx context.Context) {
+	if m.nudgeAfter == 0 && m.expireAfter == 0 {
+		return
+	}
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.Sweep()
+		}
+	}
+}
+
+// Sweep queues a check for every chat held in memory. Checks run on the chat's
+// own queue because only that queue may touch its state.
+func (m *inactivityMonitor) Sweep() {
+	statesMu.Lock()
+	ids := make([]int64, 0, len(states))
+	for id := range states {
+		ids = append(ids, id)
+	}
+	statesMu.Unlock()
+	for _, id := range ids {
+		id := id
+		m.submit(id, func() { m.check(id) })
+	}
+}
+
+// limits returns the timers that apply while a chat waits on node n.
+func (m *inactivityMonitor) limits(n Node) (nudge, expire time.Duration) {
+	nudge, expire = m.nudgeAfter, m.expireAfter
+	if n.Inactivity != nil {
+		if n.Inactivity.NudgeAfter != nil {
+			nudge = n.Inactivity.NudgeAfter.Duration
+		}
+		if n.Inactivity.ExpireAfter != nil {
+			expire = n.Inactivity.ExpireAfter.Duration
+		}
+	}
+	return nudge, expire
+}
+
+func (m *inactivityMonitor) check(chatID int64) {
+	statesMu.Lock()
+	st := states[chatID]
+	statesMu.Unlock()
+	if st == nil || st.LastActivity.IsZero() {
+		return
+	}
+	// A cooldown outlives inactivity: expiring the chat would lift it.
+	if clock().Before(st.CooldownUntil) {
+		return
+	}
+	n, _ := lookupNode(st.Awaiting)
+	nudge, expire := m.limits(n)
+	idle := clock().Sub(st.LastActivity)
+	locale := chatLocale(st)
+
+	switch {
+	case expire > 0 && idle >= expire:
+		// Only conversations still waiting on an answer are closed with a goodbye;
+		// finished ones just leave memory.
+		if st.Started && st.Awaiting != "" {
+			text := msg(locale, "inactivity.goodbye")
+			if in := n.Inactivity; in != nil {
+				text = localizedOverride(in.GoodbyeText, in.GoodbyeTexts, locale, text)
+			}
+			log.Printf("chat %d idle for %s, closing the conversation", chatID, idle.Round(time.Second))
+			replyOrLog(chatID, text)
+			recordDropoff(st.Awaiting)
+			if sessionStore != nil {
+				if err := sessionStore.Delete(chatID); err != nil {
+					log.Printf("delete session for chat %d: %v", chatID, err)
+				}
+			}
+		}
+		// Idle chats are dropped from memory; a new message starts over.
+		statesMu.Lock()
+		if states[chatID] == st {
+			delete(states, chatID)
+		}
+		statesMu.Unlock()
+	case nudge > 0 && idle >= nudge && !st.Nudged && st.Started && st.Awaiting != "":
+		text := msg(locale, "inactivity.nudge")
+		if in := n.Inactivity; in != nil {
+			text = localizedOverride(in.NudgeText, in.NudgeTexts, locale, text)
+		}
+		log.Printf("chat %d idle for %s on %s, sending a reminder", chatID, idle.Round(time.Second), st.Awaiting)
+		replyOrLog(chatID, text)
+		st.Nudged = true
+		saveChatState(chatID)
+	}
+}
+
+// Drop-offs recorded when the bot closes a conversation that was still waiting
+// on an answer, counted per node and persisted to dropoffFile. The sessions
+// themselves are gone by then, so this record is what the graph overlay reads.
+var (
+	dropoffMu     sync.Mutex
+	dropoffCounts map[string]int
+	dropoffFile   string
+)
+
+// loadDropoffs reads the drop-off record; a missing file starts an empty one.
+func loadDropoffs(path string) error {
+	counts, err := readDropoffs(path)
+	if err != nil {
+		return err
+	}
+	dropoffMu.Lock()
+	defer dropoffMu.Unlock()
+	dropoffCounts, dropoffFile = counts, path
+	return nil
+}
+
+// readDropoffs decodes a drop-off record file.
+func readDropoffs(path string) (map[string]int, error) {
+	counts := make(map[string]int)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return counts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &counts); err != nil {
+			return nil, fmt.Errorf("decode drop-offs: %w", err)
+		}
+	}
+	return counts, nil
+}
+
+// recordDropoff counts a conversation abandoned on nodeID. Without a drop-off
+// file (tests, the simulator) the count is kept in memory only.
+func recordDropoff(nodeID string) {
+	dropoffMu.Lock()
+	defer dropoffMu.Unlock()
+	if dropoffCounts == nil {
+		dropoffCounts = make(map[string]int)
+	}
+	dropoffCounts[nodeID]++
+	if dropoffFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(dropoffCounts, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(dropoffFile, data, 0o600)
+	}
+	if err != nil {
+		log.Printf("record drop-off on %s: %v", nodeID, err)
+	}
+}
+
+// localizedOverride picks a node's text for locale, then its default text, then fallback.
+func localizedOverride(text string, texts map[string]string, locale, fallback string) string {
+	if s, ok := lookupLocalized(texts, locale); ok {
+		return s
+	}
+	if text != "" {
+		return text
+	}
+	return fallback
+}
+
+// touchChat records that the user just wrote to the bot.
+func touchChat(st *ChatState) {
+	st.LastActivity = clock()
+	st.Nudged = false
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const inactivityConv = `{"messages":[
+{"id":"start","type":"start_message","text":"hi","success_transition":"name"},
+{"id":"name","type":"question","text":"Your name?","success_transition":"age","fail_transition":"name"},
+{"id":"age","type":"question","text":"Your age?","success_transition":"end","fail_transition":"age",
+ "inactivity":{"nudge_after":"5m","nudge_texts":{"pt":"Qual a sua idade?"},"expire_after":"0s"}},
+{"id":"end","type":"end_message","text":"bye"}]}`
+
+func TestInactivityMonitorNudgesThenExpires(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	path := filepath.Join(t.TempDir(), "conversation.json")
+	if err := os.WriteFile(path, []byte(inactivityConv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConversation(path); err != nil {
+		t.Fatal(err)
+	}
+
+	originalSend, originalClock := sendReply, clock
+	defer func() { sendReply, clock = originalSend, originalClock }()
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+	now := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+
+	m := &inactivityMonitor{nudgeAfter: 30 * time.Minute, expireAfter: 2 * time.Hour, interval: time.Minute,
+		submit: func(chatID int64, job func()) { job() }}
+
+	printMessage(&Message{Chat: Chat{ID: 7}, Text: "/start"})
+	sent = nil
+
+	now = now.Add(29 * time.Minute)
+	m.Sweep()
+	if len(sent) != 0 {
+		t.Fatalf("nudged too early: %v", sent)
+	}
+	now = now.Add(time.Minute)
+	m.Sweep()
+	m.Sweep()
+	if len(sent) != 1 || sent[0] != msg("en", "inactivity.nudge") {
+		t.Fatalf("expected a single nudge, got %v", sent)
+	}
+
+	// Answering clears the nudge so the next silence gets its own reminder.
+	printMessage(&Message{Chat: Chat{ID: 7}, Text: "Ana", From: &User{LanguageCode: "pt"}})
+	sent = nil
+	now = now.Add(5 * time.Minute)
+	m.Sweep()
+	if len(sent) != 1 || sent[0] != "Qual a sua idade?" {
+		t.Fatalf("expected the node's nudge override, got %v", sent)
+	}
+	// The age node disables expiry.
+	now = now.Add(24 * time.Hour)
+	m.Sweep()
+	if len(sent) != 1 || chatStateFor(7).Awaiting != "age" {
+		t.Fatalf("age node should never expire, got %v", sent)
+	}
+}
+
+func TestInactivityMonitorExpiresSession(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	path := filepath.Join(t.TempDir(), "conversation.json")
+	if err := os.WriteFile(path, []byte(inactivityConv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConversation(path); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newFileSessionStore(filepath.Join(t.TempDir(), "sessions.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionStore = store
+
+	originalSend, originalClock := sendReply, clock
+	defer func() { sendReply, clock = originalSend, originalClock }()
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+	now := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+
+	m := &inactivityMonitor{nudgeAfter: 30 * time.Minute, expireAfter: 2 * time.Hour, interval: time.Minute,
+		submit: func(chatID int64, job func()) { job() }}
+
+	printMessage(&Message{Chat: Chat{ID: 8}, Text: "/start"})
+	sent = nil
+	now = now.Add(3 * time.Hour)
+	m.Sweep()
+	if len(sent) != 1 || !strings.Contains(sent[0], "closed") {
+		t.Fatalf("expected the goodbye message, got %v", sent)
+	}
+	statesMu.Lock()
+	_, inMemory := states[8]
+	statesMu.Unlock()
+	if inMemory {
+		t.Fatalf("expired chat still held in memory")
+	}
+	if st, err := store.Load(8); err != nil || st != nil {
+		t.Fatalf("expired session still stored: %+v, %v", st, err)
+	}
+	if st := chatStateFor(8); st.Started || st.Awaiting != "" {
+		t.Fatalf("expired chat should start over, got %+v", st)
+	}
+	if len(dropoffCounts) != 1 || dropoffCounts["name"] != 1 {
+		t.Fatalf("expected the drop-off recorded on the node the chat stopped at, got %v", dropoffCounts)
+	}
+}
+
+func TestInactivityMonitorSparesFinishedAndCoolingChats(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	path := filepath.Join(t.TempDir(), "conversation.json")
+	if err := os.WriteFile(path, []byte(inactivityConv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConversation(path); err != nil {
+		t.Fatal(err)
+	}
+	originalSend, originalClock := sendReply, clock
+	defer func() { sendReply, clock = originalSend, originalClock }()
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+	now := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return now }
+
+	m := &inactivityMonitor{nudgeAfter: 30 * time.Minute, expireAfter: 2 * time.Hour, interval: time.Minute,
+		submit: func(chatID int64, job func()) { job() }}
+
+	// Chat 9 finished the conversation; chat 10 is cooling down on a question.
+	printMessage(&Message{Chat: Chat{ID: 9}, Text: "/start"})
+	printMessage(&Message{Chat: Chat{ID: 9}, Text: "Ana"})
+	printMessage(&Message{Chat: Chat{ID: 9}, Text: "40"})
+	if st := chatStateFor(9); !st.Started || st.Awaiting != "" {
+		t.Fatalf("expected a finished conversation, got %+v", st)
+	}
+	printMessage(&Message{Chat: Chat{ID: 10}, Text: "/start"})
+	chatStateFor(10).CooldownUntil = now.Add(6 * time.Hour)
+	sent = nil
+
+	now = now.Add(3 * time.Hour)
+	m.Sweep()
+	if len(sent) != 0 {
+		t.Fatalf("finished or cooling chats got messages: %v", sent)
+	}
+	if st := chatStateFor(10); st.Awaiting != "name" || st.CooldownUntil.IsZero() {
+		t.Fatalf("cooldown lost to expiry: %+v", st)
+	}
+}
+
+func TestValidateInactivity(t *testing.T) {
+	var cf ConversationFile
+	err := json.Unmarshal([]byte(`{"messages":[
+{"id":"start","type":"start_message","text":"hi","success_transition":"q"},
+{"id":"q","type":"question","text":"?","success_transition":"end","fail_transition":"q","inactivity":{"nudge_after":"2h","expire_after":"1h"}},
+{"id":"end","type":"end_message","text":"bye"}]}`), &cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issues := validateConversation(&cf)
+	if len(issues) != 1 || !strings.Contains(issues[0], "nudge_after must be shorter") {
+		t.Fatalf("unexpected issues: %v", issues)
+	}
+}
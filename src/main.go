@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,50 +17,126 @@ import (
 
 // Global runtime state.
 var (
+	configMu         sync.RWMutex // guards nodes, startNodeID, fallbackNodeID, flows, customCommands, authUsers and authRoles
 	nodes            map[string]Node
 	startNodeID      string
+	fallbackNodeID   string
 	states           map[int64]*ChatState
+	statesMu         sync.Mutex
+	sessionStore     SessionStore
+	sessionTTL       time.Duration
 	apiBase          string
 	httpClient       *http.Client
 	assetsDir        string
 	maxDownloadBytes int64
 	authUsers        map[string]string
+	authRoles        map[string]string
 	diagnosisLog     map[string][]DiagnosisEntry
 	diagnosisFile    string
 	diagnosisMu      sync.Mutex
 
-	sendReply = sendMessage
-	savePhoto = saveIncomingPhoto
+	sendReply      = sendMessage
+	sendReplyWith  = sendMessageWith
+	answerCallback = answerCallbackQuery
+	savePhoto      = saveIncomingPhoto
 
 	classifyPhoto CancerClassifier = classifyWithGemini
 
+	clock = time.Now
+
+	albums = newMediaGroupCollector(1500 * time.Millisecond)
+
 	geminiClient     *gemini.Client
 	geminiClientOnce sync.Once
 	geminiClientErr  error
 )
 
 // chatStateFor retrieves or initializes the state tracking for a chat ID.
+// States missing from memory are restored from the session store when one is configured.
 func chatStateFor(chatID int64) *ChatState {
+	statesMu.Lock()
 	st := states[chatID]
+	statesMu.Unlock()
+	if st != nil && sessionExpired(st, sessionTTL, time.Now()) {
+		// The session outlived SESSION_TTL before the inactivity monitor closed it.
+		if st.Started && st.Awaiting != "" {
+			recordDropoff(st.Awaiting)
+		}
+		st = nil
+	}
+	if st != nil {
+		return st
+	}
+
+	if sessionStore != nil {
+		loaded, err := sessionStore.Load(chatID)
+		if err != nil {
+			log.Printf("load session for chat %d: %v", chatID, err)
+		}
+		st = loaded
+	}
 	if st == nil {
-		st = &ChatState{Answers: make(map[string]string)}
-		states[chatID] = st
+		st = &ChatState{}
+	}
+	if st.Answers == nil {
+		st.Answers = make(map[string]string)
+	}
+
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	if cur := states[chatID]; cur != nil && !sessionExpired(cur, sessionTTL, time.Now()) {
+		return cur
+	}
+	states[chatID] = st
+	return st
+}
+
+// resetChatState replaces a chat's state with a fresh one and returns it. What
+// the sender's messages tell about them is kept; the sign-in, and with it the
+// role, is not.
+func resetChatState(chatID int64, started bool) *ChatState {
+	st := &ChatState{Answers: make(map[string]string), Started: started}
+	statesMu.Lock()
+	if old := states[chatID]; old != nil {
+		st.FirstName = old.FirstName
+		st.LanguageCode = old.LanguageCode
+		st.UserID = old.UserID
+		st.Locale = old.Locale
+		st.LastActivity = old.LastActivity
+		st.Flow = old.Flow
+		st.CooldownUntil = old.CooldownUntil
 	}
+	states[chatID] = st
+	statesMu.Unlock()
 	return st
 }
 
-// main boots the Telegram polling loop and model's client prompt handling.
+// workerLimitFromEnv reads WORKER_LIMIT, the number of chats handled in parallel.
+func workerLimitFromEnv() int {
+	if v := os.Getenv("WORKER_LIMIT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("warning: invalid WORKER_LIMIT %q, using default", v)
+	}
+	return 8
+}
+
+// main boots the messaging transport (Telegram or WhatsApp) and model's client prompt handling.
 func main() {
 	_ = godotenv.Load()
 
-	token := os.Getenv("TELEGRAM_TOKEN")
-	if token == "" {
-		log.Fatal("TELEGRAM_TOKEN not set in environment")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate(os.Args[2:], os.Stdout, os.Stderr))
+		case "graph":
+			os.Exit(runGraph(os.Args[2:], os.Stdout, os.Stderr))
+		case "simulate":
+			os.Exit(runSimulate(os.Args[2:], os.Stdin, os.Stdout, os.Stderr))
+		}
 	}
 
-	base := "https://api.telegram.org/bot" + token + "/"
-	apiBase = base
-
 	// Configure runtime assets directory and download limits from environment.
 	assetsDir = os.Getenv("ASSETS_DIR")
 	if assetsDir == "" {
@@ -75,14 +153,35 @@ func main() {
 	} else {
 		maxDownloadBytes = 20 * 1024 * 1024
 	}
-	log.Println("starting telbot long-polling...")
+
+	if v := os.Getenv("DEFAULT_LOCALE"); v != "" {
+		defaultLocale = normalizeLocale(v)
+	}
 
 	// load conversation graph if present
+	// CONVERSATION_STRICT refuses to start when conversation.json is missing or invalid.
+	strict, _ := strconv.ParseBool(os.Getenv("CONVERSATION_STRICT"))
+	conversationPath := conversationPathFromEnv()
 	states = make(map[int64]*ChatState)
-	if err := loadConversation("configs/conversation.json"); err != nil {
+	cf, err := readConversation(conversationPath)
+	if err == nil {
+		err = checkRunnable(cf)
+	}
+	if err != nil {
+		if strict {
+			log.Fatalf("could not load conversation.json: %v", err)
+		}
 		log.Printf("warning: could not load conversation.json: %v", err)
 	} else {
-		log.Printf("conversation loaded, start node: %s", startNodeID)
+		issues := validateConversation(cf)
+		for _, issue := range issues {
+			log.Printf("conversation.json: %s", issue)
+		}
+		if strict && len(issues) > 0 {
+			log.Fatalf("conversation.json has %d problem(s); refusing to start in strict mode", len(issues))
+		}
+		applyConversation(cf)
+		log.Printf("conversation loaded, start node: %s", currentStartNode())
 	}
 	if err := loadAuth("configs/auth.json"); err != nil {
 		log.Printf("warning: could not load auth.json: %v", err)
@@ -95,32 +194,157 @@ func main() {
 		log.Printf("diagnosis history entries: %d", len(diagnosisLog))
 	}
 
+	// CONSENT_FILE keeps the audited consent acceptances.
+	consentPath := os.Getenv("CONSENT_FILE")
+	if consentPath == "" {
+		consentPath = "configs/consents.json"
+	}
+	// Starting without the existing log would let new consents overwrite it.
+	if err := loadConsents(consentPath); err != nil {
+		log.Fatalf("consent log %s: %v", consentPath, err)
+	}
+	log.Printf("consent records: %d", len(consentRecords))
+
+	// DROPOFF_FILE counts the conversations closed while waiting on a node.
+	if err := loadDropoffs(dropoffPathFromEnv()); err != nil {
+		log.Printf("warning: could not load drop-offs: %v", err)
+	}
+
+	store, ttl, err := sessionStoreFromEnv()
+	if err != nil {
+		log.Fatalf("session store: %v", err)
+	}
+	sessionStore, sessionTTL = store, ttl
+
 	initQueue()
 
-	offset := 0
 	client := &http.Client{Timeout: 60 * time.Second}
 	httpClient = client
 
-	// loop and transition
-	for {
-		updates, err := getUpdates(client, base, offset, 30)
+	// Updates from different chats run in parallel; each chat stays in order.
+	workers := newDispatcher(workerLimitFromEnv())
+	deliver := func(u Update) { workers.Submit(updateChatID(u), func() { handleUpdate(u) }) }
+
+	// TRANSPORT selects the messaging platform: "telegram" (default) or "whatsapp".
+	var transport Transport
+	switch kind := os.Getenv("TRANSPORT"); kind {
+	case "", "telegram":
+		token := os.Getenv("TELEGRAM_TOKEN")
+		if token == "" {
+			log.Fatal("TELEGRAM_TOKEN not set in environment")
+		}
+
+		// TELEGRAM_API_URL lets the bot talk to a local Bot API server or a test double.
+		apiURL := strings.TrimRight(os.Getenv("TELEGRAM_API_URL"), "/")
+		if apiURL == "" {
+			apiURL = "https://api.telegram.org"
+		}
+		base := apiURL + "/bot" + token + "/"
+		apiBase = base
+
+		offsets, err := offsetStoreFromEnv()
+		if err != nil {
+			log.Fatalf("offset store: %v", err)
+		}
+		tracker, err := newUpdateTracker(offsets)
 		if err != nil {
-			log.Printf("getUpdates error: %v", err)
-			time.Sleep(2 * time.Second)
-			continue
+			log.Fatalf("restore update offset: %v", err)
 		}
+		tt := &telegramTransport{client: client, base: base, tracker: tracker}
 
-		for _, u := range updates {
-			if u.UpdateID >= offset {
-				offset = u.UpdateID + 1
+		// TELEGRAM_MODE selects how updates are received: "polling" (default) or "webhook".
+		if strings.EqualFold(os.Getenv("TELEGRAM_MODE"), "webhook") {
+			cfg, err := webhookConfigFromEnv()
+			if err != nil {
+				log.Fatal(err)
 			}
-			if u.Message != nil {
-				printMessage(u.Message)
+			tt.webhook = &cfg
+			// Webhooks arrive in parallel and are retried out of order, so they
+			// are deduplicated by ID rather than through the polling offset.
+			pending := newWebhookUpdates(webhookMaxPendingFromEnv())
+			tt.accept = func(u Update) bool { return pending.Submit(workers, u) }
+		}
+		transport = tt
+		deliver = func(u Update) { submitUpdate(workers, tracker, u) }
+	case "whatsapp":
+		cfg, err := whatsappConfigFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		transport = newWhatsAppTransport(cfg, client)
+	default:
+		log.Fatalf("unknown TRANSPORT %q", kind)
+	}
+	registerCommands := func() {}
+	if r, ok := transport.(commandRegistrar); ok {
+		registerCommands = func() {
+			// The default menu is in DEFAULT_LOCALE; each catalog locale gets its own.
+			if err := r.SetCommands(allCommands(defaultLocale), ""); err != nil {
+				log.Printf("warning: could not register bot commands: %v", err)
 			}
-			if u.EditedMessage != nil {
-				log.Printf("Edited message: ")
-				printMessage(u.EditedMessage)
+			for locale := range catalog {
+				if err := r.SetCommands(allCommands(locale), locale); err != nil {
+					log.Printf("warning: could not register %s bot commands: %v", locale, err)
+				}
 			}
 		}
 	}
+	registerCommands()
+	savePhoto = transport.DownloadMedia
+	answerCallback = transport.AnswerCallback
+
+	// Replies go through a persistent outbox that honours the platform's rate limits.
+	outboxPath := os.Getenv("OUTBOX_FILE")
+	if outboxPath == "" {
+		outboxPath = "configs/outbox.json"
+	}
+	out, err := newOutbox(outboxPath, transport.SendText)
+	if err != nil {
+		log.Fatalf("outbox: %v", err)
+	}
+	if n := out.Len(); n > 0 {
+		log.Printf("outbox restored %d pending messages", n)
+	}
+	// As many chats are sent to in parallel as are handled in parallel.
+	out.senders = workerLimitFromEnv()
+	go out.Run(context.Background())
+	sendReply = out.Send
+	sendReplyWith = out.SendWith
+
+	// SIGHUP (or a change seen every CONFIG_WATCH_INTERVAL) reloads conversation.json and auth.json.
+	reloader := newConfigReloader(conversationPath, "configs/auth.json")
+	reloader.onReload = registerCommands
+	reloader.strict = strict
+	go reloader.Run(context.Background(), configWatchIntervalFromEnv())
+
+	// Quiet chats get a reminder and are closed after a while.
+	monitor, err := inactivityMonitorFromEnv(workers.Submit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go monitor.Run(context.Background())
+
+	// Repeated failed sign-ins lock the Telegram user out; /unlock clears it on the user's queue.
+	lockoutStore, err := lockoutStoreFromEnv()
+	if err != nil {
+		log.Fatalf("lockout store: %v", err)
+	}
+	if lockouts, err = loginLockoutFromEnv(lockoutStore); err != nil {
+		log.Fatal(err)
+	}
+	submitChatJob = workers.Submit
+
+	// Albums are flushed on the chat's worker queue once their photos stop arriving.
+	albums.submit = workers.Submit
+	if v := os.Getenv("MEDIA_GROUP_DEBOUNCE"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			albums.debounce = d
+		} else {
+			log.Printf("warning: invalid MEDIA_GROUP_DEBOUNCE %q, using %s", v, albums.debounce)
+		}
+	}
+	// MEDIA_GROUP_VERDICT selects how an album is judged: "any" (default) or "majority".
+	albums.majority = strings.EqualFold(os.Getenv("MEDIA_GROUP_VERDICT"), "majority")
+
+	log.Fatal(transport.Run(deliver))
 }
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func captureOutput(t *testing.T, fn func()) string {
@@ -45,6 +46,57 @@ func resetGlobals() {
 	authUsers = nil
 	diagnosisLog = nil
 	diagnosisFile = ""
+	sessionStore = nil
+	sessionTTL = 0
+	customCommands = nil
+	fallbackNodeID = ""
+	nodeTemplates = nil
+	flows = nil
+	defaultFlowID = ""
+	flowStarts = nil
+	authRoles = nil
+	consentNodeID, consentVersion = "", ""
+	conversationVersion = ""
+	lockouts = newLoginLockout(5, 15*time.Minute)
+	consentRecords, consentFile = nil, ""
+	dropoffCounts, dropoffFile = nil, ""
+}
+
+// setupChatTest resets the globals and stubs Telegram, photo storage, the
+// classifier and the clock for a test that drives chats through the
+// conversation built from messages, or through nodes the test installs itself.
+// Replies are collected in the returned slice, photos are classified as clear
+// and the clock reads the returned time until the test swaps a stub.
+// Everything is restored when the test ends.
+func setupChatTest(t *testing.T, messages ...ConvMessage) (*[]string, *time.Time) {
+	t.Helper()
+	resetGlobals()
+	t.Cleanup(resetGlobals)
+	originalSend, originalSendWith, originalAnswer := sendReply, sendReplyWith, answerCallback
+	originalSave, originalClassifier, originalClock := savePhoto, classifyPhoto, clock
+	t.Cleanup(func() {
+		sendReply, sendReplyWith, answerCallback = originalSend, originalSendWith, originalAnswer
+		savePhoto, classifyPhoto, clock = originalSave, originalClassifier, originalClock
+	})
+	sent := new([]string)
+	sendReply = func(id int64, text string) error {
+		*sent = append(*sent, text)
+		return nil
+	}
+	sendReplyWith = func(id int64, text string, opts ReplyOptions) error {
+		*sent = append(*sent, text)
+		return nil
+	}
+	answerCallback = func(string, string) error { return nil }
+	savePhoto = func(ctx context.Context, m *Message) (string, error) { return "/tmp/mouth.jpg", nil }
+	classifyPhoto = func(ctx context.Context, path string) (bool, string, error) { return false, "clear", nil }
+	now := new(time.Time)
+	*now = time.Date(2024, 5, 2, 10, 0, 0, 0, time.UTC)
+	clock = func() time.Time { return *now }
+	if len(messages) > 0 {
+		buildConversation(&ConversationFile{Messages: messages}).install()
+	}
+	return sent, now
 }
 
 func TestLoadConversation(t *testing.T) {
@@ -226,8 +278,9 @@ func TestRecordDiagnosis(t *testing.T) {
 	if err := loadDiagnosis(path); err != nil {
 		t.Fatalf("loadDiagnosis returned error: %v", err)
 	}
-	if err := recordDiagnosis("patient1", "/tmp/photo.jpg", true, "looks suspicious"); err != nil {
-		t.Fatalf("recordDiagnosis returned error: %v", err)
+	recorded := DiagnosisEntry{PhotoPath: "/tmp/photo.jpg", Verdict: true, Rationale: "looks suspicious"}
+	if err := recordDiagnosisEntry("patient1", recorded); err != nil {
+		t.Fatalf("recordDiagnosisEntry returned error: %v", err)
 	}
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -256,6 +309,59 @@ func TestRecordDiagnosis(t *testing.T) {
 	}
 }
 
+func TestDiagnosisKeepsAnswers(t *testing.T) {
+	setupChatTest(t)
+	classifyPhoto = func(ctx context.Context, path string) (bool, string, error) { return true, "white patch", nil }
+	path := filepath.Join(t.TempDir(), "diag.json")
+	if err := loadDiagnosis(path); err != nil {
+		t.Fatal(err)
+	}
+	buildConversation(&ConversationFile{Version: "2024-06", Messages: []ConvMessage{
+		{ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("age")},
+		{ID: "age", Type: "question", Text: "Age?", SuccessTransition: strPtr("photo"), FailTransition: strPtr("age")},
+		{ID: "photo", Type: "start_message", Text: "Photo", ExpectPhoto: true, SuccessTransition: strPtr("smoker"), FailTransition: strPtr("photo")},
+		{ID: "smoker", Type: "question", Text: "Smoker?", SuccessTransition: strPtr("end"), FailTransition: strPtr("smoker")},
+		{ID: "end", Type: "end_message", Text: "bye"},
+	}}).install()
+
+	const chatID = 31
+	from := &User{ID: 7001}
+	printMessage(&Message{Chat: Chat{ID: chatID}, From: from, Text: "hi"})
+	chatStateFor(chatID).Username = "ana"
+	printMessage(&Message{Chat: Chat{ID: chatID}, From: from, Text: "52"})
+	printMessage(&Message{Chat: Chat{ID: chatID}, From: from, Photo: []PhotoSize{{FileID: "p"}}})
+	printMessage(&Message{Chat: Chat{ID: chatID}, From: from, Text: "yes"})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log map[string][]DiagnosisEntry
+	if err := json.Unmarshal(data, &log); err != nil {
+		t.Fatal(err)
+	}
+	if len(log["ana"]) != 1 {
+		t.Fatalf("expected one case, got %+v", log)
+	}
+	entry := log["ana"][0]
+	if entry.ID == "" || entry.ChatID != chatID || entry.TelegramUserID != 7001 || entry.ConversationVersion != "2024-06" {
+		t.Fatalf("case not attributed: %+v", entry)
+	}
+	// Answers given after the photo are added when the conversation ends.
+	if entry.Answers["age"] != "52" || entry.Answers["smoker"] != "yes" || entry.Answers["photo"] == "" {
+		t.Fatalf("answers missing from the case: %v", entry.Answers)
+	}
+}
+
+func TestConversationVersionDefaultsToHash(t *testing.T) {
+	cf := &ConversationFile{Messages: []ConvMessage{{ID: "start", Type: "start_message", Text: "hi"}}}
+	first := buildConversation(cf).version
+	cf.Messages[0].Text = "hello"
+	if first == "" || first == buildConversation(cf).version {
+		t.Fatalf("expected a content hash that changes with the file, got %q", first)
+	}
+}
+
 func strPtr(s string) *string {
 	return &s
 }
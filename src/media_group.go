@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mediaGroupCollector gathers the photos of a Telegram album (messages sharing a
+// media_group_id) and flushes them as one batch once no new photo has arrived
+// for the debounce period.
+type mediaGroupCollector struct {
+	mu       sync.Mutex
+	debounce time.Duration
+	majority bool // MEDIA_GROUP_VERDICT=majority, see aggregateVerdict
+	groups   map[string]*pendingMediaGroup
+	// submit runs the flush for a chat; main routes it through the chat's worker queue.
+	submit func(chatID int64, job func())
+}
+
+// pendingMediaGroup is an album still receiving photos.
+type pendingMediaGroup struct {
+	chatID int64
+	first  *Message
+	paths  []string
+	timer  *time.Timer
+	// handled commits the album's updates once it has been flushed.
+	handled []func()
+}
+
+func newMediaGroupCollector(debounce time.Duration) *mediaGroupCollector {
+	return &mediaGroupCollector{
+		debounce: debounce,
+		groups:   make(map[string]*pendingMediaGroup),
+		submit:   func(chatID int64, job func()) { job() },
+	}
+}
+
+// Add records a saved album photo and restarts the debounce timer; flush receives
+// every path of the album once it is complete.
+func (c *mediaGroupCollector) Add(msg *Message, path string, flush func(chatID int64, first *Message, paths []string)) {
+	key := fmt.Sprintf("%d:%s", msg.Chat.ID, msg.MediaGroupID)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g := c.groups[key]
+	if g == nil {
+		g = &pendingMediaGroup{chatID: msg.Chat.ID, first: msg}
+		c.groups[key] = g
+		g.timer = time.AfterFunc(c.debounce, func() {
+			c.mu.Lock()
+			if c.groups[key] != g {
+				// A Reset raced with an earlier firing that already flushed this album.
+				c.mu.Unlock()
+				return
+			}
+			delete(c.groups, key)
+			paths := append([]string(nil), g.paths...)
+			handled := g.handled
+			c.mu.Unlock()
+			c.submit(g.chatID, func() {
+				defer func() {
+					for _, done := range handled {
+						done()
+					}
+				}()
+				flush(g.chatID, g.first, paths)
+			})
+		})
+	} else {
+		g.timer.Reset(c.debounce)
+	}
+	g.paths = append(g.paths, path)
+	if msg.handled != nil {
+		g.handled = append(g.handled, msg.handled)
+		msg.handled = nil
+	}
+}
+
+// flushAlbum classifies a completed album if the chat is still waiting for photos.
+func flushAlbum(chatID int64, first *Message, paths []string) {
+	node, ok := lookupNode(chatStateFor(chatID).Awaiting)
+	if !ok || !node.ExpectPhoto {
+		log.Printf("dropping album for chat %d: no longer awaiting a photo", chatID)
+		return
+	}
+	handlePhotoMessage(chatID, first, paths)
+}
+
+// photoResult is the classifier outcome for one image of a case; Err is set
+// when the image could not be saved or classified.
+type photoResult struct {
+	Path      string
+	Positive  bool
+	Rationale string
+	Err       error
+}
+
+// aggregateVerdict combines per-photo results into a single case verdict, with
+// the rationale of each photo in the chat's locale. By default the case is
+// flagged when any analysed photo is positive; majority requires more than
+// half of them. Failed photos are listed but do not count.
+func aggregateVerdict(results []photoResult, locale string, majority bool) (bool, string) {
+	if len(results) == 1 {
+		return results[0].Positive, results[0].Rationale
+	}
+
+	positives, analysed := 0, 0
+	var rationale strings.Builder
+	for i, r := range results {
+		if i > 0 {
+			rationale.WriteString("\n")
+		}
+		if r.Err != nil {
+			rationale.WriteString(msg(locale, "verdict.album_photo_failed", i+1))
+			continue
+		}
+		analysed++
+		label := msg(locale, "verdict.photo_negative")
+		if r.Positive {
+			positives++
+			label = msg(locale, "verdict.photo_positive")
+		}
+		rationale.WriteString(msg(locale, "verdict.album_photo", i+1, label, r.Rationale))
+	}
+
+	verdict := positives > 0
+	if majority {
+		verdict = positives*2 > analysed
+	}
+	return verdict, rationale.String()
+}
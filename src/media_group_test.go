@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMediaGroupClassifiedAsOneCase(t *testing.T) {
+	resetGlobals()
+	originalSend, originalClassifier, originalSave, originalAlbums := sendReply, classifyPhoto, savePhoto, albums
+	defer func() {
+		sendReply, classifyPhoto, savePhoto, albums = originalSend, originalClassifier, originalSave, originalAlbums
+	}()
+
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+	savePhoto = func(ctx context.Context, msg *Message) (string, error) {
+		return fmt.Sprintf("/tmp/album_%d.jpg", msg.MessageID), nil
+	}
+	var classified []string
+	classifyPhoto = func(ctx context.Context, path string) (bool, string, error) {
+		classified = append(classified, path)
+		return path == "/tmp/album_2.jpg", "finding for " + path, nil
+	}
+
+	done := make(chan struct{})
+	albums = newMediaGroupCollector(20 * time.Millisecond)
+	albums.submit = func(chatID int64, job func()) {
+		job()
+		close(done)
+	}
+
+	nodes = map[string]Node{
+		"photo": {ID: "photo", Type: "start_message", Text: "send photos", ExpectPhoto: true, SuccessTransition: strPtr("wrap")},
+		"wrap":  {ID: "wrap", Type: "question", Text: "Anything else?"},
+	}
+	startNodeID = "photo"
+
+	chat := Chat{ID: 8}
+	captureOutput(t, func() {
+		printMessage(&Message{Chat: chat, Text: "hi"})
+		for i := 1; i <= 3; i++ {
+			printMessage(&Message{MessageID: i, Chat: chat, MediaGroupID: "album", Photo: []PhotoSize{{FileID: "f"}}})
+		}
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("album was never flushed")
+		}
+	})
+
+	if len(classified) != 3 {
+		t.Fatalf("expected every album photo classified, got %v", classified)
+	}
+	// greeting, combined verdict, next question
+	if len(sent) != 3 {
+		t.Fatalf("expected a single verdict reply, got %v", sent)
+	}
+	if !strings.Contains(sent[1], "Analysed 3 photos") || !strings.Contains(sent[1], "Yes.") {
+		t.Fatalf("unexpected combined verdict: %s", sent[1])
+	}
+	if st := chatStateFor(8); st.Awaiting != "wrap" {
+		t.Fatalf("expected a single transition to wrap, got %q", st.Awaiting)
+	}
+}
+
+func TestAggregateVerdictMajority(t *testing.T) {
+	results := []photoResult{{Positive: true}, {Positive: false}, {Positive: false}}
+	if verdict, _ := aggregateVerdict(results, "en", false); !verdict {
+		t.Fatalf("any-positive rule should flag the case")
+	}
+	if _, rationale := aggregateVerdict(results, "pt", false); !strings.HasPrefix(rationale, "Foto 1 (positiva)") {
+		t.Fatalf("rationale not in the chat's locale: %q", rationale)
+	}
+	if verdict, _ := aggregateVerdict(results, "en", true); verdict {
+		t.Fatalf("majority rule should not flag one positive out of three")
+	}
+}
+
+func TestAlbumKeepsFailedPhotosInTheCase(t *testing.T) {
+	setupChatTest(t,
+		ConvMessage{ID: "photo", Type: "start_message", Text: "send photos", ExpectPhoto: true, SuccessTransition: strPtr("wrap")},
+		ConvMessage{ID: "wrap", Type: "question", Text: "Anything else?"},
+	)
+	originalAlbums := albums
+	t.Cleanup(func() { albums = originalAlbums })
+	path := filepath.Join(t.TempDir(), "diag.json")
+	if err := loadDiagnosis(path); err != nil {
+		t.Fatal(err)
+	}
+	// Photo 2 cannot be classified and photo 3 cannot be downloaded.
+	savePhoto = func(ctx context.Context, msg *Message) (string, error) {
+		if msg.MessageID == 3 {
+			return "", errors.New("download failed")
+		}
+		return fmt.Sprintf("/tmp/album_%d.jpg", msg.MessageID), nil
+	}
+	classifyPhoto = func(ctx context.Context, path string) (bool, string, error) {
+		if path == "/tmp/album_2.jpg" {
+			return false, "", errors.New("model unavailable")
+		}
+		return true, "white patch", nil
+	}
+	albums = newMediaGroupCollector(10 * time.Millisecond)
+	var flush func()
+	flushed := make(chan struct{})
+	albums.submit = func(chatID int64, job func()) {
+		flush = job
+		close(flushed)
+	}
+
+	chat := Chat{ID: 9}
+	captureOutput(t, func() {
+		printMessage(&Message{Chat: chat, Text: "hi"})
+		chatStateFor(9).Username = "ana"
+		for i := 1; i <= 3; i++ {
+			printMessage(&Message{MessageID: i, Chat: chat, MediaGroupID: "album", Photo: []PhotoSize{{FileID: "f"}}})
+		}
+		select {
+		case <-flushed:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("album was never flushed")
+		}
+		flush()
+	})
+
+	entries := diagnosisLog["ana"]
+	if len(entries) != 1 {
+		t.Fatalf("expected one case, got %+v", diagnosisLog)
+	}
+	want := []FailedPhoto{
+		{Photo: 2, Path: "/tmp/album_2.jpg", Error: "model unavailable"},
+		{Photo: 3, Error: errPhotoNotSaved.Error()},
+	}
+	if got := entries[0].FailedPhotos; !reflect.DeepEqual(got, want) {
+		t.Fatalf("failed photos not recorded: %+v", got)
+	}
+	if !entries[0].Verdict || !strings.Contains(entries[0].Rationale, msg("en", "verdict.album_photo_failed", 3)) {
+		t.Fatalf("unexpected case: %+v", entries[0])
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// offsetState is the durable record of which updates have been fully handled.
+type offsetState struct {
+	Offset int   `json:"offset"`         // every update below this ID has been handled
+	Done   []int `json:"done,omitempty"` // handled update IDs at or above Offset
+}
+
+// OffsetStore persists the getUpdates progress between restarts.
+type OffsetStore interface {
+	Load() (offsetState, error)
+	Save(offsetState) error
+}
+
+// fileOffsetStore keeps the offset state in a small JSON file.
+type fileOffsetStore struct {
+	path string
+}
+
+func (s fileOffsetStore) Load() (offsetState, error) {
+	var st offsetState
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return st, nil
+		}
+		return st, err
+	}
+	if len(data) == 0 {
+		return st, nil
+	}
+	err = json.Unmarshal(data, &st)
+	return st, err
+}
+
+func (s fileOffsetStore) Save(st offsetState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// redisOffsetStore keeps the offset state under a single Redis key.
+type redisOffsetStore struct {
+	client *redis.Client
+	key    string
+}
+
+func (s redisOffsetStore) Load() (offsetState, error) {
+	var st offsetState
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data, err := s.client.Get(ctx, s.key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(data, &st)
+	return st, err
+}
+
+func (s redisOffsetStore) Save(st offsetState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.client.Set(ctx, s.key, data, 0).Err()
+}
+
+// offsetStoreFromEnv builds the store selected by OFFSET_STORE ("file" or "redis").
+func offsetStoreFromEnv() (OffsetStore, error) {
+	switch kind := os.Getenv("OFFSET_STORE"); kind {
+	case "", "file":
+		path := os.Getenv("OFFSET_FILE")
+		if path == "" {
+			path = "configs/offset.json"
+		}
+		return fileOffsetStore{path: path}, nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{Addr: redisAddr()})
+		return redisOffsetStore{client: client, key: "diagnosis:telegram_offset"}, nil
+	default:
+		return nil, fmt.Errorf("unknown OFFSET_STORE %q", kind)
+	}
+}
+
+// updateTracker gives at-least-once handling of updates: an update only counts
+// as acknowledged once it has been handled, and handled IDs are remembered so a
+// replay after a restart is skipped instead of being classified twice.
+type updateTracker struct {
+	mu       sync.Mutex
+	store    OffsetStore
+	offset   int
+	inflight map[int]bool
+	done     map[int]bool
+}
+
+// newUpdateTracker restores the committed progress from store (which may be nil).
+func newUpdateTracker(store OffsetStore) (*updateTracker, error) {
+	t := &updateTracker{store: store, inflight: make(map[int]bool), done: make(map[int]bool)}
+	if store == nil {
+		return t, nil
+	}
+	st, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	t.offset = st.Offset
+	for _, id := range st.Done {
+		if id >= t.offset {
+			t.done[id] = true
+		}
+	}
+	return t, nil
+}
+
+// Offset returns the first update ID that has not been committed yet.
+func (t *updateTracker) Offset() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.offset
+}
+
+// Begin reports whether the update should be handled, returning false for
+// updates that were already handled or are being handled right now.
+func (t *updateTracker) Begin(updateID int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if updateID < t.offset || t.done[updateID] || t.inflight[updateID] {
+		return false
+	}
+	t.inflight[updateID] = true
+	return true
+}
+
+// Finish marks an update as handled and commits the new offset watermark.
+func (t *updateTracker) Finish(updateID int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.inflight, updateID)
+	t.done[updateID] = true
+
+	// The watermark may only pass IDs that are no longer in flight.
+	next := t.offset
+	for id := range t.done {
+		if id >= next {
+			next = id + 1
+		}
+	}
+	for id := range t.inflight {
+		if id < next {
+			next = id
+		}
+	}
+	t.offset = next
+
+	st := offsetState{Offset: next}
+	for id := range t.done {
+		if id < next {
+			delete(t.done, id)
+			continue
+		}
+		st.Done = append(st.Done, id)
+	}
+	sort.Ints(st.Done)
+
+	if t.store != nil {
+		if err := t.store.Save(st); err != nil {
+			log.Printf("save update offset: %v", err)
+		}
+	}
+}
+
+// updateLedger decides which updates to handle and learns when they are done:
+// updateTracker for polling, webhookUpdates for webhooks.
+type updateLedger interface {
+	Begin(updateID int) bool
+	Finish(updateID int)
+}
+
+// submitUpdate hands an update to the chat's worker queue unless it is a duplicate.
+func submitUpdate(workers *dispatcher, tracker updateLedger, u Update) {
+	if !tracker.Begin(u.UpdateID) {
+		log.Printf("skipping already handled update %d", u.UpdateID)
+		return
+	}
+	workers.Submit(updateChatID(u), func() {
+		finish := func() { tracker.Finish(u.UpdateID) }
+		if m := u.Message; m != nil {
+			m.handled = finish
+			defer func() {
+				if m.handled != nil {
+					m.handled()
+				}
+			}()
+		} else {
+			defer finish()
+		}
+		handleUpdate(u)
+	})
+}
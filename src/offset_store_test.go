@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUpdateTrackerCommitsOnlyHandledUpdates(t *testing.T) {
+	store := fileOffsetStore{path: filepath.Join(t.TempDir(), "offset.json")}
+	tracker, err := newUpdateTracker(store)
+	if err != nil {
+		t.Fatalf("newUpdateTracker: %v", err)
+	}
+
+	for _, id := range []int{10, 11, 12} {
+		if !tracker.Begin(id) {
+			t.Fatalf("expected update %d to be accepted", id)
+		}
+	}
+	// 11 and 12 finish while 10 is still being handled.
+	tracker.Finish(12)
+	tracker.Finish(11)
+	if got := tracker.Offset(); got != 10 {
+		t.Fatalf("offset committed past in-flight update: %d", got)
+	}
+
+	// Crash before 10 finishes: 10 is replayed, 11 and 12 are deduplicated.
+	restored, err := newUpdateTracker(store)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if !restored.Begin(10) {
+		t.Fatalf("unfinished update 10 should be handled again")
+	}
+	if restored.Begin(11) || restored.Begin(12) {
+		t.Fatalf("handled updates should not be replayed")
+	}
+	restored.Finish(10)
+	if got := restored.Offset(); got != 13 {
+		t.Fatalf("expected offset 13 after all handled, got %d", got)
+	}
+
+	again, err := newUpdateTracker(store)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if again.Offset() != 13 {
+		t.Fatalf("expected persisted offset 13, got %d", again.Offset())
+	}
+	if again.Begin(12) {
+		t.Fatalf("update below the committed offset accepted")
+	}
+}
+
+func TestSubmitUpdateSkipsDuplicates(t *testing.T) {
+	resetGlobals()
+	originalSend := sendReply
+	defer func() { sendReply = originalSend }()
+
+	sent := 0
+	sendReply = func(int64, string) error {
+		sent++
+		return nil
+	}
+	nodes = map[string]Node{"start": {ID: "start", Type: "start_message", Text: "hi"}}
+	startNodeID = "start"
+
+	tracker, _ := newUpdateTracker(nil)
+	workers := newDispatcher(1)
+	u := Update{UpdateID: 5, Message: &Message{Chat: Chat{ID: 1}, Text: "hello"}}
+	captureOutput(t, func() {
+		submitUpdate(workers, tracker, u)
+		workers.Wait()
+		submitUpdate(workers, tracker, u)
+		workers.Wait()
+	})
+	if sent != 1 {
+		t.Fatalf("expected the update to be handled once, got %d replies", sent)
+	}
+}
+
+func TestAlbumUpdatesCommitAfterFlush(t *testing.T) {
+	resetGlobals()
+	originalSend, originalClassifier, originalSave, originalAlbums := sendReply, classifyPhoto, savePhoto, albums
+	defer func() {
+		sendReply, classifyPhoto, savePhoto, albums = originalSend, originalClassifier, originalSave, originalAlbums
+	}()
+	sendReply = func(int64, string) error { return nil }
+	savePhoto = func(ctx context.Context, msg *Message) (string, error) { return "/tmp/album.jpg", nil }
+	classifyPhoto = func(ctx context.Context, path string) (bool, string, error) { return false, "clear", nil }
+	nodes = map[string]Node{"photo": {ID: "photo", Type: "start_message", Text: "send photos", ExpectPhoto: true}}
+	startNodeID = "photo"
+
+	tracker, _ := newUpdateTracker(nil)
+	workers := newDispatcher(1)
+	var flush func()
+	albums = newMediaGroupCollector(10 * time.Millisecond)
+	flushed := make(chan struct{})
+	albums.submit = func(chatID int64, job func()) {
+		flush = job
+		close(flushed)
+	}
+	captureOutput(t, func() {
+		submitUpdate(workers, tracker, Update{UpdateID: 1, Message: &Message{Chat: Chat{ID: 3}, Text: "hi"}})
+		for id := 2; id <= 3; id++ {
+			submitUpdate(workers, tracker, Update{UpdateID: id, Message: &Message{Chat: Chat{ID: 3}, MediaGroupID: "a", Photo: []PhotoSize{{FileID: "f"}}}})
+		}
+		workers.Wait()
+		<-flushed
+		if got := tracker.Offset(); got != 2 {
+			t.Fatalf("album photos committed before the album was classified: offset %d", got)
+		}
+		flush()
+	})
+	if got := tracker.Offset(); got != 4 {
+		t.Fatalf("expected the album committed after the flush, offset %d", got)
+	}
+}
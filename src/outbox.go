@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// apiError is a non-200 answer from the Bot API, including the flood-control hint.
+type apiError struct {
+	Method      string
+	StatusCode  int
+	Description string
+	RetryAfter  time.Duration
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s status %d: %s", e.Method, e.StatusCode, e.Description)
+}
+
+// newAPIError decodes a Telegram error body such as
+// {"ok":false,"error_code":429,"description":"...","parameters":{"retry_after":5}}.
+func newAPIError(method string, status int, body []byte) *apiError {
+	e := &apiError{Method: method, StatusCode: status, Description: string(body)}
+	var r struct {
+		Description string `json:"description"`
+		Parameters  struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+	if json.Unmarshal(body, &r) == nil {
+		if r.Description != "" {
+			e.Description = r.Description
+		}
+		e.RetryAfter = time.Duration(r.Parameters.RetryAfter) * time.Second
+	}
+	return e
+}
+
+// outboundMessage is a reply waiting to be delivered.
+type outboundMessage struct {
+	ID         int64                 `json:"id"`
+	ChatID     int64                 `json:"chat_id"`
+	Text       string                `json:"text"`
+	ParseMode  string                `json:"parse_mode,omitempty"`
+	Markup     *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+	ListButton string                `json:"list_button,omitempty"`
+	Attempts   int                   `json:"attempts"`
+	NotBefore  time.Time             `json:"not_before"`
+}
+
+// outbox delivers replies in order per chat while respecting Telegram's rate
+// limits. Pending messages are written to disk so they survive a restart.
+// Several senders work in parallel, each on a different chat, so a slow
+// delivery to one chat does not hold up the others.
+type outbox struct {
+	mu      sync.Mutex
+	path    string
+	pending []outboundMessage
+	nextID  int64
+	wake    chan struct{}
+
+	deliver        func(chatID int64, text string, opts ReplyOptions) error
+	chatInterval   time.Duration // minimum gap between messages to one chat
+	globalInterval time.Duration // minimum gap between any two messages
+	maxAttempts    int           // attempts before a failing message is dropped
+	senders        int           // messages in flight at once
+	lastChat       map[int64]time.Time
+	lastGlobal     time.Time
+	pausedUntil    time.Time // flood control applies to the whole bot
+	inFlight       map[int64]bool
+}
+
+// newOutbox restores pending messages from path (empty disables persistence).
+func newOutbox(path string, deliver func(chatID int64, text string, opts ReplyOptions) error) (*outbox, error) {
+	o := &outbox{
+		path:           path,
+		wake:           make(chan struct{}, 1),
+		deliver:        deliver,
+		chatInterval:   time.Second,
+		globalInterval: time.Second / 30,
+		maxAttempts:    8,
+		senders:        8,
+		lastChat:       make(map[int64]time.Time),
+		inFlight:       make(map[int64]bool),
+	}
+	if path == "" {
+		return o, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &o.pending); err != nil {
+			return nil, fmt.Errorf("decode outbox: %w", err)
+		}
+	}
+	for _, m := range o.pending {
+		if m.ID >= o.nextID {
+			o.nextID = m.ID + 1
+		}
+	}
+	return o, nil
+}
+
+// Send queues a plain text reply; it matches the sendReply signature.
+func (o *outbox) Send(chatID int64, text string) error {
+	return o.SendWith(chatID, text, ReplyOptions{})
+}
+
+// SendWith queues a reply with formatting options; it matches the sendReplyWith signature.
+// Once queued the message will be sent, so a failure to persist it is only
+// logged: an error would make the caller send it a second time.
+func (o *outbox) SendWith(chatID int64, text string, opts ReplyOptions) error {
+	o.mu.Lock()
+	o.pending = append(o.pending, outboundMessage{
+		ID:         o.nextID,
+		ChatID:     chatID,
+		Text:       text,
+		ParseMode:  opts.ParseMode,
+		Markup:     opts.ReplyMarkup,
+		ListButton: opts.ListButton,
+	})
+	o.nextID++
+	if err := o.persistLocked(); err != nil {
+		log.Printf("outbox: persist error: %v", err)
+	}
+	o.mu.Unlock()
+	o.notify()
+	return nil
+}
+
+// Len reports how many messages are still waiting to be delivered.
+func (o *outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+func (o *outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers queued messages until ctx is cancelled.
+func (o *outbox) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < o.senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o.sendLoop(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// sendLoop is one sender: it takes the next due message and delivers it.
+func (o *outbox) sendLoop(ctx context.Context) {
+	for {
+		msg, wait, ok := o.claim(time.Now())
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-o.wake:
+				continue
+			}
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-o.wake:
+				timer.Stop()
+				continue
+			case <-timer.C:
+				continue
+			}
+		}
+
+		// Another sender may take the next chat while this one is busy.
+		o.notify()
+		err := o.deliver(msg.ChatID, msg.Text, ReplyOptions{ParseMode: msg.ParseMode, ReplyMarkup: msg.Markup, ListButton: msg.ListButton})
+		o.complete(msg, err, time.Now())
+	}
+}
+
+// next picks the message that may be sent soonest. Only the oldest message of
+// each chat is a candidate so replies never overtake each other.
+func (o *outbox) next(now time.Time) (outboundMessage, time.Duration, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.nextLocked(now)
+}
+
+// claim is next for a sender: a message that is due is taken, and its chat
+// left to this sender until complete.
+func (o *outbox) claim(now time.Time) (outboundMessage, time.Duration, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	msg, wait, ok := o.nextLocked(now)
+	if ok && wait <= 0 {
+		o.inFlight[msg.ChatID] = true
+		o.lastGlobal = now
+	}
+	return msg, wait, ok
+}
+
+func (o *outbox) nextLocked(now time.Time) (outboundMessage, time.Duration, bool) {
+	var best outboundMessage
+	var bestAt time.Time
+	found := false
+	seen := make(map[int64]bool)
+	for _, m := range o.pending {
+		if seen[m.ChatID] {
+			continue
+		}
+		seen[m.ChatID] = true
+		if o.inFlight[m.ChatID] {
+			continue
+		}
+
+		at := m.NotBefore
+		if o.pausedUntil.After(at) {
+			at = o.pausedUntil
+		}
+		if t := o.lastChat[m.ChatID].Add(o.chatInterval); t.After(at) {
+			at = t
+		}
+		if t := o.lastGlobal.Add(o.globalInterval); t.After(at) {
+			at = t
+		}
+		if !found || at.Before(bestAt) {
+			best, bestAt, found = m, at, true
+		}
+	}
+	if !found {
+		return best, 0, false
+	}
+	return best, bestAt.Sub(now), true
+}
+
+// complete records the outcome of a delivery attempt.
+func (o *outbox) complete(msg outboundMessage, err error, now time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	defer o.notify()
+
+	delete(o.inFlight, msg.ChatID)
+	o.lastChat[msg.ChatID] = now
+
+	idx := -1
+	for i := range o.pending {
+		if o.pending[i].ID == msg.ID {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return
+	}
+
+	drop := err == nil
+	if err != nil {
+		m := &o.pending[idx]
+		var apiErr *apiError
+		switch {
+		case errors.As(err, &apiErr) && apiErr.RetryAfter > 0:
+			// Flood control: the limit is the bot's, so every chat waits as long
+			// as Telegram asks, without using up an attempt.
+			m.NotBefore = now.Add(apiErr.RetryAfter)
+			if m.NotBefore.After(o.pausedUntil) {
+				o.pausedUntil = m.NotBefore
+			}
+			log.Printf("outbox: rate limited on chat %d, pausing all sends for %s", msg.ChatID, apiErr.RetryAfter)
+		case errors.As(err, &apiErr) && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 && apiErr.StatusCode != http.StatusTooManyRequests:
+			log.Printf("outbox: dropping message to chat %d: %v", msg.ChatID, err)
+			drop = true
+		default:
+			m.Attempts++
+			if m.Attempts >= o.maxAttempts {
+				log.Printf("outbox: giving up on message to chat %d after %d attempts: %v", msg.ChatID, m.Attempts, err)
+				drop = true
+			} else {
+				backoff := time.Second << uint(m.Attempts-1)
+				if backoff > 5*time.Minute {
+					backoff = 5 * time.Minute
+				}
+				m.NotBefore = now.Add(backoff)
+				log.Printf("outbox: send to chat %d failed (attempt %d), retrying in %s: %v", msg.ChatID, m.Attempts, backoff, err)
+			}
+		}
+	}
+	if drop {
+		o.pending = append(o.pending[:idx], o.pending[idx+1:]...)
+	}
+	if perr := o.persistLocked(); perr != nil {
+		log.Printf("outbox: persist error: %v", perr)
+	}
+}
+
+func (o *outbox) persistLocked() error {
+	if o.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(o.pending, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(o.path, data, 0600)
+}
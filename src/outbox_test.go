@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendMessageReportsRetryAfter(t *testing.T) {
+	originalBase, originalClient := apiBase, httpClient
+	defer func() { apiBase, httpClient = originalBase, originalClient }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 3","parameters":{"retry_after":3}}`))
+	}))
+	defer server.Close()
+	apiBase = server.URL + "/botTOKEN/"
+	httpClient = server.Client()
+
+	err := sendMessage(1, "hi")
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected apiError, got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusTooManyRequests || apiErr.RetryAfter != 3*time.Second {
+		t.Fatalf("unexpected api error: %#v", apiErr)
+	}
+}
+
+func TestOutboxRetriesAfterFloodControl(t *testing.T) {
+	var mu sync.Mutex
+	var delivered []string
+	var attempts []time.Time
+	calls := 0
+	deliver := func(chatID int64, text string, opts ReplyOptions) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		attempts = append(attempts, time.Now())
+		switch calls {
+		case 1:
+			return &apiError{Method: "sendMessage", StatusCode: 429, RetryAfter: 80 * time.Millisecond}
+		case 2:
+			return errors.New("connection reset")
+		}
+		delivered = append(delivered, text)
+		return nil
+	}
+
+	o, err := newOutbox("", deliver)
+	if err != nil {
+		t.Fatalf("newOutbox: %v", err)
+	}
+	o.chatInterval = 0
+	o.globalInterval = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.Run(ctx)
+
+	_ = o.Send(1, "diagnosis")
+	_ = o.Send(1, "next question")
+
+	deadline := time.After(5 * time.Second)
+	for o.Len() > 0 {
+		select {
+		case <-deadline:
+			t.Fatalf("outbox did not drain, %d pending", o.Len())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(delivered) != 2 || delivered[0] != "diagnosis" || delivered[1] != "next question" {
+		t.Fatalf("messages delivered out of order or lost: %v", delivered)
+	}
+	if gap := attempts[1].Sub(attempts[0]); gap < 80*time.Millisecond {
+		t.Fatalf("retry_after not respected, retried after %s", gap)
+	}
+}
+
+func TestOutboxPersistsPendingMessages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.json")
+	o, err := newOutbox(path, nil)
+	if err != nil {
+		t.Fatalf("newOutbox: %v", err)
+	}
+	if err := o.SendWith(9, "pick one", ReplyOptions{ReplyMarkup: &InlineKeyboardMarkup{}}); err != nil {
+		t.Fatalf("SendWith: %v", err)
+	}
+
+	restored, err := newOutbox(path, nil)
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	msg, _, ok := restored.next(time.Now())
+	if !ok || msg.ChatID != 9 || msg.Text != "pick one" || msg.Markup == nil {
+		t.Fatalf("pending message not restored: %#v", msg)
+	}
+}
+
+func TestOutboxSlowChatDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	delivered := make(chan int64, 2)
+	deliver := func(chatID int64, text string, opts ReplyOptions) error {
+		if chatID == 1 {
+			<-release
+		}
+		delivered <- chatID
+		return nil
+	}
+	o, err := newOutbox("", deliver)
+	if err != nil {
+		t.Fatalf("newOutbox: %v", err)
+	}
+	o.chatInterval, o.globalInterval, o.senders = 0, 0, 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.Run(ctx)
+	defer close(release)
+
+	_ = o.Send(1, "slow")
+	_ = o.Send(2, "fast")
+	select {
+	case chatID := <-delivered:
+		if chatID != 2 {
+			t.Fatalf("expected chat 2 delivered first, got chat %d", chatID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("chat 2 waited for the slow send to chat 1")
+	}
+}
+
+func TestOutboxFloodControlPausesEveryChat(t *testing.T) {
+	var mu sync.Mutex
+	sent := make(map[int64]time.Time)
+	limited := false
+	deliver := func(chatID int64, text string, opts ReplyOptions) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !limited {
+			limited = true
+			return &apiError{Method: "sendMessage", StatusCode: 429, RetryAfter: 80 * time.Millisecond}
+		}
+		sent[chatID] = time.Now()
+		return nil
+	}
+	o, err := newOutbox("", deliver)
+	if err != nil {
+		t.Fatalf("newOutbox: %v", err)
+	}
+	o.chatInterval, o.globalInterval, o.senders = 0, 0, 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	_ = o.Send(1, "limited")
+	_ = o.Send(2, "other chat")
+	go o.Run(ctx)
+
+	deadline := time.After(5 * time.Second)
+	for o.Len() > 0 {
+		select {
+		case <-deadline:
+			t.Fatalf("outbox did not drain, %d pending", o.Len())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if gap := sent[2].Sub(start); gap < 80*time.Millisecond {
+		t.Fatalf("chat 2 was sent during the flood-control pause, after %s", gap)
+	}
+}
+
+func TestOutboxQueuedMessageIsNotReportedAsFailed(t *testing.T) {
+	// The outbox directory does not exist, so every persist fails.
+	o, err := newOutbox(filepath.Join(t.TempDir(), "missing", "outbox.json"), nil)
+	if err != nil {
+		t.Fatalf("newOutbox: %v", err)
+	}
+	if err := o.Send(9, "hello"); err != nil {
+		t.Fatalf("a queued message must not be reported as failed: %v", err)
+	}
+	if o.Len() != 1 {
+		t.Fatalf("expected the message queued, %d pending", o.Len())
+	}
+}
@@ -16,13 +16,18 @@ var (
 	queueName     string
 )
 
+// redisAddr returns the Redis address from REDIS_ADDR, defaulting to localhost.
+func redisAddr() string {
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		return addr
+	}
+	return "localhost:6379"
+}
+
 // initQueue configures the Redis client used to push chat notifications.
 func initQueue() {
 	queueInitOnce.Do(func() {
-		addr := os.Getenv("REDIS_ADDR")
-		if addr == "" {
-			addr = "localhost:6379"
-		}
+		addr := redisAddr()
 		queueName = os.Getenv("CHAT_EVENT_QUEUE")
 		if queueName == "" {
 			queueName = "diagnosis:chat_events"
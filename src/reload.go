@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// configReloader swaps in new conversation and auth files while the bot runs.
+// Reloads are triggered by SIGHUP and, when an interval is set, by polling the
+// files for changes.
+type configReloader struct {
+	conversationPath string
+	authPath         string
+	onReload         func() // runs after a successful swap, may be nil
+	strict           bool   // reject a conversation with any validation issue, as CONVERSATION_STRICT does at startup
+
+	mu      sync.Mutex // serializes reloads
+	stamps  map[string]fileStamp
+	signals chan os.Signal
+}
+
+// fileStamp identifies one version of a watched file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+	files   int
+}
+
+func newConfigReloader(conversationPath, authPath string) *configReloader {
+	r := &configReloader{
+		conversationPath: conversationPath,
+		authPath:         authPath,
+		stamps:           make(map[string]fileStamp),
+	}
+	r.changed() // remember the versions loaded at startup
+	return r
+}
+
+// Reload validates both files and installs them together. A file that fails
+// to parse, or in strict mode to validate, leaves the running configuration
+// untouched; otherwise validation issues are logged as they are at startup.
+func (r *configReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cf, err := readConversation(r.conversationPath)
+	if err == nil {
+		err = checkRunnable(cf)
+	}
+	if err != nil {
+		return fmt.Errorf("conversation: %w", err)
+	}
+	issues := validateConversation(cf)
+	if r.strict && len(issues) > 0 {
+		return fmt.Errorf("conversation: %d problem(s): %s", len(issues), strings.Join(issues, "; "))
+	}
+	users, roles, err := readAuth(r.authPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("auth: %w", err)
+	}
+	for _, issue := range issues {
+		log.Printf("conversation.json: %s", issue)
+	}
+	g := buildConversation(cf)
+
+	configMu.Lock()
+	g.install()
+	if users != nil {
+		authUsers, authRoles = users, roles
+	}
+	configMu.Unlock()
+
+	log.Printf("configuration reloaded: %d nodes, start node %s", len(g.nodes), g.start)
+	if r.onReload != nil {
+		r.onReload()
+	}
+	return nil
+}
+
+// Run reloads on SIGHUP, and every interval when a file changed, until ctx ends.
+func (r *configReloader) Run(ctx context.Context, interval time.Duration) {
+	sig := r.signals
+	if sig == nil {
+		sig = make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGHUP)
+		defer signal.Stop(sig)
+	}
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			r.changed()
+		case <-tick:
+			if !r.changed() {
+				continue
+			}
+		}
+		if err := r.Reload(); err != nil {
+			log.Printf("configuration reload rejected, keeping the running config: %v", err)
+		}
+	}
+}
+
+// changed records the current version of the watched files and reports whether
+// any differs from the last one seen.
+func (r *configReloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	diff := false
+	for _, path := range []string{r.conversationPath, r.authPath} {
+		stamp := statConfig(path)
+		if old, ok := r.stamps[path]; ok && old != stamp {
+			diff = true
+		}
+		r.stamps[path] = stamp
+	}
+	return diff
+}
+
+// statConfig stamps a config file; for a directory of flow files it combines
+// the newest modification time with the total size and file count.
+func statConfig(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	if !info.IsDir() {
+		return fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	stamp := fileStamp{modTime: info.ModTime()}
+	files, _ := filepath.Glob(filepath.Join(path, "*.json"))
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			if fi.ModTime().After(stamp.modTime) {
+				stamp.modTime = fi.ModTime()
+			}
+			stamp.size += fi.Size()
+			stamp.files++
+		}
+	}
+	return stamp
+}
+
+// configWatchIntervalFromEnv reads CONFIG_WATCH_INTERVAL; zero disables polling.
+func configWatchIntervalFromEnv() time.Duration {
+	v := os.Getenv("CONFIG_WATCH_INTERVAL")
+	if v == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("invalid CONFIG_WATCH_INTERVAL %q, file watching disabled", v)
+		return 0
+	}
+	return d
+}
+
+// currentFallbackNode returns where chats on a removed node resume: the
+// conversation's fallback_node when it exists, otherwise the start node.
+func currentFallbackNode() string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	if _, ok := nodes[fallbackNodeID]; ok {
+		return fallbackNodeID
+	}
+	return startNodeID
+}
+
+// relocateChat moves a chat whose awaiting node disappeared in a reload to the fallback node.
+func relocateChat(chatID int64, st *ChatState) {
+	target := currentFallbackNode()
+	log.Printf("chat %d was waiting on removed node %q, moving it to %q", chatID, st.Awaiting, target)
+	st.Awaiting = ""
+	replyOrLog(chatID, msg(chatLocale(st), "conversation.updated"))
+	if target == "" {
+		saveChatState(chatID)
+		return
+	}
+	advanceChatState(chatID, target)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const reloadConvV1 = `{"messages":[
+{"id":"start","type":"start_message","text":"hi","success_transition":"name"},
+{"id":"name","type":"question","text":"Your name?","success_transition":"end","fail_transition":"name"},
+{"id":"end","type":"end_message","text":"bye"}]}`
+
+const reloadConvV2 = `{"fallback_node":"intro","messages":[
+{"id":"start","type":"start_message","text":"hello again","success_transition":"intro"},
+{"id":"intro","type":"question","text":"What brings you here?","success_transition":"end","fail_transition":"intro"},
+{"id":"end","type":"end_message","text":"bye"}]}`
+
+func writeReloadFiles(t *testing.T, dir, conv, auth string) (string, string) {
+	t.Helper()
+	convPath := filepath.Join(dir, "conversation.json")
+	authPath := filepath.Join(dir, "auth.json")
+	if err := os.WriteFile(convPath, []byte(conv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(authPath, []byte(auth), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return convPath, authPath
+}
+
+func TestConfigReloaderSwapsAndRejects(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	dir := t.TempDir()
+	convPath, authPath := writeReloadFiles(t, dir, reloadConvV1, `{"users":[{"username":"ana","password":"1"}]}`)
+	if err := loadConversation(convPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadAuth(authPath); err != nil {
+		t.Fatal(err)
+	}
+	r := newConfigReloader(convPath, authPath)
+	r.strict = true
+
+	writeReloadFiles(t, dir, reloadConvV2, `{"users":[{"username":"bia","password":"2"}]}`)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if n, ok := lookupNode("start"); !ok || n.Text != "hello again" {
+		t.Fatalf("expected new node text, got %+v", n)
+	}
+	if _, ok := lookupNode("name"); ok {
+		t.Fatalf("removed node still present")
+	}
+	if userExists("ana") || !verifyPassword("bia", "2") {
+		t.Fatalf("auth users were not swapped")
+	}
+
+	// In strict mode a graph with a dangling transition is rejected and nothing changes.
+	writeReloadFiles(t, dir, `{"messages":[{"id":"start","type":"start_message","text":"broken","success_transition":"nowhere"}]}`, `{"users":[{"username":"caio","password":"3"}]}`)
+	if err := r.Reload(); err == nil || !strings.Contains(err.Error(), "nowhere") {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	if n, _ := lookupNode("start"); n.Text != "hello again" || userExists("caio") {
+		t.Fatalf("rejected reload changed the running config")
+	}
+
+	// An unreadable auth file rejects the conversation change too.
+	writeReloadFiles(t, dir, reloadConvV1, `{"users":`)
+	if err := r.Reload(); err == nil {
+		t.Fatalf("expected auth decode error")
+	}
+	if _, ok := lookupNode("name"); ok || !userExists("bia") {
+		t.Fatalf("partial reload was applied")
+	}
+}
+
+func TestNonStrictReloadAcceptsWhatStartupAccepts(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	dir := t.TempDir()
+	convPath, authPath := writeReloadFiles(t, dir, reloadConvV1, `{"users":[]}`)
+	if err := loadConversation(convPath); err != nil {
+		t.Fatal(err)
+	}
+	// An unreachable node is reported but does not stop a non-strict startup.
+	writeReloadFiles(t, dir, `{"messages":[
+{"id":"start","type":"start_message","text":"hello again","success_transition":"end"},
+{"id":"orphan","type":"question","text":"?","success_transition":"end","fail_transition":"orphan"},
+{"id":"end","type":"end_message","text":"bye"}]}`, `{"users":[]}`)
+	if err := newConfigReloader(convPath, authPath).Reload(); err != nil {
+		t.Fatalf("non-strict reload rejected: %v", err)
+	}
+	if n, _ := lookupNode("start"); n.Text != "hello again" {
+		t.Fatalf("expected the new graph, got %+v", n)
+	}
+}
+
+func TestLoopWithoutInputIsNeverLoaded(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	dir := t.TempDir()
+	convPath, authPath := writeReloadFiles(t, dir, reloadConvV1, `{"users":[]}`)
+	if err := loadConversation(convPath); err != nil {
+		t.Fatal(err)
+	}
+	looping := `{"messages":[
+{"id":"start","type":"start_message","text":"hello again","success_transition":"route"},
+{"id":"route","type":"branch","branches":[{"when":"x == \"1\"","transition":"end"}],"success_transition":"again"},
+{"id":"again","type":"branch","success_transition":"route"},
+{"id":"end","type":"end_message","text":"bye"}]}`
+	writeReloadFiles(t, dir, looping, `{"users":[]}`)
+	err := newConfigReloader(convPath, authPath).Reload()
+	if err == nil || !strings.Contains(err.Error(), "route -> again -> route loop without waiting for input") {
+		t.Fatalf("non-strict reload accepted a loop: %v", err)
+	}
+	if n, _ := lookupNode("start"); n.Text != "hi" {
+		t.Fatalf("expected the running graph kept, got %+v", n)
+	}
+	if err := loadConversation(convPath); err == nil {
+		t.Fatal("loadConversation accepted a loop")
+	}
+}
+
+func TestChatOnRemovedNodeMovesToFallback(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	originalSend := sendReply
+	defer func() { sendReply = originalSend }()
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+
+	dir := t.TempDir()
+	convPath, authPath := writeReloadFiles(t, dir, reloadConvV1, `{"users":[]}`)
+	if err := loadConversation(convPath); err != nil {
+		t.Fatal(err)
+	}
+	chat := Chat{ID: 9}
+	captureOutput(t, func() { printMessage(&Message{Chat: chat, Text: "hi"}) })
+	if chatStateFor(9).Awaiting != "name" {
+		t.Fatalf("expected chat to wait on name")
+	}
+
+	writeReloadFiles(t, dir, reloadConvV2, `{"users":[]}`)
+	if err := newConfigReloader(convPath, authPath).Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	sent = nil
+	captureOutput(t, func() { printMessage(&Message{Chat: chat, Text: "Ana"}) })
+	st := chatStateFor(9)
+	if st.Awaiting != "intro" {
+		t.Fatalf("expected chat to resume at the fallback node, got %q", st.Awaiting)
+	}
+	if _, ok := st.Answers["name"]; ok {
+		t.Fatalf("message was stored as an answer to the removed node")
+	}
+	if len(sent) != 2 || !strings.Contains(sent[0], "updated") || sent[1] != "What brings you here?" {
+		t.Fatalf("unexpected replies %q", sent)
+	}
+}
+
+func TestCallbackOnRemovedNodeMovesToFallback(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	originalSend, originalAnswer := sendReply, answerCallback
+	defer func() { sendReply, answerCallback = originalSend, originalAnswer }()
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+	answerCallback = func(string, string) error { return nil }
+
+	dir := t.TempDir()
+	convPath, authPath := writeReloadFiles(t, dir, reloadConvV1, `{"users":[]}`)
+	if err := loadConversation(convPath); err != nil {
+		t.Fatal(err)
+	}
+	captureOutput(t, func() { printMessage(&Message{Chat: Chat{ID: 10}, Text: "hi"}) })
+	writeReloadFiles(t, dir, reloadConvV2, `{"users":[]}`)
+	if err := newConfigReloader(convPath, authPath).Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	sent = nil
+	captureOutput(t, func() {
+		handleCallbackQuery(&CallbackQuery{ID: "1", Message: &Message{Chat: Chat{ID: 10}}, Data: "choice:name:0"})
+	})
+	if st := chatStateFor(10); st.Awaiting != "intro" || len(sent) != 2 || sent[1] != "What brings you here?" {
+		t.Fatalf("expected the chat moved to the fallback node, got %q / %q", st.Awaiting, sent)
+	}
+}
+
+func TestConfigReloaderRunReloadsOnSignalAndChange(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+	dir := t.TempDir()
+	convPath, authPath := writeReloadFiles(t, dir, reloadConvV1, `{"users":[]}`)
+	if err := loadConversation(convPath); err != nil {
+		t.Fatal(err)
+	}
+	r := newConfigReloader(convPath, authPath)
+	r.signals = make(chan os.Signal, 1)
+	reloads := make(chan struct{}, 4)
+	r.onReload = func() { reloads <- struct{}{} }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx, 20*time.Millisecond)
+
+	wait := func(what string) {
+		t.Helper()
+		select {
+		case <-reloads:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no reload after %s", what)
+		}
+	}
+
+	r.signals <- syscall.SIGHUP
+	wait("SIGHUP")
+
+	writeReloadFiles(t, dir, reloadConvV2, `{"users":[]}`)
+	wait("file change")
+	if n, _ := lookupNode("start"); n.Text != "hello again" {
+		t.Fatalf("expected watched change to be applied, got %q", n.Text)
+	}
+
+	select {
+	case <-reloads:
+		t.Fatalf("reloaded without a change")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
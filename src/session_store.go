@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SessionStore persists chat states so conversations survive restarts.
+// Load returns a nil state when the chat has no session or it has expired;
+// List returns every session that has not expired.
+type SessionStore interface {
+	Load(chatID int64) (*ChatState, error)
+	Save(chatID int64, st *ChatState) error
+	Delete(chatID int64) error
+	List() (map[int64]*ChatState, error)
+}
+
+// redisSessionPrefix namespaces the session keys in Redis.
+const redisSessionPrefix = "diagnosis:session:"
+
+// sessionExpired reports whether a state has been idle for longer than ttl.
+func sessionExpired(st *ChatState, ttl time.Duration, now time.Time) bool {
+	if ttl <= 0 || st.UpdatedAt.IsZero() {
+		return false
+	}
+	return now.Sub(st.UpdatedAt) > ttl
+}
+
+// fileSessionStore keeps every session in a single JSON file keyed by chat ID.
+type fileSessionStore struct {
+	mu       sync.Mutex
+	path     string
+	ttl      time.Duration
+	sessions map[int64]json.RawMessage
+}
+
+// newFileSessionStore opens (or creates) the session file at path, dropping expired entries.
+func newFileSessionStore(path string, ttl time.Duration) (*fileSessionStore, error) {
+	s := &fileSessionStore{path: path, ttl: ttl, sessions: make(map[int64]json.RawMessage)}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.sessions); err != nil {
+			return nil, fmt.Errorf("decode sessions: %w", err)
+		}
+	}
+	now := time.Now()
+	for chatID, raw := range s.sessions {
+		var st ChatState
+		if err := json.Unmarshal(raw, &st); err != nil || sessionExpired(&st, ttl, now) {
+			delete(s.sessions, chatID)
+		}
+	}
+	return s, nil
+}
+
+func (s *fileSessionStore) Load(chatID int64) (*ChatState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	raw, ok := s.sessions[chatID]
+	if !ok {
+		return nil, nil
+	}
+	var st ChatState
+	if err := json.Unmarshal(raw, &st); err != nil {
+		return nil, err
+	}
+	if sessionExpired(&st, s.ttl, time.Now()) {
+		delete(s.sessions, chatID)
+		return nil, s.persistLocked()
+	}
+	return &st, nil
+}
+
+func (s *fileSessionStore) Save(chatID int64, st *ChatState) error {
+	raw, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[chatID] = raw
+	return s.persistLocked()
+}
+
+func (s *fileSessionStore) Delete(chatID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[chatID]; !ok {
+		return nil
+	}
+	delete(s.sessions, chatID)
+	return s.persistLocked()
+}
+
+func (s *fileSessionStore) List() (map[int64]*ChatState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	all := make(map[int64]*ChatState, len(s.sessions))
+	for chatID, raw := range s.sessions {
+		var st ChatState
+		if err := json.Unmarshal(raw, &st); err != nil {
+			return nil, fmt.Errorf("session %d: %w", chatID, err)
+		}
+		if !sessionExpired(&st, s.ttl, now) {
+			all[chatID] = &st
+		}
+	}
+	return all, nil
+}
+
+// persistLocked rewrites the session file through a temporary file so a crash
+// mid-write never leaves a truncated file behind.
+func (s *fileSessionStore) persistLocked() error {
+	data, err := json.MarshalIndent(s.sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// redisSessionStore keeps each session under its own key with an idle TTL.
+type redisSessionStore struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+// newRedisSessionStore builds a Redis-backed store; ttl <= 0 keeps sessions forever.
+func newRedisSessionStore(client *redis.Client, prefix string, ttl time.Duration) *redisSessionStore {
+	return &redisSessionStore{client: client, prefix: prefix, ttl: ttl}
+}
+
+func (s *redisSessionStore) key(chatID int64) string {
+	return s.prefix + strconv.FormatInt(chatID, 10)
+}
+
+func (s *redisSessionStore) Load(chatID int64) (*ChatState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data, err := s.client.Get(ctx, s.key(chatID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st ChatState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (s *redisSessionStore) Save(chatID int64, st *ChatState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.client.Set(ctx, s.key(chatID), data, s.ttl).Err()
+}
+
+func (s *redisSessionStore) Delete(chatID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.client.Del(ctx, s.key(chatID)).Err()
+}
+
+func (s *redisSessionStore) List() (map[int64]*ChatState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	all := make(map[int64]*ChatState)
+	iter := s.client.Scan(ctx, 0, s.prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		chatID, err := strconv.ParseInt(iter.Val()[len(s.prefix):], 10, 64)
+		if err != nil {
+			continue // not a session key
+		}
+		data, err := s.client.Get(ctx, iter.Val()).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue // expired since the scan
+		}
+		if err != nil {
+			return nil, err
+		}
+		var st ChatState
+		if err := json.Unmarshal(data, &st); err != nil {
+			return nil, fmt.Errorf("session %d: %w", chatID, err)
+		}
+		all[chatID] = &st
+	}
+	return all, iter.Err()
+}
+
+// sessionTTLFromEnv reads SESSION_TTL, how long an idle session is kept (default 24h).
+func sessionTTLFromEnv() (time.Duration, error) {
+	v := os.Getenv("SESSION_TTL")
+	if v == "" {
+		return 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid SESSION_TTL %q: %w", v, err)
+	}
+	return d, nil
+}
+
+// sessionStoreFromEnv builds the store selected by SESSION_STORE ("file", "redis" or "memory").
+func sessionStoreFromEnv() (SessionStore, time.Duration, error) {
+	ttl, err := sessionTTLFromEnv()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch kind := os.Getenv("SESSION_STORE"); kind {
+	case "", "file":
+		path := os.Getenv("SESSION_FILE")
+		if path == "" {
+			path = "configs/sessions.json"
+		}
+		store, err := newFileSessionStore(path, ttl)
+		if err != nil {
+			return nil, 0, err
+		}
+		return store, ttl, nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{Addr: redisAddr()})
+		return newRedisSessionStore(client, redisSessionPrefix, ttl), ttl, nil
+	case "memory":
+		return nil, ttl, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown SESSION_STORE %q", kind)
+	}
+}
+
+// saveChatState writes a chat's current state through to the session store.
+func saveChatState(chatID int64) {
+	if sessionStore == nil {
+		return
+	}
+	st := chatStateFor(chatID)
+	st.UpdatedAt = time.Now().UTC()
+	if err := sessionStore.Save(chatID, st); err != nil {
+		log.Printf("save session for chat %d: %v", chatID, err)
+	}
+}
+
+// writeFileAtomic replaces path with data by writing a sibling temp file and renaming it.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
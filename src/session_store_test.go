@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestFileSessionStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	store, err := newFileSessionStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("newFileSessionStore: %v", err)
+	}
+	st := &ChatState{Awaiting: "login_password", Username: "patient1", Started: true, Answers: map[string]string{"age": "42"}, UpdatedAt: time.Now()}
+	if err := store.Save(7, st); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	reopened, err := newFileSessionStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	got, err := reopened.Load(7)
+	if err != nil || got == nil {
+		t.Fatalf("Load returned %v, %v", got, err)
+	}
+	if got.Awaiting != "login_password" || got.Username != "patient1" || got.Answers["age"] != "42" {
+		t.Fatalf("unexpected restored state: %#v", got)
+	}
+
+	if err := reopened.Delete(7); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if got, _ := reopened.Load(7); got != nil {
+		t.Fatalf("expected session to be deleted, got %#v", got)
+	}
+}
+
+func TestFileSessionStoreDropsIdleSessions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	store, err := newFileSessionStore(path, time.Minute)
+	if err != nil {
+		t.Fatalf("newFileSessionStore: %v", err)
+	}
+	if err := store.Save(1, &ChatState{Awaiting: "q", UpdatedAt: time.Now().Add(-2 * time.Minute)}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if got, _ := store.Load(1); got != nil {
+		t.Fatalf("expected idle session to expire, got %#v", got)
+	}
+}
+
+func TestChatStateResumesFromStore(t *testing.T) {
+	resetGlobals()
+	defer resetGlobals()
+
+	originalSend := sendReply
+	defer func() { sendReply = originalSend }()
+	sendReply = func(int64, string) error { return nil }
+
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	store, err := newFileSessionStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("newFileSessionStore: %v", err)
+	}
+	sessionStore = store
+	nodes = map[string]Node{
+		"start": {ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("age")},
+		"age":   {ID: "age", Type: "question", Text: "age?"},
+	}
+	startNodeID = "start"
+
+	captureOutput(t, func() {
+		printMessage(&Message{Chat: Chat{ID: 11}, Text: "hello"})
+	})
+
+	// Simulate a restart: memory is wiped, the store survives.
+	states = make(map[int64]*ChatState)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("session file not written: %v", err)
+	}
+	sessionStore, err = newFileSessionStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	st := chatStateFor(11)
+	if !st.Started || st.Awaiting != "age" {
+		t.Fatalf("expected resumed state awaiting age, got %#v", st)
+	}
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	addr := os.Getenv("TEST_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("TEST_REDIS_ADDR not set")
+	}
+	store := newRedisSessionStore(redis.NewClient(&redis.Options{Addr: addr}), "test:session:", time.Minute)
+	if err := store.Save(3, &ChatState{Awaiting: "q"}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	defer store.Delete(3)
+	got, err := store.Load(3)
+	if err != nil || got == nil || got.Awaiting != "q" {
+		t.Fatalf("Load returned %#v, %v", got, err)
+	}
+	all, err := store.List()
+	if err != nil || all[3] == nil || all[3].Awaiting != "q" {
+		t.Fatalf("List returned %#v, %v", all, err)
+	}
+}
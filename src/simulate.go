@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// simulatorChatID is the chat every simulated message comes from.
+const simulatorChatID = 1
+
+// simulator drives the conversation engine in-process, capturing what the
+// bot would send instead of calling Telegram.
+type simulator struct {
+	replies  []string               // replies sent since the last input
+	buttons  []InlineKeyboardButton // buttons of the last keyboard sent
+	keyboard bool                   // a keyboard was sent since the last input
+	verdicts map[string]bool        // scripted classifier answers by photo path
+	nextID   int
+	user     User
+}
+
+// runSimulate implements the "simulate" subcommand and returns the exit code.
+func runSimulate(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	authPath := fs.String("auth", "configs/auth.json", "auth file with the users that can sign in")
+	classifier := fs.String("classifier", "scripted", "photo classifier: scripted or gemini")
+	script := fs.String("script", "", "replay a session file and check its expected replies instead of reading stdin")
+	lang := fs.String("lang", "", "Telegram language_code of the simulated user")
+	verbose := fs.Bool("v", false, "show the engine's logs")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: telbot simulate [-auth auth.json] [-classifier scripted|gemini] [-script session.txt] [conversation.json]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+	path := conversationPathFromEnv()
+	if fs.NArg() == 1 {
+		path = fs.Arg(0)
+	}
+
+	if !*verbose {
+		// The engine narrates every step on stdout and the log; keep only the replies.
+		devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err == nil {
+			originalStdout := os.Stdout
+			os.Stdout = devnull
+			log.SetOutput(devnull)
+			defer func() {
+				os.Stdout = originalStdout
+				log.SetOutput(os.Stderr)
+				devnull.Close()
+			}()
+		}
+	}
+
+	if err := loadConversation(path); err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", path, err)
+		return 1
+	}
+	if err := loadAuth(*authPath); err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(stderr, "%s: %v\n", *authPath, err)
+		return 1
+	}
+	if states == nil {
+		states = make(map[int64]*ChatState)
+	}
+
+	sim := &simulator{verdicts: make(map[string]bool), user: User{ID: simulatorChatID, FirstName: "Simulator", LanguageCode: *lang}}
+	sendReply = sim.sendReply
+	sendReplyWith = sim.sendReplyWith
+	answerCallback = func(string, string) error { return nil }
+	savePhoto = sim.savePhoto
+	switch *classifier {
+	case "scripted":
+		classifyPhoto = sim.classify
+	case "gemini":
+		classifyPhoto = classifyWithGemini
+	default:
+		fmt.Fprintf(stderr, "unknown classifier %q (use scripted or gemini)\n", *classifier)
+		return 2
+	}
+
+	if *script != "" {
+		f, err := os.Open(*script)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer f.Close()
+		return sim.replay(f, *script, stdout)
+	}
+	return sim.repl(stdin, stdout)
+}
+
+func (s *simulator) sendReply(chatID int64, text string) error {
+	s.replies = append(s.replies, text)
+	return nil
+}
+
+func (s *simulator) sendReplyWith(chatID int64, text string, opts ReplyOptions) error {
+	s.replies = append(s.replies, text)
+	if opts.ReplyMarkup != nil {
+		s.buttons, s.keyboard = nil, true
+		for _, row := range opts.ReplyMarkup.InlineKeyboard {
+			s.buttons = append(s.buttons, row...)
+		}
+	}
+	return nil
+}
+
+// savePhoto "downloads" a simulated photo, whose FileID is its local path.
+func (s *simulator) savePhoto(ctx context.Context, m *Message) (string, error) {
+	if len(m.Photo) == 0 {
+		return "", fmt.Errorf("no photo in message")
+	}
+	return m.Photo[len(m.Photo)-1].FileID, nil
+}
+
+// classify answers with the verdict given in ":photo <path> positive|negative".
+func (s *simulator) classify(ctx context.Context, path string) (bool, string, error) {
+	positive := s.verdicts[path]
+	return positive, fmt.Sprintf("scripted verdict for %s", path), nil
+}
+
+// send feeds one line of input to the engine and returns the bot's replies.
+// Lines starting with ":" are simulator commands; everything else is typed text.
+func (s *simulator) send(line string) ([]string, error) {
+	s.replies, s.keyboard = nil, false
+	s.nextID++
+	m := &Message{MessageID: s.nextID, From: &s.user, Chat: Chat{ID: simulatorChatID, Type: "private"}}
+
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) > 0 && fields[0] == ":photo":
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("usage: :photo <path> [positive|negative]")
+		}
+		s.verdicts[fields[1]] = len(fields) == 3 && fields[2] == "positive"
+		m.Photo = []PhotoSize{{FileID: fields[1]}}
+		printMessage(m)
+	case len(fields) > 0 && fields[0] == ":tap":
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("usage: :tap <button number>")
+		}
+		i, err := strconv.Atoi(fields[1])
+		if err != nil || i < 1 || i > len(s.buttons) {
+			return nil, fmt.Errorf("no button %s (the last keyboard has %d)", fields[1], len(s.buttons))
+		}
+		handleCallbackQuery(&CallbackQuery{ID: strconv.Itoa(s.nextID), From: &s.user, Message: m, Data: s.buttons[i-1].CallbackData})
+	case strings.HasPrefix(line, ":"):
+		return nil, fmt.Errorf("unknown simulator command %s (try :photo, :tap or :quit)", fields[0])
+	default:
+		m.Text = line
+		printMessage(m)
+	}
+	return s.replies, nil
+}
+
+// repl reads input lines until EOF or ":quit", printing every reply.
+func (s *simulator) repl(stdin io.Reader, stdout io.Writer) int {
+	fmt.Fprintln(stdout, "Type a message, \":photo <path> [positive|negative]\", \":tap <n>\" to press a button, or \":quit\".")
+	scanner := bufio.NewScanner(stdin)
+	for {
+		fmt.Fprint(stdout, "you> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(stdout)
+			return 0
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == ":quit" {
+			return 0
+		}
+		replies, err := s.send(line)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			continue
+		}
+		s.printReplies(stdout, replies)
+	}
+}
+
+func (s *simulator) printReplies(w io.Writer, replies []string) {
+	for _, r := range replies {
+		fmt.Fprintf(w, "bot> %s\n", strings.ReplaceAll(r, "\n", "\n     "))
+	}
+	if !s.keyboard {
+		return
+	}
+	for i, b := range s.buttons {
+		fmt.Fprintf(w, "     [%d] %s\n", i+1, b.Text)
+	}
+}
+
+// replay runs a session file and checks the bot's replies against it.
+// Lines starting with "> " are input, lines starting with "< " must be
+// contained in the next reply to that input, in order; "#" starts a comment.
+// Every reply must be checked: one left over fails the replay.
+func (s *simulator) replay(r io.Reader, name string, stdout io.Writer) int {
+	scanner := bufio.NewScanner(r)
+	var replies []string
+	// Failed checks, replies no check expected and bad input lines are
+	// counted apart so the summary never reports more failed checks than checks.
+	inputs, checks, failed, unexpected, errs := 0, 0, 0, 0, 0
+	lineNo := 0
+	report := func(count *int, format string, args ...interface{}) {
+		*count++
+		fmt.Fprintf(stdout, "%s:%d: %s\n", name, lineNo, fmt.Sprintf(format, args...))
+	}
+	unchecked := func() {
+		for _, r := range replies {
+			report(&unexpected, "unexpected reply %q", r)
+		}
+		replies = nil
+	}
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+		case strings.HasPrefix(line, "> "):
+			unchecked()
+			inputs++
+			var err error
+			if replies, err = s.send(strings.TrimSpace(line[2:])); err != nil {
+				report(&errs, "%v", err)
+			}
+		case strings.HasPrefix(line, "< "):
+			checks++
+			want := strings.TrimSpace(line[2:])
+			if len(replies) == 0 {
+				report(&failed, "expected reply %q, got none", want)
+				continue
+			}
+			if got := replies[0]; !strings.Contains(got, want) {
+				report(&failed, "expected reply containing %q, got %q", want, got)
+			}
+			replies = replies[1:]
+		default:
+			report(&errs, "unrecognized line %q (start it with \"> \", \"< \" or \"#\")", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(stdout, "%s: %v\n", name, err)
+		return 1
+	}
+	unchecked()
+	if failed+unexpected+errs > 0 {
+		summary := fmt.Sprintf("%d of %d checks failed", failed, checks)
+		if unexpected > 0 {
+			summary += fmt.Sprintf(", %d unexpected %s", unexpected, plural(unexpected, "reply", "replies"))
+		}
+		if errs > 0 {
+			summary += fmt.Sprintf(", %d %s", errs, plural(errs, "input error", "input errors"))
+		}
+		fmt.Fprintf(stdout, "%s: FAIL (%s)\n", name, summary)
+		return 1
+	}
+	fmt.Fprintf(stdout, "%s: ok (%d inputs, %d checks)\n", name, inputs, checks)
+	return 0
+}
+
+// plural picks the singular or plural form of a word for n.
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
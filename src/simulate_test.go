@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const simulateConv = `{"messages":[
+{"id":"start","type":"start_message","text":"Welcome","success_transition":"user"},
+{"id":"user","type":"question","text":"Username?","action":"auth.username","success_transition":"pass","fail_transition":"user"},
+{"id":"pass","type":"question","text":"Password?","action":"auth.password","success_transition":"pain","fail_transition":"user"},
+{"id":"pain","type":"choice","text":"Any pain?","options":[{"label":"Yes"},{"label":"No"}],"success_transition":"photo"},
+{"id":"photo","type":"start_message","text":"Send a photo","expect_photo":true,"success_transition":"end","fail_transition":"photo"},
+{"id":"end","type":"end_message","text":"Thanks, pain: {{.Answers.pain}}"}]}`
+
+func runSimulateForTest(t *testing.T, script string, extra ...string) (int, string) {
+	t.Helper()
+	resetGlobals()
+	t.Cleanup(resetGlobals)
+	originalSend, originalSendWith, originalAnswer := sendReply, sendReplyWith, answerCallback
+	originalSave, originalClassifier := savePhoto, classifyPhoto
+	t.Cleanup(func() {
+		sendReply, sendReplyWith, answerCallback = originalSend, originalSendWith, originalAnswer
+		savePhoto, classifyPhoto = originalSave, originalClassifier
+	})
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"conversation.json": simulateConv,
+		"auth.json":         `{"users":[{"username":"ana","password":"1"}]}`,
+		"session.txt":       script,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := append([]string{"-auth", filepath.Join(dir, "auth.json")}, extra...)
+	if script != "" {
+		args = append(args, "-script", filepath.Join(dir, "session.txt"))
+	}
+	args = append(args, filepath.Join(dir, "conversation.json"))
+	var out, errOut bytes.Buffer
+	code := runSimulate(args, strings.NewReader(":photo x.jpg\n:quit\n"), &out, &errOut)
+	return code, out.String() + errOut.String()
+}
+
+func TestSimulateReplayPasses(t *testing.T) {
+	code, out := runSimulateForTest(t, `# full screening
+> hi
+< Welcome
+< Username?
+> ana
+< Password?
+> wrong
+< did not match
+< Username?
+> ana
+< Password?
+> 1
+< Any pain?
+> :tap 1
+< Send a photo
+> :photo mouth.jpg positive
+< Model's assessment: Yes
+< Thanks, pain: Yes
+`)
+	if code != 0 || !strings.Contains(out, "ok (7 inputs, 10 checks)") {
+		t.Fatalf("exit %d:\n%s", code, out)
+	}
+}
+
+func TestSimulateReplayReportsMismatches(t *testing.T) {
+	code, out := runSimulateForTest(t, `> hi
+< Welcome
+< Password?
+> :tap 4
+`)
+	if code != 1 {
+		t.Fatalf("expected failure, got exit %d:\n%s", code, out)
+	}
+	for _, want := range []string{
+		`session.txt:3: expected reply containing "Password?", got "Username?"`,
+		"session.txt:4: no button 4",
+		"FAIL (1 of 2 checks failed, 1 input error)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestSimulateReplayReportsUncheckedReplies(t *testing.T) {
+	code, out := runSimulateForTest(t, `> hi
+< Welcome
+> ana
+`)
+	if code != 1 {
+		t.Fatalf("expected failure, got exit %d:\n%s", code, out)
+	}
+	for _, want := range []string{
+		`session.txt:3: unexpected reply "Username?"`,
+		`session.txt:3: unexpected reply "Password?"`,
+		"FAIL (0 of 1 checks failed, 2 unexpected replies)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestSimulateREPL(t *testing.T) {
+	code, out := runSimulateForTest(t, "")
+	if code != 0 || !strings.Contains(out, "bot> Welcome") || !strings.Contains(out, "bot> Username?") {
+		t.Fatalf("exit %d:\n%s", code, out)
+	}
+}
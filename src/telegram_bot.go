@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,6 +15,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 )
 
@@ -42,6 +46,20 @@ func getUpdates(client *http.Client, base string, offset int, timeout int) ([]Up
 	return r.Result, nil
 }
 
+// handleUpdate routes a single Telegram update into the conversation engine.
+func handleUpdate(u Update) {
+	if u.Message != nil {
+		printMessage(u.Message)
+	}
+	if u.EditedMessage != nil {
+		log.Printf("Edited message: ")
+		printMessage(u.EditedMessage)
+	}
+	if u.CallbackQuery != nil {
+		handleCallbackQuery(u.CallbackQuery)
+	}
+}
+
 // printMessage logs a message and advances the conversation if needed.
 func printMessage(m *Message) {
 	ts := time.Unix(m.Date, 0).Format(time.RFC3339)
@@ -57,24 +75,70 @@ func printMessage(m *Message) {
 	fmt.Printf("[%s] chat:%s from:%s text:%s\n", ts, chat, from, strconv.Quote(m.Text))
 
 	// If we have a conversation loaded, handle state transitions
-	if nodes == nil || startNodeID == "" {
+	startID := currentStartNode()
+	if startID == "" {
+		return
+	}
+
+	sender := chatStateFor(m.Chat.ID)
+	touchChat(sender)
+	if m.From != nil {
+		rememberSender(sender, m.From)
+	}
+
+	// A chat in a cooldown, or a locked-out user, is only told when to come back.
+	if wait := blockedFor(m.Chat.ID, sender); wait > 0 {
+		replyOrLog(m.Chat.ID, msg(chatLocale(sender), "attempts.wait", waitMinutes(wait)))
+		return
+	}
+
+	// Commands take precedence over whatever node the chat is sitting on.
+	if handleCommand(m) {
 		return
 	}
 
 	chID := m.Chat.ID
 	st := chatStateFor(chID)
 	startedNow := false
-	if !st.Started && startNodeID != "" {
+	if !st.Started {
 		startedNow = true
-		advanceChatState(chID, startNodeID)
+		startFlow(chID, chooseFlow(""))
 	}
 	if startedNow {
 		return
 	}
 
+	// The node this chat was waiting on may have been removed by a reload.
+	if st.Awaiting != "" {
+		if _, ok := lookupNode(st.Awaiting); !ok {
+			relocateChat(chID, st)
+			return
+		}
+	}
+
 	var photoPath string
 
-	if len(m.Photo) > 0 {
+	if m.Document != nil && !isImageDocument(m.Document) {
+		log.Printf("[document] chat:%d message:%d rejected type %q", chID, m.MessageID, documentMimeType(m.Document))
+		if err := sendReply(chID, msg(chatLocale(st), "document.unsupported")); err != nil {
+			log.Printf("send document rejection error: %v", err)
+		}
+		return
+	}
+	if m.Document != nil && maxDownloadBytes > 0 && int64(m.Document.FileSize) > maxDownloadBytes {
+		if err := sendReply(chID, msg(chatLocale(st), "document.too_large", maxDownloadBytes/(1024*1024))); err != nil {
+			log.Printf("send document size error: %v", err)
+		}
+		return
+	}
+
+	// Health photos are not even stored without consent.
+	if hasImage(m) && consentMissing(chID, st) {
+		redirectToConsent(chID, st, st.Awaiting)
+		return
+	}
+
+	if hasImage(m) {
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		path, err := savePhoto(ctx, m)
 		cancel()
@@ -88,12 +152,12 @@ func printMessage(m *Message) {
 
 	currentNodeID := st.Awaiting
 	if currentNodeID != "" {
-		node, ok := nodes[currentNodeID]
+		node, ok := lookupNode(currentNodeID)
 		if ok {
 			if node.Type == "question" {
 				text := strings.TrimSpace(m.Text)
 				if text == "" {
-					if err := sendReply(chID, "Please reply with text so we can continue."); err != nil {
+					if err := sendReply(chID, msg(chatLocale(st), "reply.text_required")); err != nil {
 						log.Printf("send text reminder error: %v", err)
 					}
 					return
@@ -101,40 +165,82 @@ func printMessage(m *Message) {
 				handleQuestionAnswer(chID, currentNodeID, text)
 				return
 			}
+			if node.Type == "choice" {
+				handleChoiceText(chID, node, m.Text)
+				return
+			}
+			if node.Type == "consent" {
+				handleConsentText(chID, node, m.Text)
+				return
+			}
 			if node.ExpectPhoto {
+				// An album photo that could not be saved stays in the case as a failed photo.
+				if m.MediaGroupID != "" && hasImage(m) {
+					albums.Add(m, photoPath, flushAlbum)
+					return
+				}
 				if photoPath == "" {
-					if err := sendReply(chID, "I need a clear photo of the inside of your mouth to continue. Please try sending an image."); err != nil {
+					if err := sendReply(chID, msg(chatLocale(st), "photo.required")); err != nil {
 						log.Printf("send reminder error: %v", err)
 					}
 					return
 				}
-				handlePhotoMessage(chID, m, photoPath)
+				handlePhotoMessage(chID, m, []string{photoPath})
 				return
 			}
 		}
 	}
 }
 
+// rememberSender keeps the sender's name and language on the chat state.
+func rememberSender(st *ChatState, from *User) {
+	if from.FirstName != "" {
+		st.FirstName = from.FirstName
+	}
+	if from.LanguageCode != "" {
+		st.LanguageCode = from.LanguageCode
+	}
+	if from.ID != 0 {
+		st.UserID = int64(from.ID)
+	}
+}
+
+// chatUserID is the Telegram user a chat belongs to; in private chats the user
+// ID equals the chat ID, which stands in when no sender is known.
+func chatUserID(chatID int64, st *ChatState) int64 {
+	if st.UserID != 0 {
+		return st.UserID
+	}
+	return chatID
+}
+
 // advanceChatState handles visiting a node ID for a chat.
 func advanceChatState(chatID int64, nodeID string) {
-	n, ok := nodes[nodeID]
+	n, ok := lookupNode(nodeID)
 	if !ok {
 		log.Printf("unknown node %s", nodeID)
 		return
 	}
+	defer saveChatState(chatID)
 	st := chatStateFor(chatID)
+	if flow, ok := flowStartingAt(n.ID); ok {
+		st.Flow = flow
+	}
 	switch n.Type {
 	case "start_message":
 		st.Started = true
 		if n.ExpectPhoto {
 			st.Awaiting = n.ID
+			pushHistory(st, n)
 		} else {
 			st.Awaiting = ""
 		}
 
 		// print the start message text
-		fmt.Printf("[conversation] chat:%d start: %s\n", chatID, n.Text)
-		if err := sendReply(chatID, n.Text); err != nil {
+		text, opts := renderNodeText(st, n)
+		opts.ReplyMarkup = withBackButton(st, n, nil)
+		fmt.Printf("[conversation] chat:%d start: %s\n", chatID, text)
+		if err := sendNodeText(chatID, text, opts); err != nil {
 			log.Printf("send start message error: %v", err)
 		}
 		if !n.ExpectPhoto && n.SuccessTransition != nil && *n.SuccessTransition != "" {
@@ -145,52 +251,95 @@ func advanceChatState(chatID int64, nodeID string) {
 	case "question":
 		// set awaiting to this question id
 		st.Awaiting = n.ID
-		fmt.Printf("[conversation] chat:%d question(%s): %s\n", chatID, n.ID, n.Text)
-		if err := sendReply(chatID, n.Text); err != nil {
+		pushHistory(st, n)
+		text, opts := renderNodeText(st, n)
+		opts.ReplyMarkup = withBackButton(st, n, nil)
+		fmt.Printf("[conversation] chat:%d question(%s): %s\n", chatID, n.ID, text)
+		if err := sendNodeText(chatID, text, opts); err != nil {
 			log.Printf("send question error: %v", err)
 		}
+	case "choice":
+		st.Awaiting = n.ID
+		pushHistory(st, n)
+		text, opts := renderNodeText(st, n)
+		opts.ReplyMarkup = withBackButton(st, n, choiceKeyboard(n, chatLocale(st)))
+		opts.ListButton = msg(chatLocale(st), "choice.list_button")
+		fmt.Printf("[conversation] chat:%d choice(%s): %s\n", chatID, n.ID, text)
+		if err := sendReplyWith(chatID, text, opts); err != nil {
+			log.Printf("send choice error: %v", err)
+		}
+	case "consent":
+		showConsent(chatID, st, n)
 	case "end_message":
 		// print end text and restart (clear state)
-		fmt.Printf("[conversation] chat:%d end: %s\n", chatID, n.Text)
-		if err := sendReply(chatID, n.Text); err != nil {
+		text, opts := renderNodeText(st, n)
+		fmt.Printf("[conversation] chat:%d end: %s\n", chatID, text)
+		if err := sendNodeText(chatID, text, opts); err != nil {
 			log.Printf("send end message error: %v", err)
 		}
 
-		// show answers stored
+		// show answers stored and keep them with the case screened in this conversation
 		fmt.Printf("[conversation] chat:%d answers: %v\n", chatID, st.Answers)
+		if st.CaseID != "" {
+			if err := completeDiagnosisAnswers(st.Username, st.CaseID, st.Answers); err != nil {
+				log.Printf("record answers for chat:%d: %v", chatID, err)
+			}
+		}
 
 		// restart: clear state
-		states[chatID] = &ChatState{Answers: make(map[string]string), Started: true}
+		resetChatState(chatID, true)
 
 		if n.SuccessTransition != nil && *n.SuccessTransition != "" {
 			advanceChatState(chatID, *n.SuccessTransition)
 		}
+	case "branch":
+		target := branchTarget(n, st.Answers)
+		fmt.Printf("[conversation] chat:%d branch(%s) -> %s\n", chatID, n.ID, target)
+		if target == "" {
+			log.Printf("branch %s matched no target", n.ID)
+			return
+		}
+		advanceChatState(chatID, target)
 	default:
 		log.Printf("unhandled node type %s", n.Type)
 	}
 }
 
 // applyTransition advances the chat based on the outcome of an awaiting node.
+// A success clears the node's failed attempts; a failure counts one and, once
+// max_attempts is reached, hands over to exhaustAttempts.
 func applyTransition(chatID int64, nodeID string, success bool) bool {
 	if nodeID == "" {
 		return false
 	}
-	n, ok := nodes[nodeID]
+	n, ok := lookupNode(nodeID)
 	if !ok {
 		log.Printf("transition requested for unknown node %s", nodeID)
 		return false
 	}
 
 	st := chatStateFor(chatID)
+	if success {
+		delete(st.Attempts, nodeID)
+	} else if n.MaxAttempts > 0 && countAttempt(st, n) >= n.MaxAttempts && exhaustAttempts(chatID, st, n) {
+		return true
+	}
+	return followTransition(chatID, st, n, success)
+}
+
+// followTransition moves the chat along n's success or fail transition
+// without counting attempts.
+func followTransition(chatID int64, st *ChatState, n Node, success bool) bool {
+	defer saveChatState(chatID)
 	var nextID *string
 	if success {
 		nextID = n.SuccessTransition
-		if st.Awaiting == nodeID {
+		if st.Awaiting == n.ID {
 			st.Awaiting = ""
 		}
 	} else {
 		nextID = n.FailTransition
-		if nextID != nil && *nextID != "" && st.Awaiting == nodeID {
+		if nextID != nil && *nextID != "" && st.Awaiting == n.ID {
 			st.Awaiting = ""
 		}
 	}
@@ -203,66 +352,72 @@ func applyTransition(chatID int64, nodeID string, success bool) bool {
 	return true
 }
 
-// handleQuestionAnswer directs username/password inputs through authentication checks.
+// handleQuestionAnswer validates an answer and either runs the node's action
+// or stores the answer and moves on.
 func handleQuestionAnswer(chatID int64, nodeID, answer string) {
 	st := chatStateFor(chatID)
 	trimmed := strings.TrimSpace(answer)
-	switch nodeID {
-	case "login_username":
-		if trimmed == "" || !userExists(trimmed) {
-			if err := sendReply(chatID, "I couldn't find that username. Please try again."); err != nil {
-				log.Printf("send username failure: %v", err)
-			}
-			applyTransition(chatID, nodeID, false)
-			return
-		}
-		st.Username = trimmed
-		applyTransition(chatID, nodeID, true)
-	case "login_password":
-		if st.Username == "" {
-			if err := sendReply(chatID, "Please provide your username before sending the password."); err != nil {
-				log.Printf("send username reminder: %v", err)
-			}
-			applyTransition(chatID, nodeID, false)
-			return
-		}
-		if !verifyPassword(st.Username, trimmed) {
-			if err := sendReply(chatID, "The password did not match. Please try again."); err != nil {
-				log.Printf("send password failure: %v", err)
-			}
-			applyTransition(chatID, nodeID, false)
-			return
-		}
-		st.Authed = true
-		applyTransition(chatID, nodeID, true)
-	default:
-		if trimmed != "" {
-			st.Answers[nodeID] = trimmed
-		}
-		applyTransition(chatID, nodeID, true)
+	n, _ := lookupNode(nodeID)
+	value, err := validateAnswer(n.Validation, trimmed, chatLocale(st))
+	if err != nil {
+		rejectAnswer(chatID, st, n, err)
+		return
+	}
+	if action := nodeAction(n); action != "" {
+		runAction(chatID, st, n, action, value)
+		return
+	}
+	if value != "" {
+		st.Answers[nodeID] = value
 	}
+	applyTransition(chatID, nodeID, true)
 }
 
 // loadAuth reads credentials from disk to enable authentication checks.
 func loadAuth(path string) error {
-	f, err := os.Open(path)
+	users, roles, err := readAuth(path)
 	if err != nil {
 		return err
 	}
+	configMu.Lock()
+	authUsers, authRoles = users, roles
+	configMu.Unlock()
+	return nil
+}
+
+// readAuth decodes an auth file into username to password and username to role maps.
+func readAuth(path string) (map[string]string, map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
 	defer f.Close()
 	var af AuthFile
 	dec := json.NewDecoder(f)
 	if err := dec.Decode(&af); err != nil {
-		return err
+		return nil, nil, err
 	}
-	authUsers = make(map[string]string, len(af.Users))
+	users := make(map[string]string, len(af.Users))
+	roles := make(map[string]string)
 	for _, u := range af.Users {
-		authUsers[u.Username] = u.Password
+		users[u.Username] = u.Password
+		if u.Role != "" {
+			roles[u.Username] = u.Role
+		}
 	}
-	return nil
+	return users, roles, nil
+}
+
+// userRole returns the role auth.json gives username, or "".
+func userRole(username string) string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return authRoles[username]
 }
 
 func userExists(username string) bool {
+	configMu.RLock()
+	defer configMu.RUnlock()
 	if authUsers == nil || username == "" {
 		return false
 	}
@@ -271,6 +426,8 @@ func userExists(username string) bool {
 }
 
 func verifyPassword(username, password string) bool {
+	configMu.RLock()
+	defer configMu.RUnlock()
 	if authUsers == nil {
 		return false
 	}
@@ -321,16 +478,12 @@ func persistDiagnosisLocked() error {
 	return os.WriteFile(diagnosisFile, data, 0600)
 }
 
-func recordDiagnosis(username, photoPath string, verdict bool, rationale string) error {
+// recordDiagnosisEntry appends a screening case to the user's history, stamping it with the current time.
+func recordDiagnosisEntry(username string, entry DiagnosisEntry) error {
 	if username == "" {
 		return fmt.Errorf("username is required to record diagnosis")
 	}
-	entry := DiagnosisEntry{
-		PhotoPath: photoPath,
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
-		Verdict:   verdict,
-		Rationale: rationale,
-	}
+	entry.Timestamp = time.Now().UTC().Format(time.RFC3339)
 	diagnosisMu.Lock()
 	if diagnosisLog == nil {
 		diagnosisLog = make(map[string][]DiagnosisEntry)
@@ -341,18 +494,55 @@ func recordDiagnosis(username, photoPath string, verdict bool, rationale string)
 	return err
 }
 
-// saveIncomingPhoto retrieves the largest photo variant from a message and writes
-// it to the assets directory, returning the saved file path.
+// completeDiagnosisAnswers replaces the answers of a recorded case with the
+// full set collected by the end of its conversation.
+func completeDiagnosisAnswers(username, caseID string, answers map[string]string) error {
+	diagnosisMu.Lock()
+	defer diagnosisMu.Unlock()
+	entries := diagnosisLog[username]
+	for i := range entries {
+		if entries[i].ID == caseID {
+			entries[i].Answers = copyAnswers(answers)
+			return persistDiagnosisLocked()
+		}
+	}
+	return fmt.Errorf("case %s of %q not found", caseID, username)
+}
+
+// copyAnswers returns a copy of answers that later changes to the chat do not touch.
+func copyAnswers(answers map[string]string) map[string]string {
+	if len(answers) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(answers))
+	for k, v := range answers {
+		out[k] = v
+	}
+	return out
+}
+
+// saveIncomingPhoto retrieves the largest photo variant (or an image document) from
+// a message and writes it to the assets directory, returning the saved file path.
 func saveIncomingPhoto(ctx context.Context, msg *Message) (string, error) {
 	if httpClient == nil || apiBase == "" {
 		return "", fmt.Errorf("telegram client not initialised")
 	}
-	if len(msg.Photo) == 0 {
+
+	var fileID, originalName string
+	switch {
+	case len(msg.Photo) > 0:
+		fileID = msg.Photo[len(msg.Photo)-1].FileID
+	case isImageDocument(msg.Document):
+		if maxDownloadBytes > 0 && int64(msg.Document.FileSize) > maxDownloadBytes {
+			return "", fmt.Errorf("file size %d exceeds max allowed %d", msg.Document.FileSize, maxDownloadBytes)
+		}
+		fileID = msg.Document.FileID
+		originalName = msg.Document.FileName
+	default:
 		return "", fmt.Errorf("message does not contain photo data")
 	}
 
-	photo := msg.Photo[len(msg.Photo)-1]
-	reqURL := fmt.Sprintf("%sgetFile?file_id=%s", apiBase, url.QueryEscape(photo.FileID))
+	reqURL := fmt.Sprintf("%sgetFile?file_id=%s", apiBase, url.QueryEscape(fileID))
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
 	if err != nil {
 		return "", fmt.Errorf("create getFile request: %w", err)
@@ -408,31 +598,29 @@ func saveIncomingPhoto(ctx context.Context, msg *Message) (string, error) {
 		return "", fmt.Errorf("download status %d: %s", dlResp.StatusCode, string(body))
 	}
 
-	data, err := io.ReadAll(dlResp.Body)
+	data, err := readLimited(dlResp.Body)
 	if err != nil {
 		return "", fmt.Errorf("read photo data: %w", err)
 	}
 
-	if err := os.MkdirAll(assetsDir, 0755); err != nil {
-		return "", fmt.Errorf("create assets dir: %w", err)
-	}
-
 	ext := filepath.Ext(fileResp.Result.FilePath)
+	if ext == "" {
+		ext = filepath.Ext(originalName)
+	}
 	if ext == "" {
 		ext = ".jpg"
 	}
 	fileName := fmt.Sprintf("%d_%d_%d%s", msg.Chat.ID, msg.MessageID, msg.Date, ext)
-	localPath := filepath.Join(assetsDir, fileName)
-
-	if err := os.WriteFile(localPath, data, 0644); err != nil {
-		return "", fmt.Errorf("write photo: %w", err)
-	}
-
-	return localPath, nil
+	return writeAsset(fileName, data)
 }
 
 // sendMessage posts a text reply to the Telegram Bot API.
 func sendMessage(chatID int64, text string) error {
+	return sendMessageWith(chatID, text, ReplyOptions{})
+}
+
+// sendMessageWith posts a reply carrying an optional parse mode and inline keyboard.
+func sendMessageWith(chatID int64, text string, opts ReplyOptions) error {
 	if httpClient == nil || apiBase == "" {
 		return fmt.Errorf("telegram client not initialised")
 	}
@@ -440,6 +628,16 @@ func sendMessage(chatID int64, text string) error {
 	values := url.Values{}
 	values.Set("chat_id", strconv.FormatInt(chatID, 10))
 	values.Set("text", text)
+	if opts.ParseMode != "" {
+		values.Set("parse_mode", opts.ParseMode)
+	}
+	if opts.ReplyMarkup != nil {
+		markup, err := json.Marshal(opts.ReplyMarkup)
+		if err != nil {
+			return fmt.Errorf("encode reply markup: %w", err)
+		}
+		values.Set("reply_markup", string(markup))
+	}
 
 	resp, err := httpClient.PostForm(apiBase+"sendMessage", values)
 	if err != nil {
@@ -449,7 +647,33 @@ func sendMessage(chatID int64, text string) error {
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("sendMessage status %d: %s", resp.StatusCode, string(body))
+		return newAPIError("sendMessage", resp.StatusCode, body)
+	}
+
+	return nil
+}
+
+// answerCallbackQuery acknowledges a button press, optionally showing a short notice.
+func answerCallbackQuery(callbackID, text string) error {
+	if httpClient == nil || apiBase == "" {
+		return fmt.Errorf("telegram client not initialised")
+	}
+
+	values := url.Values{}
+	values.Set("callback_query_id", callbackID)
+	if text != "" {
+		values.Set("text", text)
+	}
+
+	resp, err := httpClient.PostForm(apiBase+"answerCallbackQuery", values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return newAPIError("answerCallbackQuery", resp.StatusCode, body)
 	}
 
 	return nil
@@ -457,45 +681,242 @@ func sendMessage(chatID int64, text string) error {
 
 // loadConversation loads a conversation JSON file into the nodes map.
 func loadConversation(path string) error {
-	f, err := os.Open(path)
+	cf, err := readConversation(path)
 	if err != nil {
 		return err
 	}
+	if err := checkRunnable(cf); err != nil {
+		return err
+	}
+	applyConversation(cf)
+	return nil
+}
+
+// checkRunnable rejects a conversation the engine cannot run at all, whatever
+// CONVERSATION_STRICT says: a loop that never waits for input would keep the
+// chat's queue busy forever, and only one consent version can be enforced.
+func checkRunnable(cf *ConversationFile) error {
+	if problems := append(inputlessLoops(cf), consentConflicts(cf)...); len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// readConversation decodes a conversation file, or a directory of flow
+// files, without touching the running graph.
+func readConversation(path string) (*ConversationFile, error) {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return readConversationDir(path)
+	}
+	return readConversationFile(path)
+}
+
+func readConversationFile(path string) (*ConversationFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
 	var cf ConversationFile
 	dec := json.NewDecoder(f)
 	if err := dec.Decode(&cf); err != nil {
-		return err
+		return nil, err
+	}
+	return &cf, nil
+}
+
+// applyConversation replaces the running graph with the nodes of cf.
+func applyConversation(cf *ConversationFile) {
+	g := buildConversation(cf)
+	configMu.Lock()
+	g.install()
+	configMu.Unlock()
+}
+
+// conversationGraph is a compiled conversation file, ready to be installed.
+type conversationGraph struct {
+	nodes     map[string]Node
+	start     string
+	fallback  string
+	commands  map[string]ConvCommand
+	templates map[string]*template.Template
+	locales   map[string]bool
+	flows     map[string]ConvFlow
+	flow      string            // default flow
+	starts    map[string]string // flow start node to flow ID
+	consent   string            // first consent node
+	consentV  string            // its consent_version
+	version   string            // conversation version stamped on diagnoses
+}
+
+func buildConversation(cf *ConversationFile) conversationGraph {
+	g := conversationGraph{
+		nodes:    make(map[string]Node),
+		fallback: cf.FallbackNode,
+		commands: make(map[string]ConvCommand),
+	}
+	for _, c := range cf.Commands {
+		name := strings.ToLower(strings.TrimPrefix(c.Command, "/"))
+		if isBuiltinCommand(name) {
+			log.Printf("command /%s is built in, ignoring the conversation's", name)
+			continue
+		}
+		g.commands[name] = c
 	}
-	nodes = make(map[string]Node)
-	startNodeID = ""
 	// Map messages to nodes
 	for i, m := range cf.Messages {
-		nodes[m.ID] = Node(m)
+		n := Node(m)
+		n.Branches = compileBranches(m.ID, m.Branches)
+		n.Validation = compileValidation(m.ID, m.Validation)
+		g.nodes[m.ID] = n
 		// pick first message of type start_message as start
-		if startNodeID == "" && m.Type == "start_message" {
-			startNodeID = m.ID
+		if g.start == "" && m.Type == "start_message" {
+			g.start = m.ID
+		}
+		if g.consent == "" && m.Type == "consent" {
+			g.consent, g.consentV = m.ID, m.ConsentVersion
 		}
 		// fallback: if no explicit start, use first message
-		if startNodeID == "" && i == 0 {
-			startNodeID = m.ID
+		if g.start == "" && i == 0 {
+			g.start = m.ID
 		}
 	}
-	return nil
+	g.flows = make(map[string]ConvFlow, len(cf.Flows))
+	g.starts = make(map[string]string, len(cf.Flows))
+	for _, f := range cf.Flows {
+		g.flows[f.ID] = f
+		if _, ok := g.starts[f.Start]; !ok {
+			g.starts[f.Start] = f.ID
+		}
+	}
+	if len(cf.Flows) > 0 {
+		g.flow = cf.DefaultFlow
+		if _, ok := g.flows[g.flow]; !ok {
+			g.flow = cf.Flows[0].ID
+		}
+		g.start = g.flows[g.flow].Start
+	}
+	g.version = cf.Version
+	if g.version == "" {
+		g.version = conversationHash(cf)
+	}
+	g.templates = buildTemplates(g.nodes)
+	g.locales = make(map[string]bool)
+	for _, n := range g.nodes {
+		for l := range n.Texts {
+			g.locales[normalizeLocale(l)] = true
+		}
+	}
+	return g
+}
+
+// install makes g the running graph; configMu must be held for writing.
+func (g conversationGraph) install() {
+	nodes = g.nodes
+	startNodeID = g.start
+	fallbackNodeID = g.fallback
+	customCommands = g.commands
+	nodeTemplates = g.templates
+	conversationLocales = g.locales
+	flows = g.flows
+	defaultFlowID = g.flow
+	flowStarts = g.starts
+	consentNodeID, consentVersion = g.consent, g.consentV
+	conversationVersion = g.version
+}
+
+// conversationVersion is the running conversation's Version, or a hash of its
+// content; guarded by configMu.
+var conversationVersion string
+
+// conversationHash identifies a conversation without a version by its content.
+func conversationHash(cf *ConversationFile) string {
+	data, err := json.Marshal(cf)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// currentConversationVersion returns the version of the running conversation.
+func currentConversationVersion() string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return conversationVersion
+}
+
+// lookupNode returns the node with the given ID from the running graph.
+func lookupNode(id string) (Node, bool) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	n, ok := nodes[id]
+	return n, ok
 }
 
-func handlePhotoMessage(chatID int64, msg *Message, photoPath string) {
-	ctx, cancel := context.WithTimeout(context.Background(), 90*time.Second)
-	defer cancel()
+// currentStartNode returns the ID of the node new conversations begin at.
+func currentStartNode() string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return startNodeID
+}
+
+// errPhotoNotSaved marks an album photo that could not be downloaded.
+var errPhotoNotSaved = errors.New("photo could not be saved")
+
+// photoTimeout bounds the handling of one photo: publishing its event and classifying it.
+const photoTimeout = 90 * time.Second
+
+// handlePhotoMessage classifies every photo of a case (a single photo or a whole
+// album), replies with one combined verdict and follows the awaiting node's
+// transition. An empty path is an album photo that could not be saved.
+func handlePhotoMessage(chatID int64, m *Message, photoPaths []string) {
 	st := chatStateFor(chatID)
+	if consentMissing(chatID, st) {
+		redirectToConsent(chatID, st, st.Awaiting)
+		return
+	}
 	awaitingID := st.Awaiting
-	// Publish event including the photo path so downstream services can act.
-	enqueueChatEvent(ctx, chatID, photoPath)
+	locale := chatLocale(st)
+	// Publish events including the photo paths so downstream services can act.
+	for _, path := range photoPaths {
+		if path == "" {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), photoTimeout)
+		enqueueChatEvent(ctx, chatID, path)
+		cancel()
+	}
 
-	answer, rationale, err := classifyPhoto(ctx, photoPath)
-	if err != nil {
-		log.Printf("model analysis error chat:%d message:%d: %v", chatID, msg.MessageID, err)
-		if sendErr := sendReply(chatID, "I couldn't analyse that photo. Please try again with a clearer picture or lighting."); sendErr != nil {
+	// Each photo of an album gets the full timeout, however many came before it.
+	// Photos that fail keep their place in the case so the record shows them.
+	var results []photoResult
+	var first *photoResult
+	analysed := 0
+	for _, path := range photoPaths {
+		if path == "" {
+			results = append(results, photoResult{Err: errPhotoNotSaved})
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), photoTimeout)
+		answer, rationale, err := classifyPhoto(withLocale(ctx, locale), path)
+		cancel()
+		if err != nil {
+			log.Printf("model analysis error chat:%d message:%d photo:%s: %v", chatID, m.MessageID, path, err)
+			results = append(results, photoResult{Path: path, Err: err})
+			continue
+		}
+		results = append(results, photoResult{Path: path, Positive: answer, Rationale: rationale})
+		analysed++
+	}
+	for i := range results {
+		if results[i].Err == nil {
+			first = &results[i]
+			break
+		}
+	}
+	if first == nil {
+		if sendErr := sendReply(chatID, msg(locale, "photo.analysis_failed")); sendErr != nil {
 			log.Printf("send analysis failure message error: %v", sendErr)
 		}
 		if awaitingID != "" {
@@ -503,23 +924,53 @@ func handlePhotoMessage(chatID int64, msg *Message, photoPath string) {
 		}
 		return
 	}
+	answer, rationale := aggregateVerdict(results, locale, albums.majority)
 
-	verdict := "No. The image does not appear to show signs consistent with oral cancer."
+	verdict := msg(locale, "verdict.negative")
 	if answer {
-		verdict = "Yes. The image may show signs consistent with oral cancer."
+		verdict = msg(locale, "verdict.positive")
 	}
 	if awaitingID != "" {
 		st.Answers[awaitingID] = verdict
 	}
+	st.LastVerdict = &VerdictRecord{Positive: answer, Summary: verdict, Rationale: rationale}
+	// A verdict has been given; the answers that led to it can no longer be changed.
+	sealHistory(st)
 	if st.Username != "" {
-		if err := recordDiagnosis(st.Username, photoPath, answer, rationale); err != nil {
+		entry := DiagnosisEntry{
+			ID:                  fmt.Sprintf("%d-%d", chatID, clock().UnixNano()),
+			PhotoPath:           first.Path,
+			Verdict:             answer,
+			Rationale:           rationale,
+			Answers:             copyAnswers(st.Answers),
+			Flow:                st.Flow,
+			ConversationVersion: currentConversationVersion(),
+			TelegramUserID:      st.UserID,
+			ChatID:              chatID,
+		}
+		if len(results) > 1 {
+			for i, r := range results {
+				if r.Path != "" {
+					entry.PhotoPaths = append(entry.PhotoPaths, r.Path)
+				}
+				if r.Err != nil {
+					entry.FailedPhotos = append(entry.FailedPhotos, FailedPhoto{Photo: i + 1, Path: r.Path, Error: r.Err.Error()})
+				}
+			}
+		}
+		if err := recordDiagnosisEntry(st.Username, entry); err != nil {
 			log.Printf("record diagnosis error: %v", err)
+		} else {
+			st.CaseID = entry.ID
 		}
 	} else {
 		log.Printf("skipping diagnosis log for chat:%d: username not set", chatID)
 	}
 
-	reply := fmt.Sprintf("Model's assessment: %s\n\nRationale: %s\n\nThis is an AI assessment and not a medical diagnosis.\nPlease consult a qualified professional for concerns.", verdict, rationale)
+	reply := msg(locale, "verdict.reply", verdict, rationale)
+	if len(results) > 1 {
+		reply = msg(locale, "verdict.album", analysed, reply)
+	}
 	if err := sendReply(chatID, reply); err != nil {
 		log.Printf("send diagnosis message error: %v", err)
 	}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveIncomingPhotoAcceptsImageDocument(t *testing.T) {
+	resetGlobals()
+	originalBase, originalClient, originalAssets, originalMax := apiBase, httpClient, assetsDir, maxDownloadBytes
+	defer func() {
+		apiBase, httpClient, assetsDir, maxDownloadBytes = originalBase, originalClient, originalAssets, originalMax
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/botTOKEN/getFile":
+			if got := r.URL.Query().Get("file_id"); got != "doc-file" {
+				t.Fatalf("unexpected file_id %q", got)
+			}
+			_, _ = w.Write([]byte(`{"ok":true,"result":{"file_id":"doc-file","file_size":4,"file_path":"documents/file_1"}}`))
+		case "/file/botTOKEN/documents/file_1":
+			_, _ = w.Write([]byte("\x89PNG"))
+		default:
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	apiBase = server.URL + "/botTOKEN/"
+	httpClient = server.Client()
+	assetsDir = t.TempDir()
+	maxDownloadBytes = 1024
+
+	msg := &Message{MessageID: 3, Date: 9, Chat: Chat{ID: 1}, Document: &Document{FileID: "doc-file", FileName: "scan.png", MimeType: "image/png", FileSize: 4}}
+	path, err := saveIncomingPhoto(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("saveIncomingPhoto returned error: %v", err)
+	}
+	if filepath.Ext(path) != ".png" {
+		t.Fatalf("expected extension from file name, got %s", path)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "\x89PNG" {
+		t.Fatalf("unexpected saved content %q", data)
+	}
+
+	msg.Document.FileSize = 4096
+	if _, err := saveIncomingPhoto(context.Background(), msg); err == nil {
+		t.Fatalf("expected oversized document to be rejected")
+	}
+}
+
+func TestNonImageDocumentIsRejected(t *testing.T) {
+	resetGlobals()
+	originalSend, originalSave := sendReply, savePhoto
+	defer func() { sendReply, savePhoto = originalSend, originalSave }()
+
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+	savePhoto = func(ctx context.Context, msg *Message) (string, error) {
+		t.Fatalf("non-image document should not be downloaded")
+		return "", nil
+	}
+	nodes = map[string]Node{
+		"photo": {ID: "photo", Type: "start_message", Text: "send a photo", ExpectPhoto: true},
+	}
+	startNodeID = "photo"
+
+	chat := Chat{ID: 4}
+	captureOutput(t, func() {
+		printMessage(&Message{Chat: chat, Text: "hi"})
+		printMessage(&Message{Chat: chat, Document: &Document{FileID: "x", FileName: "report.pdf", MimeType: "application/pdf"}})
+	})
+	if len(sent) != 2 || !strings.Contains(sent[1], "image files") {
+		t.Fatalf("expected a rejection message, got %v", sent)
+	}
+	if chatStateFor(4).Awaiting != "photo" {
+		t.Fatalf("rejected document should leave the chat waiting for a photo")
+	}
+}
+
+func TestAlbumPhotosGetTheirOwnTimeout(t *testing.T) {
+	setupChatTest(t)
+	nodes = map[string]Node{
+		"photo": {ID: "photo", Type: "start_message", Text: "Photo please", ExpectPhoto: true, SuccessTransition: strPtr("end"), FailTransition: strPtr("photo")},
+		"end":   {ID: "end", Type: "end_message", Text: "bye"},
+	}
+	const chatID = 31
+	st := resetChatState(chatID, true)
+	st.Awaiting = "photo"
+
+	var contexts []context.Context
+	classifyPhoto = func(ctx context.Context, path string) (bool, string, error) {
+		for _, earlier := range contexts {
+			if earlier == ctx || earlier.Err() == nil {
+				t.Errorf("photo %s shares its timeout with an earlier photo", path)
+			}
+		}
+		deadline, ok := ctx.Deadline()
+		if !ok || time.Until(deadline) < photoTimeout-time.Second {
+			t.Errorf("photo %s started with less than the full timeout", path)
+		}
+		contexts = append(contexts, ctx)
+		return false, "clear", nil
+	}
+	handlePhotoMessage(chatID, &Message{Chat: Chat{ID: chatID}}, []string{"/tmp/a.jpg", "/tmp/b.jpg", "/tmp/c.jpg"})
+	if len(contexts) != 3 {
+		t.Fatalf("expected three classifications, got %d", len(contexts))
+	}
+}
@@ -1,10 +1,42 @@
 package main
 
+import (
+	"regexp"
+	"time"
+)
+
 // Update mirrors the Telegram update payload that wraps incoming messages.
 type Update struct {
-	UpdateID      int      `json:"update_id"`
-	Message       *Message `json:"message"`
-	EditedMessage *Message `json:"edited_message"`
+	UpdateID      int            `json:"update_id"`
+	Message       *Message       `json:"message"`
+	EditedMessage *Message       `json:"edited_message"`
+	CallbackQuery *CallbackQuery `json:"callback_query"`
+}
+
+// CallbackQuery is sent by Telegram when a user presses an inline keyboard button.
+type CallbackQuery struct {
+	ID      string   `json:"id"`
+	From    *User    `json:"from"`
+	Message *Message `json:"message"`
+	Data    string   `json:"data"`
+}
+
+// InlineKeyboardMarkup is the reply_markup payload rendering buttons under a message.
+type InlineKeyboardMarkup struct {
+	InlineKeyboard [][]InlineKeyboardButton `json:"inline_keyboard"`
+}
+
+// InlineKeyboardButton is a single button whose press is reported as a callback query.
+type InlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data,omitempty"`
+}
+
+// ReplyOptions carries optional formatting for an outgoing message.
+type ReplyOptions struct {
+	ParseMode   string
+	ReplyMarkup *InlineKeyboardMarkup
+	ListButton  string // opens the keyboard where it becomes a list (WhatsApp, more than three buttons)
 }
 
 // Message captures the relevant parts of a Telegram chat message.
@@ -15,6 +47,21 @@ type Message struct {
 	Date      int64       `json:"date"`
 	Text      string      `json:"text"`
 	Photo     []PhotoSize `json:"photo"`
+	Document  *Document   `json:"document"`
+	// MediaGroupID is shared by every message of an album.
+	MediaGroupID string `json:"media_group_id"`
+	// handled commits the update that carried the message; an album photo
+	// takes it over until the whole album has been classified.
+	handled func()
+}
+
+// Document describes a file sent as an attachment, e.g. an uncompressed image.
+type Document struct {
+	FileID       string `json:"file_id"`
+	FileUniqueID string `json:"file_unique_id"`
+	FileName     string `json:"file_name"`
+	MimeType     string `json:"mime_type"`
+	FileSize     int    `json:"file_size"`
 }
 
 // PhotoSize captures the photo variants Telegram sends with a message.
@@ -28,10 +75,11 @@ type PhotoSize struct {
 
 // User represents the Telegram account that sent a message.
 type User struct {
-	ID        int    `json:"id"`
-	IsBot     bool   `json:"is_bot"`
-	FirstName string `json:"first_name"`
-	Username  string `json:"username"`
+	ID           int    `json:"id"`
+	IsBot        bool   `json:"is_bot"`
+	FirstName    string `json:"first_name"`
+	Username     string `json:"username"`
+	LanguageCode string `json:"language_code,omitempty"`
 }
 
 // Chat contains the destination chat metadata Telegram includes per message.
@@ -64,17 +112,84 @@ type telegramFile struct {
 
 // ConversationFile models the conversation.json structure.
 type ConversationFile struct {
-	Messages []ConvMessage `json:"messages"`
+	Messages     []ConvMessage `json:"messages"`
+	Commands     []ConvCommand `json:"commands,omitempty"`
+	FallbackNode string        `json:"fallback_node,omitempty"` // where chats on removed nodes resume after a reload
+	Flows        []ConvFlow    `json:"flows,omitempty"`
+	DefaultFlow  string        `json:"default_flow,omitempty"` // flow used when nothing else picks one; defaults to the first
+	Version      string        `json:"version,omitempty"`      // recorded with each diagnosis; defaults to a hash of the conversation
+}
+
+// ConvFlow is a named entry point into the conversation. Its ID doubles as
+// the /start deep-link payload (https://t.me/<bot>?start=<id>).
+type ConvFlow struct {
+	ID          string   `json:"id"`
+	Start       string   `json:"start"`                 // node the flow begins at
+	Description string   `json:"description,omitempty"` // shown in the command menu
+	Command     string   `json:"command,omitempty"`     // optional command that opens the flow
+	Roles       []string `json:"roles,omitempty"`       // auth.json roles that start here by default
+}
+
+// ConvCommand maps a custom bot command (without the slash) to a node ID.
+type ConvCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+	Node        string `json:"node"`
 }
 
 // ConvMessage defines an individual conversation node from conversation.json.
 type ConvMessage struct {
-	ID                string  `json:"id"`
-	Type              string  `json:"type"`
-	Text              string  `json:"text"`
-	SuccessTransition *string `json:"success_transition"`
-	FailTransition    *string `json:"fail_transition"`
-	ExpectPhoto       bool    `json:"expect_photo,omitempty"`
+	ID                  string            `json:"id"`
+	Type                string            `json:"type"`
+	Text                string            `json:"text"`
+	Texts               map[string]string `json:"texts,omitempty"` // text per locale, falling back to Text
+	SuccessTransition   *string           `json:"success_transition"`
+	FailTransition      *string           `json:"fail_transition"`
+	ExpectPhoto         bool              `json:"expect_photo,omitempty"`
+	Options             []ConvOption      `json:"options,omitempty"`
+	Validation          *AnswerValidation `json:"validation,omitempty"`
+	RetryMessage        string            `json:"retry_message,omitempty"`
+	Branches            []ConvBranch      `json:"branches,omitempty"`
+	ParseMode           string            `json:"parse_mode,omitempty"` // "HTML", "MarkdownV2" or "Markdown" for formatted text
+	Inactivity          *ConvInactivity   `json:"inactivity,omitempty"`
+	Action              string            `json:"action,omitempty"` // registered action run on the answer, e.g. "auth.username"
+	ActionParams        map[string]string `json:"action_params,omitempty"`
+	BackButton          bool              `json:"back_button,omitempty"`          // offer a Back button under the node's message
+	Irreversible        bool              `json:"irreversible,omitempty"`         // /back cannot return past this node
+	ConsentVersion      string            `json:"consent_version,omitempty"`      // version of a consent node's text; changing it asks everyone again
+	MaxAttempts         int               `json:"max_attempts,omitempty"`         // failed attempts before giving up; questions default to max_retries
+	ExhaustedTransition *string           `json:"exhausted_transition,omitempty"` // where to go once the attempts are used up
+	Cooldown            *configDuration   `json:"cooldown,omitempty"`             // how long the chat must wait once the attempts are used up
+}
+
+// ConvBranch is one arm of a branch node: the first whose condition holds wins.
+type ConvBranch struct {
+	When       string    `json:"when"` // e.g. "smoker == 'yes' and age >= 18"
+	Transition string    `json:"transition"`
+	cond       condition // When parsed by buildConversation; nil when it does not parse
+}
+
+// AnswerValidation declares the rules a question's answer must follow.
+// Type is "text" (default), "int", "float", "enum" or "date".
+type AnswerValidation struct {
+	Type       string   `json:"type,omitempty"`
+	Pattern    string   `json:"pattern,omitempty"`     // regular expression the answer must match
+	Min        *float64 `json:"min,omitempty"`         // inclusive lower bound for int and float
+	Max        *float64 `json:"max,omitempty"`         // inclusive upper bound for int and float
+	Values     []string `json:"values,omitempty"`      // accepted answers for enum, matched case-insensitively
+	Format     string   `json:"format,omitempty"`      // date format such as "DD/MM/YYYY" (default "YYYY-MM-DD")
+	MaxLength  int      `json:"max_length,omitempty"`  // maximum answer length in characters
+	MaxRetries int      `json:"max_retries,omitempty"` // invalid answers before fail_transition (default 3)
+
+	pattern *regexp.Regexp // Pattern compiled by buildConversation; nil when it does not compile
+}
+
+// ConvOption is one answer offered by a choice node, rendered as an inline button.
+type ConvOption struct {
+	Label      string            `json:"label"`
+	Value      string            `json:"value,omitempty"`      // stored in Answers, defaults to Label
+	Transition *string           `json:"transition,omitempty"` // overrides the node's success_transition
+	Labels     map[string]string `json:"labels,omitempty"`     // label per locale, e.g. {"pt": "Sim"}
 }
 
 // AuthFile models the authentication JSON structure.
@@ -86,31 +201,86 @@ type AuthFile struct {
 type AuthUser struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Role     string `json:"role,omitempty"` // picks the user's default flow
 }
 
 // DiagnosisEntry captures a single screening outcome.
 type DiagnosisEntry struct {
-	PhotoPath string `json:"photo_path"`
-	Timestamp string `json:"timestamp"`
-	Verdict   bool   `json:"verdict"`
+	ID                  string            `json:"id,omitempty"`
+	PhotoPath           string            `json:"photo_path"`              // first photo of the case
+	PhotoPaths          []string          `json:"photo_paths,omitempty"`   // every photo when the case has several
+	FailedPhotos        []FailedPhoto     `json:"failed_photos,omitempty"` // album photos that could not be saved or classified
+	Timestamp           string            `json:"timestamp"`
+	Verdict             bool              `json:"verdict"`
+	Rationale           string            `json:"rationale"`
+	Answers             map[string]string `json:"answers,omitempty"`              // questionnaire answers, completed when the conversation ends
+	Flow                string            `json:"flow,omitempty"`                 // flow the case was screened in
+	ConversationVersion string            `json:"conversation_version,omitempty"` // version of conversation.json in use
+	TelegramUserID      int64             `json:"telegram_user_id,omitempty"`
+	ChatID              int64             `json:"chat_id,omitempty"`
+}
+
+// FailedPhoto is an album photo left out of the verdict, by its position in the album.
+type FailedPhoto struct {
+	Photo int    `json:"photo"`
+	Path  string `json:"path,omitempty"` // empty when the photo could not be saved
+	Error string `json:"error"`
+}
+
+// VerdictRecord is the outcome of the latest photo assessment of a chat.
+type VerdictRecord struct {
+	Positive  bool   `json:"positive"`
+	Summary   string `json:"summary"`
 	Rationale string `json:"rationale"`
 }
 
 // Node stores a normalized conversation node for runtime use.
 type Node struct {
-	ID                string
-	Type              string
-	Text              string
-	SuccessTransition *string
-	FailTransition    *string
-	ExpectPhoto       bool
+	ID                  string
+	Type                string
+	Text                string
+	Texts               map[string]string
+	SuccessTransition   *string
+	FailTransition      *string
+	ExpectPhoto         bool
+	Options             []ConvOption
+	Validation          *AnswerValidation
+	RetryMessage        string
+	Branches            []ConvBranch
+	ParseMode           string
+	Inactivity          *ConvInactivity
+	Action              string
+	ActionParams        map[string]string
+	BackButton          bool
+	Irreversible        bool
+	ConsentVersion      string
+	MaxAttempts         int
+	ExhaustedTransition *string
+	Cooldown            *configDuration
 }
 
 // ChatState tracks where a chat is within the scripted conversation flow.
+// A ChatState is only touched from its chat's dispatcher queue, so its fields
+// need no locking of their own; the states map is guarded by statesMu.
 type ChatState struct {
-	Awaiting string            // node ID awaiting a response
-	Answers  map[string]string // questionID -> answer text (reserved for future use)
-	Started  bool              // true once we've sent the initial greeting
-	Username string            // username supplied by chat
-	Authed   bool              // true once credentials verified
+	Awaiting      string            `json:"awaiting"`                 // node ID awaiting a response
+	Answers       map[string]string `json:"answers"`                  // questionID -> answer text (reserved for future use)
+	Started       bool              `json:"started"`                  // true once we've sent the initial greeting
+	Username      string            `json:"username"`                 // username supplied by chat
+	Authed        bool              `json:"authed"`                   // true once credentials verified
+	Attempts      map[string]int    `json:"attempts,omitempty"`       // nodeID -> failed attempts so far
+	FirstName     string            `json:"first_name,omitempty"`     // sender's first name, kept across restarts
+	LanguageCode  string            `json:"language_code,omitempty"`  // language reported by Telegram
+	Locale        string            `json:"locale,omitempty"`         // language picked with /language, overrides LanguageCode
+	LastVerdict   *VerdictRecord    `json:"last_verdict,omitempty"`   // latest photo assessment
+	LastActivity  time.Time         `json:"last_activity,omitempty"`  // last message or button press from the user
+	Flow          string            `json:"flow,omitempty"`           // flow the conversation was started in
+	Role          string            `json:"role,omitempty"`           // role of the signed-in user, from auth.json
+	History       []string          `json:"history,omitempty"`        // input nodes visited, most recent last, for /back
+	UserID        int64             `json:"user_id,omitempty"`        // Telegram user last seen writing in this chat
+	ConsentReturn string            `json:"consent_return,omitempty"` // node to resume after a consent the chat was sent to
+	CaseID        string            `json:"case_id,omitempty"`        // diagnosis recorded in this conversation, completed at its end
+	CooldownUntil time.Time         `json:"cooldown_until,omitempty"` // the chat is not served before this, after using up a node's attempts
+	Nudged        bool              `json:"nudged,omitempty"`         // inactivity reminder already sent since LastActivity
+	UpdatedAt     time.Time         `json:"updated_at"`               // last time the state was persisted
 }
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+)
+
+// nodeTemplates holds the parsed texts of every node of the running graph,
+// keyed by the raw text; it is swapped together with nodes under configMu.
+var nodeTemplates map[string]*template.Template
+
+// templateData is what a node's text can refer to, e.g.
+// "Thanks, {{.User.FirstName}}! You said you are {{.Answers.age}}."
+type templateData struct {
+	Username string            // login name given to the bot
+	Answers  map[string]string // answers collected so far, by node ID
+	User     templateUser
+	Verdict  templateVerdict // latest photo assessment of this chat
+}
+
+type templateUser struct {
+	FirstName string
+}
+
+type templateVerdict struct {
+	Available bool // false until a photo has been assessed
+	Positive  bool
+	Summary   string
+	Rationale string
+}
+
+// parseModes maps the parse modes nodes may use to the escaper applied to
+// every value inserted into their text.
+var parseModes = map[string]func(string) string{
+	"":           func(s string) string { return s },
+	"HTML":       strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace,
+	"MarkdownV2": backslashEscaper("_*[]()~`>#+-=|{}.!\\"),
+	"Markdown":   backslashEscaper("_*`["),
+}
+
+func backslashEscaper(special string) func(string) string {
+	pairs := make([]string, 0, 2*len(special))
+	for _, c := range special {
+		pairs = append(pairs, string(c), `\`+string(c))
+	}
+	return strings.NewReplacer(pairs...).Replace
+}
+
+// parseNodeTemplate parses a node's text; missing answers render as empty text.
+func parseNodeTemplate(id, text string) (*template.Template, error) {
+	return template.New(id).Option("missingkey=zero").Parse(text)
+}
+
+// checkNodeTemplate parses text and renders it once with empty data so
+// unknown fields are caught when the conversation is loaded.
+func checkNodeTemplate(id, text string) error {
+	tmpl, err := parseNodeTemplate(id, text)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(&strings.Builder{}, templateData{Answers: map[string]string{}})
+}
+
+// buildTemplates parses every localized text of every node; texts that do
+// not parse are left out and sent verbatim.
+func buildTemplates(nodes map[string]Node) map[string]*template.Template {
+	out := make(map[string]*template.Template, len(nodes))
+	for id, n := range nodes {
+		texts := []string{n.Text}
+		for _, t := range n.Texts {
+			texts = append(texts, t)
+		}
+		for _, text := range texts {
+			if !strings.Contains(text, "{{") {
+				continue
+			}
+			tmpl, err := parseNodeTemplate(id, text)
+			if err != nil {
+				log.Printf("node %s: invalid text template: %v", id, err)
+				continue
+			}
+			out[text] = tmpl
+		}
+	}
+	return out
+}
+
+// renderNodeText fills in n's text template for the chat and returns the
+// reply options matching the node's parse mode.
+func renderNodeText(st *ChatState, n Node) (string, ReplyOptions) {
+	opts := ReplyOptions{ParseMode: n.ParseMode}
+	text := nodeText(n, chatLocale(st))
+	if !strings.Contains(text, "{{") {
+		return text, opts
+	}
+
+	configMu.RLock()
+	tmpl := nodeTemplates[text]
+	configMu.RUnlock()
+	if tmpl == nil {
+		var err error
+		if tmpl, err = parseNodeTemplate(n.ID, text); err != nil {
+			log.Printf("node %s: invalid text template: %v", n.ID, err)
+			return text, opts
+		}
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, newTemplateData(st, n.ParseMode)); err != nil {
+		log.Printf("node %s: render text template: %v", n.ID, err)
+		return text, opts
+	}
+	return b.String(), opts
+}
+
+// newTemplateData exposes the chat's state with every value escaped for parseMode.
+func newTemplateData(st *ChatState, parseMode string) templateData {
+	esc, ok := parseModes[parseMode]
+	if !ok {
+		esc = parseModes[""]
+	}
+	data := templateData{
+		Username: esc(st.Username),
+		Answers:  make(map[string]string, len(st.Answers)),
+		User:     templateUser{FirstName: esc(st.FirstName)},
+	}
+	for k, v := range st.Answers {
+		data.Answers[k] = esc(v)
+	}
+	if v := st.LastVerdict; v != nil {
+		data.Verdict = templateVerdict{Available: true, Positive: v.Positive, Summary: esc(v.Summary), Rationale: esc(v.Rationale)}
+	}
+	return data
+}
+
+// sendNodeText sends rendered node text, using the options only when needed.
+func sendNodeText(chatID int64, text string, opts ReplyOptions) error {
+	if opts == (ReplyOptions{}) {
+		return sendReply(chatID, text)
+	}
+	return sendReplyWith(chatID, text, opts)
+}
+
+// checkParseMode reports parse modes Telegram would not understand.
+func checkParseMode(mode string) error {
+	if _, ok := parseModes[mode]; !ok {
+		return fmt.Errorf("unknown parse_mode %q (use HTML, MarkdownV2 or Markdown)", mode)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderNodeText(t *testing.T) {
+	resetGlobals()
+	st := &ChatState{
+		Username:    "maria.s",
+		FirstName:   "Maria",
+		Answers:     map[string]string{"age": "34", "notes": "<b>sore</b> & red"},
+		LastVerdict: &VerdictRecord{Positive: false, Summary: "No.", Rationale: "Looks healthy (mostly)."},
+	}
+
+	text, opts := renderNodeText(st, Node{ID: "confirm", Text: "Thanks, {{.User.FirstName}}! You are {{.Answers.age}}{{if .Answers.missing}} and {{.Answers.missing}}{{end}}."})
+	if text != "Thanks, Maria! You are 34." || opts.ParseMode != "" {
+		t.Fatalf("unexpected render %q %+v", text, opts)
+	}
+
+	text, opts = renderNodeText(st, Node{ID: "html", ParseMode: "HTML", Text: "<b>{{.Username}}</b>: {{.Answers.notes}}"})
+	if text != "<b>maria.s</b>: &lt;b&gt;sore&lt;/b&gt; &amp; red" || opts.ParseMode != "HTML" {
+		t.Fatalf("unexpected HTML render %q %+v", text, opts)
+	}
+
+	text, _ = renderNodeText(st, Node{ID: "md", ParseMode: "MarkdownV2", Text: "*{{.Username}}*{{if .Verdict.Available}} {{.Verdict.Rationale}}{{end}}"})
+	if text != `*maria\.s* Looks healthy \(mostly\)\.` {
+		t.Fatalf("unexpected MarkdownV2 render %q", text)
+	}
+
+	// Text without template actions is sent untouched.
+	if text, _ := renderNodeText(st, Node{ID: "plain", Text: "Hello {name}"}); text != "Hello {name}" {
+		t.Fatalf("plain text changed: %q", text)
+	}
+}
+
+func TestValidateConversationChecksTemplates(t *testing.T) {
+	cf := &ConversationFile{Messages: []ConvMessage{
+		{ID: "start", Type: "start_message", Text: "Hi {{.User.FirstName", SuccessTransition: strPtr("q")},
+		{ID: "q", Type: "question", Text: "Is {{.Usernme}} right?", FailTransition: strPtr("q"), SuccessTransition: strPtr("end")},
+		{ID: "end", Type: "end_message", Text: "Bye {{.Answers.q}}", ParseMode: "markdown"},
+	}}
+	issues := strings.Join(validateConversation(cf), "\n")
+	for _, want := range []string{
+		`node "start": invalid text template`,
+		`node "q": invalid text template`,
+		`node "end": unknown parse_mode "markdown"`,
+	} {
+		if !strings.Contains(issues, want) {
+			t.Errorf("missing issue %q in:\n%s", want, issues)
+		}
+	}
+	if strings.Contains(issues, `node "end": invalid text template`) {
+		t.Errorf("valid template reported:\n%s", issues)
+	}
+}
+
+func TestTemplatedGreetingUsesSenderName(t *testing.T) {
+	resetGlobals()
+	originalSend := sendReply
+	defer func() { sendReply = originalSend }()
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+	applyConversation(&ConversationFile{Messages: []ConvMessage{
+		{ID: "start", Type: "start_message", Text: "Hello {{.User.FirstName}}!", SuccessTransition: strPtr("age")},
+		{ID: "age", Type: "question", Text: "How old are you?", SuccessTransition: strPtr("confirm")},
+		{ID: "confirm", Type: "question", Text: "So you are {{.Answers.age}}, {{.User.FirstName}}?"},
+	}})
+
+	from := &User{ID: 1, FirstName: "Maria"}
+	for _, text := range []string{"/start", "34"} {
+		captureOutput(t, func() { printMessage(&Message{Chat: Chat{ID: 4}, From: from, Text: text}) })
+	}
+	want := []string{"Hello Maria!", "How old are you?", "So you are 34, Maria?"}
+	if strings.Join(sent, "|") != strings.Join(want, "|") {
+		t.Fatalf("got %q, want %q", sent, want)
+	}
+}
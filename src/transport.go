@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Transport connects the conversation engine to a messaging platform. Inbound
+// traffic is translated into Update values so the engine stays platform agnostic.
+type Transport interface {
+	// Run receives inbound updates and hands each one to deliver until it fails.
+	Run(deliver func(Update)) error
+	// SendText delivers a reply, rendering the inline keyboard when one is set.
+	SendText(chatID int64, text string, opts ReplyOptions) error
+	// AnswerCallback acknowledges a button press.
+	AnswerCallback(callbackID, text string) error
+	// DownloadMedia saves the image attached to msg and returns the local path.
+	DownloadMedia(ctx context.Context, msg *Message) (string, error)
+}
+
+// telegramTransport receives updates through getUpdates long polling or a webhook.
+type telegramTransport struct {
+	client  *http.Client
+	base    string
+	webhook *webhookConfig // nil selects long polling
+	tracker *updateTracker
+	accept  func(Update) bool // takes webhook updates, false asks Telegram to retry
+}
+
+func (t *telegramTransport) Run(deliver func(Update)) error {
+	if t.webhook != nil {
+		accept := t.accept
+		if accept == nil {
+			accept = func(u Update) bool {
+				deliver(u)
+				return true
+			}
+		}
+		return runWebhook(t.client, t.base, *t.webhook, accept)
+	}
+
+	// The committed offset only matters after a restart; from then on polling
+	// moves past every update already received so that slow chats never hold
+	// back the next batch. The tracker drops updates replayed after a restart.
+	offset := t.tracker.Offset()
+	log.Printf("starting telbot long-polling from offset %d...", offset)
+	for {
+		updates, err := getUpdates(t.client, t.base, offset, 30)
+		if err != nil {
+			log.Printf("getUpdates error: %v", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		for _, u := range updates {
+			if u.UpdateID >= offset {
+				offset = u.UpdateID + 1
+			}
+			deliver(u)
+		}
+	}
+}
+
+func (t *telegramTransport) SendText(chatID int64, text string, opts ReplyOptions) error {
+	return sendMessageWith(chatID, text, opts)
+}
+
+func (t *telegramTransport) AnswerCallback(callbackID, text string) error {
+	return answerCallbackQuery(callbackID, text)
+}
+
+func (t *telegramTransport) DownloadMedia(ctx context.Context, msg *Message) (string, error) {
+	return saveIncomingPhoto(ctx, msg)
+}
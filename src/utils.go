@@ -1,12 +1,64 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"mime"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
 )
 
+// allowedImageTypes lists the document MIME types accepted as screening images.
+var allowedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+	"image/heic": true,
+	"image/heif": true,
+}
+
+// extensionForMime picks a file extension for an image MIME type, defaulting to .jpg.
+func extensionForMime(mt string) string {
+	switch strings.ToLower(strings.TrimSpace(strings.SplitN(mt, ";", 2)[0])) {
+	case "image/png":
+		return ".png"
+	case "image/webp":
+		return ".webp"
+	case "image/heic":
+		return ".heic"
+	case "image/heif":
+		return ".heif"
+	}
+	return ".jpg"
+}
+
+// documentMimeType returns the declared MIME type of a document, falling back to
+// its file name extension.
+func documentMimeType(doc *Document) string {
+	if mt := strings.ToLower(strings.TrimSpace(doc.MimeType)); mt != "" {
+		return mt
+	}
+	if mt := mime.TypeByExtension(strings.ToLower(filepath.Ext(doc.FileName))); mt != "" {
+		if i := strings.Index(mt, ";"); i >= 0 {
+			mt = mt[:i]
+		}
+		return mt
+	}
+	return ""
+}
+
+// isImageDocument reports whether a document is an image we are willing to analyse.
+func isImageDocument(doc *Document) bool {
+	return doc != nil && allowedImageTypes[documentMimeType(doc)]
+}
+
+// hasImage reports whether a message carries a photo or an accepted image document.
+func hasImage(msg *Message) bool {
+	return len(msg.Photo) > 0 || isImageDocument(msg.Document)
+}
+
 func detectMimeType(data []byte, path string) string {
 	if len(data) > 0 {
 		mt := http.DetectContentType(data)
@@ -23,3 +75,30 @@ func detectMimeType(data []byte, path string) string {
 
 	return "image/jpeg"
 }
+
+// readLimited reads r fully, failing when it holds more than maxDownloadBytes.
+func readLimited(r io.Reader) ([]byte, error) {
+	if maxDownloadBytes > 0 {
+		r = io.LimitReader(r, maxDownloadBytes+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if maxDownloadBytes > 0 && int64(len(data)) > maxDownloadBytes {
+		return nil, fmt.Errorf("downloaded file exceeds max allowed %d bytes", maxDownloadBytes)
+	}
+	return data, nil
+}
+
+// writeAsset stores downloaded media in the assets directory and returns its path.
+func writeAsset(fileName string, data []byte) (string, error) {
+	if err := os.MkdirAll(assetsDir, 0755); err != nil {
+		return "", fmt.Errorf("create assets dir: %w", err)
+	}
+	localPath := filepath.Join(assetsDir, fileName)
+	if err := os.WriteFile(localPath, data, 0644); err != nil {
+		return "", fmt.Errorf("write photo: %w", err)
+	}
+	return localPath, nil
+}
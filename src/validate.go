@@ -0,0 +1,397 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// knownNodeTypes lists the node types the conversation engine can run.
+var knownNodeTypes = map[string]bool{
+	"start_message": true,
+	"question":      true,
+	"choice":        true,
+	"end_message":   true,
+	"branch":        true,
+	"consent":       true,
+}
+
+// transition is an outgoing edge of a conversation node.
+type transition struct {
+	Label  string
+	Target string
+}
+
+// nodeTransitions lists every edge leaving m, skipping unset transitions.
+func nodeTransitions(m ConvMessage) []transition {
+	var out []transition
+	add := func(label string, target *string) {
+		if target != nil && *target != "" {
+			out = append(out, transition{Label: label, Target: *target})
+		}
+	}
+	add("success_transition", m.SuccessTransition)
+	add("fail_transition", m.FailTransition)
+	add("exhausted_transition", m.ExhaustedTransition)
+	for _, o := range m.Options {
+		add(fmt.Sprintf("option %q transition", o.Label), o.Transition)
+	}
+	for i := range m.Branches {
+		add(fmt.Sprintf("branch %q transition", m.Branches[i].When), &m.Branches[i].Transition)
+	}
+	return out
+}
+
+// waitsForInput reports whether the engine stops at m until the user replies.
+func waitsForInput(m ConvMessage) bool {
+	switch m.Type {
+	case "start_message":
+		return m.ExpectPhoto
+	case "end_message", "branch":
+		return false
+	}
+	return true
+}
+
+// autoTransitions lists the nodes the engine moves on to from m without
+// waiting for the user.
+func autoTransitions(m ConvMessage) []string {
+	if waitsForInput(m) {
+		return nil
+	}
+	var out []string
+	if m.Type == "branch" {
+		for _, b := range m.Branches {
+			out = append(out, b.Transition)
+		}
+	}
+	if m.SuccessTransition != nil && *m.SuccessTransition != "" {
+		out = append(out, *m.SuccessTransition)
+	}
+	return out
+}
+
+// callbackData returns the longest callback data of each kind of button m shows.
+func callbackData(m ConvMessage) []string {
+	var data []string
+	if m.Type == "choice" && len(m.Options) > 0 {
+		data = append(data, choiceCallbackData(m.ID, len(m.Options)-1))
+	}
+	if m.Type == "consent" {
+		data = append(data, consentCallbackData(m.ID, false))
+	}
+	if m.BackButton {
+		data = append(data, backCallbackPrefix+m.ID)
+	}
+	return data
+}
+
+// validateConversation checks the conversation graph and describes every problem found.
+func validateConversation(cf *ConversationFile) []string {
+	var issues []string
+	report := func(format string, args ...interface{}) {
+		issues = append(issues, fmt.Sprintf(format, args...))
+	}
+
+	byID := make(map[string]ConvMessage, len(cf.Messages))
+	var order, starts []string
+	firstStart := ""
+	for _, m := range cf.Messages {
+		if m.ID == "" {
+			report("message of type %q has no id", m.Type)
+			continue
+		}
+		if _, dup := byID[m.ID]; dup {
+			report("node %q: duplicate id", m.ID)
+			continue
+		}
+		byID[m.ID] = m
+		order = append(order, m.ID)
+		if m.Type == "start_message" && firstStart == "" {
+			firstStart = m.ID
+		}
+	}
+
+	// start_message also serves as a plain informational step, so only those
+	// nothing leads to count as competing entry points.
+	targeted := make(map[string]bool)
+	for _, id := range order {
+		for _, t := range nodeTransitions(byID[id]) {
+			targeted[t.Target] = true
+		}
+	}
+	for _, c := range cf.Commands {
+		targeted[c.Node] = true
+	}
+	for _, id := range order {
+		if byID[id].Type == "start_message" && !targeted[id] {
+			starts = append(starts, id)
+		}
+	}
+
+	switch {
+	case len(cf.Messages) == 0:
+		report("conversation has no messages")
+		return issues
+	case firstStart == "":
+		report("no start_message node")
+	case len(starts) > 1 && len(cf.Flows) == 0:
+		report("multiple start nodes (start_message with no incoming transition): %s", strings.Join(starts, ", "))
+	}
+
+	for _, id := range order {
+		m := byID[id]
+		if !knownNodeTypes[m.Type] {
+			report("node %q: unknown type %q", id, m.Type)
+		}
+		for _, t := range nodeTransitions(m) {
+			if _, ok := byID[t.Target]; !ok {
+				report("node %q: %s points to unknown node %q", id, t.Label, t.Target)
+			}
+		}
+		if err := checkNodeTemplate(id, m.Text); err != nil {
+			report("node %q: invalid text template: %v", id, err)
+		}
+		for locale, text := range m.Texts {
+			if err := checkNodeTemplate(id, text); err != nil {
+				report("node %q: invalid %s text template: %v", id, locale, err)
+			}
+		}
+		if err := checkParseMode(m.ParseMode); err != nil {
+			report("node %q: %v", id, err)
+		}
+		if m.Type == "question" && (m.FailTransition == nil || *m.FailTransition == "") {
+			report("node %q: question has no fail_transition", id)
+		}
+		if m.Type == "branch" {
+			if len(m.Branches) == 0 && (m.SuccessTransition == nil || *m.SuccessTransition == "") {
+				report("node %q: branch has no branches and no success_transition", id)
+			}
+			for _, b := range m.Branches {
+				if _, err := parseCondition(b.When); err != nil {
+					report("node %q: invalid branch condition %q: %v", id, b.When, err)
+				}
+				if b.Transition == "" {
+					report("node %q: branch %q has no transition", id, b.When)
+				}
+			}
+		}
+		if m.Type == "consent" {
+			if m.ConsentVersion == "" {
+				report("node %q: consent has no consent_version", id)
+			}
+			if m.SuccessTransition == nil || *m.SuccessTransition == "" {
+				report("node %q: consent has no success_transition", id)
+			}
+		}
+		if m.BackButton && !waitsForInput(m) {
+			report("node %q: back_button needs a node that waits for an answer", id)
+		}
+		for _, data := range callbackData(m) {
+			if len(data) > maxCallbackData {
+				report("node %q: button data %q is longer than Telegram's %d bytes; shorten the node id", id, data, maxCallbackData)
+				break
+			}
+		}
+		for _, problem := range checkAction(m) {
+			report("node %q: %s", id, problem)
+		}
+		if in := m.Inactivity; in != nil {
+			if (in.NudgeAfter != nil && in.NudgeAfter.Duration < 0) || (in.ExpireAfter != nil && in.ExpireAfter.Duration < 0) {
+				report("node %q: inactivity durations must not be negative", id)
+			}
+			if in.NudgeAfter != nil && in.ExpireAfter != nil && in.ExpireAfter.Duration > 0 && in.NudgeAfter.Duration >= in.ExpireAfter.Duration {
+				report("node %q: inactivity nudge_after must be shorter than expire_after", id)
+			}
+		}
+		if m.MaxAttempts < 0 {
+			report("node %q: max_attempts must not be negative", id)
+		}
+		if m.Cooldown != nil && m.Cooldown.Duration < 0 {
+			report("node %q: cooldown must not be negative", id)
+		}
+		if m.MaxAttempts == 0 && m.Type != "question" && (m.ExhaustedTransition != nil || m.Cooldown != nil) {
+			report("node %q: exhausted_transition and cooldown need max_attempts", id)
+		}
+		if m.Validation != nil {
+			if m.Type != "question" {
+				report("node %q: validation is only supported on question nodes", id)
+			}
+			for _, problem := range checkValidation(m.Validation) {
+				report("node %q: %s", id, problem)
+			}
+		}
+	}
+	commandNames := make(map[string]bool)
+	for _, c := range cf.Commands {
+		name := strings.ToLower(strings.TrimPrefix(c.Command, "/"))
+		if _, ok := byID[c.Node]; !ok {
+			report("command /%s points to unknown node %q", name, c.Node)
+		}
+		switch {
+		case isBuiltinCommand(name):
+			report("command /%s is a built-in command", name)
+		case commandNames[name]:
+			report("command /%s is defined twice", name)
+		}
+		commandNames[name] = true
+	}
+	issues = append(issues, checkFlows(cf, byID)...)
+	if _, ok := byID[cf.FallbackNode]; cf.FallbackNode != "" && !ok {
+		report("fallback_node points to unknown node %q", cf.FallbackNode)
+	}
+
+	// Reachability from the node the loader starts at, plus flow and command entry points.
+	var queue []string
+	if firstStart != "" {
+		queue = append(queue, firstStart)
+	} else if len(order) > 0 {
+		queue = append(queue, order[0])
+	}
+	for _, f := range cf.Flows {
+		queue = append(queue, f.Start)
+	}
+	for _, c := range cf.Commands {
+		queue = append(queue, c.Node)
+	}
+	reached := make(map[string]bool)
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		m, ok := byID[id]
+		if !ok || reached[id] {
+			continue
+		}
+		reached[id] = true
+		for _, t := range nodeTransitions(m) {
+			queue = append(queue, t.Target)
+		}
+	}
+	for _, id := range order {
+		if !reached[id] {
+			report("node %q: unreachable from the start node", id)
+		}
+	}
+
+	issues = append(issues, inputlessLoops(cf)...)
+	return append(issues, consentConflicts(cf)...)
+}
+
+// consentConflicts reports consent nodes that ask for different
+// consent_versions. The engine keeps one consent version per conversation, so
+// such a conversation is never loaded, strict mode or not.
+func consentConflicts(cf *ConversationFile) []string {
+	versions := make(map[string]string) // version to first node using it
+	seen := make(map[string]bool)
+	for _, m := range cf.Messages {
+		if m.ID == "" || seen[m.ID] {
+			continue
+		}
+		seen[m.ID] = true
+		if m.Type == "consent" && m.ConsentVersion != "" && versions[m.ConsentVersion] == "" {
+			versions[m.ConsentVersion] = m.ID
+		}
+	}
+	if len(versions) < 2 {
+		return nil
+	}
+	var list []string
+	for v, id := range versions {
+		list = append(list, fmt.Sprintf("%s (%s)", v, id))
+	}
+	sort.Strings(list)
+	return []string{"consent nodes disagree on consent_version: " + strings.Join(list, ", ")}
+}
+
+// inputlessLoops describes every cycle made only of nodes that do not wait for
+// input. Such nodes move on right away, so the cycle would spin forever; a
+// conversation with one is never loaded, strict mode or not.
+func inputlessLoops(cf *ConversationFile) []string {
+	byID := make(map[string]ConvMessage, len(cf.Messages))
+	var order []string
+	for _, m := range cf.Messages {
+		if _, dup := byID[m.ID]; m.ID == "" || dup {
+			continue
+		}
+		byID[m.ID] = m
+		order = append(order, m.ID)
+	}
+
+	var loops []string
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	color := make(map[string]int)
+	var stack []string
+	var visit func(id string)
+	visit = func(id string) {
+		color[id] = visiting
+		stack = append(stack, id)
+		for _, next := range autoTransitions(byID[id]) {
+			m, ok := byID[next]
+			if !ok || waitsForInput(m) {
+				continue
+			}
+			switch color[next] {
+			case unvisited:
+				visit(next)
+			case visiting:
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == next {
+						cycle := append(append([]string(nil), stack[i:]...), next)
+						loops = append(loops, fmt.Sprintf("nodes %s loop without waiting for input", strings.Join(cycle, " -> ")))
+						break
+					}
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		color[id] = done
+	}
+	for _, id := range order {
+		if color[id] == unvisited && !waitsForInput(byID[id]) {
+			visit(id)
+		}
+	}
+	return loops
+}
+
+// runValidate implements the "validate" subcommand and returns the exit code.
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: telbot validate [conversation.json ...]")
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"configs/conversation.json"}
+	}
+
+	code := 0
+	for _, path := range paths {
+		cf, err := readConversation(path)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s: %v\n", path, err)
+			code = 1
+			continue
+		}
+		issues := validateConversation(cf)
+		for _, issue := range issues {
+			fmt.Fprintf(stdout, "%s: %s\n", path, issue)
+		}
+		if len(issues) > 0 {
+			code = 1
+			continue
+		}
+		fmt.Fprintf(stdout, "%s: ok (%d nodes)\n", path, len(cf.Messages))
+	}
+	return code
+}
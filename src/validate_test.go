@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConversationReportsProblems(t *testing.T) {
+	cf := &ConversationFile{
+		Messages: []ConvMessage{
+			{ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("name")},
+			{ID: "name", Type: "question", Text: "name?", SuccessTransition: strPtr("nmae")},
+			{ID: "name", Type: "question", Text: "again"},
+			{ID: "other", Type: "start_message", Text: "second start"},
+			{ID: "mystery", Type: "slider", Text: "?"},
+			{ID: "bye", Type: "end_message", Text: "bye", SuccessTransition: strPtr("again")},
+			{ID: "again", Type: "start_message", Text: "again", SuccessTransition: strPtr("bye")},
+		},
+		Commands: []ConvCommand{{Command: "faq", Node: "missing"}},
+	}
+
+	issues := strings.Join(validateConversation(cf), "\n")
+	for _, want := range []string{
+		`node "name": duplicate id`,
+		"multiple start nodes (start_message with no incoming transition): start, other",
+		`node "name": success_transition points to unknown node "nmae"`,
+		`node "name": question has no fail_transition`,
+		`node "mystery": unknown type "slider"`,
+		`command /faq points to unknown node "missing"`,
+		`node "other": unreachable from the start node`,
+		`node "mystery": unreachable from the start node`,
+		"nodes bye -> again -> bye loop without waiting for input",
+	} {
+		if !strings.Contains(issues, want) {
+			t.Errorf("missing issue %q in:\n%s", want, issues)
+		}
+	}
+	if strings.Count(issues, "loop without waiting") != 1 {
+		t.Errorf("loop reported more than once:\n%s", issues)
+	}
+}
+
+func TestValidateConversationAcceptsValidGraph(t *testing.T) {
+	cf := &ConversationFile{Messages: []ConvMessage{
+		{ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr("photo")},
+		{ID: "photo", Type: "start_message", Text: "send a photo", ExpectPhoto: true, SuccessTransition: strPtr("end"), FailTransition: strPtr("photo")},
+		{ID: "end", Type: "end_message", Text: "bye", SuccessTransition: strPtr("start")},
+	}}
+	// The end -> start loop is fine because the photo node waits for input.
+	if issues := validateConversation(cf); len(issues) != 0 {
+		t.Fatalf("unexpected issues: %v", issues)
+	}
+}
+
+func TestRunValidate(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.json")
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(good, []byte(`{"messages":[{"id":"start","type":"start_message","text":"hi","success_transition":"q"},{"id":"q","type":"question","text":"?","success_transition":"end","fail_transition":"q"},{"id":"end","type":"end_message","text":"bye"}]}`), 0o600)
+	os.WriteFile(bad, []byte(`{"messages":[{"id":"start","type":"start_message","text":"hi","success_transition":"gone"}]}`), 0o600)
+
+	var stdout, stderr bytes.Buffer
+	if code := runValidate([]string{good}, &stdout, &stderr); code != 0 {
+		t.Fatalf("expected exit 0, got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+	stdout.Reset()
+	if code := runValidate([]string{good, bad}, &stdout, &stderr); code != 1 {
+		t.Fatalf("expected exit 1, got %d", code)
+	}
+	if !strings.Contains(stdout.String(), `bad.json: node "start": success_transition points to unknown node "gone"`) {
+		t.Fatalf("unexpected output %q", stdout.String())
+	}
+}
+
+func TestValidateCallbackDataLength(t *testing.T) {
+	long := strings.Repeat("x", 56)
+	cf := &ConversationFile{Messages: []ConvMessage{
+		{ID: "start", Type: "start_message", Text: "hi", SuccessTransition: strPtr(long)},
+		{ID: long, Type: "choice", Text: "?", BackButton: true, SuccessTransition: strPtr("terms_" + long),
+			Options: []ConvOption{{Label: "a"}, {Label: "b"}}},
+		{ID: "terms_" + long, Type: "consent", Text: "ok?", ConsentVersion: "v1", SuccessTransition: strPtr("end")},
+		{ID: "end", Type: "end_message", Text: "bye"},
+	}}
+	issues := strings.Join(validateConversation(cf), "\n")
+	for _, want := range []string{
+		fmt.Sprintf(`node %q: button data "choice:%s:1" is longer`, long, long),
+		fmt.Sprintf(`node "terms_%s": button data "consent:terms_%s:decline" is longer`, long, long),
+	} {
+		if !strings.Contains(issues, want) {
+			t.Errorf("missing issue %q in:\n%s", want, issues)
+		}
+	}
+
+	// "back:" plus 56 bytes fits, so a shorter choice only trips on its options.
+	if data := callbackData(ConvMessage{ID: long, BackButton: true}); len(data) != 1 || len(data[0]) > maxCallbackData {
+		t.Fatalf("unexpected back button data %v", data)
+	}
+}
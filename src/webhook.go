@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// webhookSecretHeader carries the secret Telegram echoes back on every webhook call.
+const webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// webhookConfig describes how the bot receives updates through setWebhook.
+type webhookConfig struct {
+	URL      string // public URL registered with Telegram
+	Secret   string // expected value of the secret token header
+	Listen   string // local address the HTTP server binds to
+	CertFile string // optional TLS certificate, serves HTTPS when set
+	KeyFile  string // optional TLS key paired with CertFile
+}
+
+// webhookConfigFromEnv reads the webhook settings from environment variables.
+func webhookConfigFromEnv() (webhookConfig, error) {
+	cfg := webhookConfig{
+		URL:      os.Getenv("WEBHOOK_URL"),
+		Secret:   os.Getenv("WEBHOOK_SECRET"),
+		Listen:   os.Getenv("WEBHOOK_LISTEN"),
+		CertFile: os.Getenv("WEBHOOK_TLS_CERT"),
+		KeyFile:  os.Getenv("WEBHOOK_TLS_KEY"),
+	}
+	if cfg.URL == "" {
+		return cfg, fmt.Errorf("WEBHOOK_URL not set in environment")
+	}
+	if cfg.Listen == "" {
+		cfg.Listen = ":8080"
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return cfg, fmt.Errorf("WEBHOOK_TLS_CERT and WEBHOOK_TLS_KEY must be set together")
+	}
+	return cfg, nil
+}
+
+// webhookMaxPendingFromEnv reads WEBHOOK_MAX_PENDING, how many updates may be
+// in flight before the webhook asks Telegram to retry (default 1000).
+func webhookMaxPendingFromEnv() int {
+	v := os.Getenv("WEBHOOK_MAX_PENDING")
+	if v == "" {
+		return 1000
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Printf("invalid WEBHOOK_MAX_PENDING %q, using 1000", v)
+		return 1000
+	}
+	return n
+}
+
+// path returns the URL path the webhook server should answer on.
+func (c webhookConfig) path() string {
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+// setWebhook registers the webhook URL and secret token with the Telegram Bot API.
+func setWebhook(client *http.Client, base string, cfg webhookConfig) error {
+	values := url.Values{}
+	values.Set("url", cfg.URL)
+	if cfg.Secret != "" {
+		values.Set("secret_token", cfg.Secret)
+	}
+
+	resp, err := client.PostForm(base+"setWebhook", values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("setWebhook status %d: %s", resp.StatusCode, string(b))
+	}
+
+	var r struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return err
+	}
+	if !r.OK {
+		return fmt.Errorf("telegram setWebhook returned ok=false: %s", r.Description)
+	}
+	return nil
+}
+
+// webhookHandler validates the secret token and hands each decoded update to deliver.
+// deliver reports false when the update cannot be accepted right now, which makes
+// Telegram retry the delivery later.
+func webhookHandler(secret string, deliver func(Update) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if secret != "" {
+			got := r.Header.Get(webhookSecretHeader)
+			if subtle.ConstantTimeCompare([]byte(got), []byte(secret)) != 1 {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		var u Update
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			http.Error(w, "invalid update payload", http.StatusBadRequest)
+			return
+		}
+		if !deliver(u) {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// webhookUpdates deduplicates webhook updates by ID. Telegram sends webhooks in
+// parallel and retries them out of order, so unlike polling there is no
+// watermark: each update ID is tracked on its own.
+type webhookUpdates struct {
+	mu       sync.Mutex
+	limit    int // updates in flight before new ones are refused
+	inflight map[int]bool
+	done     *recentIDs
+}
+
+// newWebhookUpdates accepts up to limit updates in flight (minimum 1).
+func newWebhookUpdates(limit int) *webhookUpdates {
+	if limit < 1 {
+		limit = 1
+	}
+	return &webhookUpdates{limit: limit, inflight: make(map[int]bool), done: newRecentIDs(4096)}
+}
+
+// Begin reports whether the update is new, marking it in flight.
+func (w *webhookUpdates) Begin(updateID int) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.inflight[updateID] || w.done.Has(strconv.Itoa(updateID)) {
+		return false
+	}
+	w.inflight[updateID] = true
+	return true
+}
+
+// Finish marks an update as handled.
+func (w *webhookUpdates) Finish(updateID int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.inflight, updateID)
+	w.done.Add(strconv.Itoa(updateID))
+}
+
+// Submit queues u for the chat's worker, or reports false when too many
+// updates are in flight so that Telegram delivers it again later.
+func (w *webhookUpdates) Submit(workers *dispatcher, u Update) bool {
+	w.mu.Lock()
+	busy := len(w.inflight) >= w.limit
+	w.mu.Unlock()
+	if busy {
+		log.Printf("webhook busy, refusing update %d for a retry", u.UpdateID)
+		return false
+	}
+	submitUpdate(workers, w, u)
+	return true
+}
+
+// runWebhook registers the webhook and serves incoming updates until the server stops.
+// Each decoded update is passed to deliver; false answers 503 so Telegram retries it.
+func runWebhook(client *http.Client, base string, cfg webhookConfig, deliver func(Update) bool) error {
+	if cfg.Secret == "" {
+		log.Printf("warning: WEBHOOK_SECRET not set, webhook requests will not be authenticated")
+	}
+	if err := setWebhook(client, base, cfg); err != nil {
+		return fmt.Errorf("register webhook: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.path(), webhookHandler(cfg.Secret, deliver))
+
+	server := &http.Server{Addr: cfg.Listen, Handler: mux}
+	log.Printf("starting telbot webhook server on %s (path %s)...", cfg.Listen, cfg.path())
+	if cfg.CertFile != "" {
+		return server.ListenAndServeTLS(cfg.CertFile, cfg.KeyFile)
+	}
+	return server.ListenAndServe()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetWebhookRegistersURLAndSecret(t *testing.T) {
+	var gotURL, gotSecret string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/botTOKEN/setWebhook" {
+			t.Fatalf("unexpected path: %s", r.URL.Path)
+		}
+		if err := r.ParseForm(); err != nil {
+			t.Fatalf("parse form: %v", err)
+		}
+		gotURL = r.PostForm.Get("url")
+		gotSecret = r.PostForm.Get("secret_token")
+		_, _ = w.Write([]byte(`{"ok":true,"result":true}`))
+	}))
+	defer server.Close()
+
+	cfg := webhookConfig{URL: "https://bot.example.com/telegram/hook", Secret: "s3cret"}
+	if err := setWebhook(server.Client(), server.URL+"/botTOKEN/", cfg); err != nil {
+		t.Fatalf("setWebhook returned error: %v", err)
+	}
+	if gotURL != cfg.URL {
+		t.Fatalf("url mismatch: %q", gotURL)
+	}
+	if gotSecret != "s3cret" {
+		t.Fatalf("secret mismatch: %q", gotSecret)
+	}
+	if cfg.path() != "/telegram/hook" {
+		t.Fatalf("unexpected webhook path %q", cfg.path())
+	}
+}
+
+func TestWebhookHandlerChecksSecret(t *testing.T) {
+	var delivered []Update
+	handler := webhookHandler("s3cret", func(u Update) bool {
+		delivered = append(delivered, u)
+		return true
+	})
+	body := `{"update_id":42,"message":{"message_id":1,"chat":{"id":7},"text":"hi"}}`
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set(webhookSecretHeader, "wrong")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for bad secret, got %d", rec.Code)
+	}
+	if len(delivered) != 0 {
+		t.Fatalf("update delivered despite bad secret")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set(webhookSecretHeader, "s3cret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if len(delivered) != 1 || delivered[0].UpdateID != 42 || delivered[0].Message.Text != "hi" {
+		t.Fatalf("unexpected delivered updates: %#v", delivered)
+	}
+}
+
+func TestWebhookHandlerFeedsConversation(t *testing.T) {
+	resetGlobals()
+	originalSend := sendReply
+	defer func() { sendReply = originalSend }()
+
+	var sent []string
+	sendReply = func(id int64, text string) error {
+		sent = append(sent, text)
+		return nil
+	}
+	nodes = map[string]Node{
+		"start": {ID: "start", Type: "start_message", Text: "welcome"},
+	}
+	startNodeID = "start"
+
+	handler := webhookHandler("", func(u Update) bool {
+		handleUpdate(u)
+		return true
+	})
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"update_id":1,"message":{"message_id":1,"chat":{"id":9},"text":"hello"}}`))
+	rec := httptest.NewRecorder()
+	captureOutput(t, func() { handler.ServeHTTP(rec, req) })
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if len(sent) != 1 || sent[0] != "welcome" {
+		t.Fatalf("expected start message to be sent, got %v", sent)
+	}
+}
+
+func TestWebhookUpdatesDedupByExactID(t *testing.T) {
+	w := newWebhookUpdates(10)
+	// Telegram retried update 6 after 7 was already handled.
+	if !w.Begin(7) {
+		t.Fatal("expected update 7 to be new")
+	}
+	w.Finish(7)
+	if !w.Begin(6) {
+		t.Fatal("an earlier update arriving late must still be handled")
+	}
+	if w.Begin(6) || w.Begin(7) {
+		t.Fatal("expected in-flight and handled updates to be skipped")
+	}
+	w.Finish(6)
+	if w.Begin(6) {
+		t.Fatal("expected a handled update to be skipped")
+	}
+}
+
+func TestWebhookAsksForRetryWhenBusy(t *testing.T) {
+	w := newWebhookUpdates(1)
+	w.Begin(1) // still being handled
+	handler := webhookHandler("", func(u Update) bool { return w.Submit(newDispatcher(1), u) })
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"update_id":2,"message":{"chat":{"id":7},"text":"hi"}}`))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 so Telegram retries, got %d", rec.Code)
+	}
+	if !w.Begin(2) {
+		t.Fatal("a refused update must not count as handled")
+	}
+}
+
+func TestPollingMovesPastUpdatesStillInFlight(t *testing.T) {
+	offsets := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case offsets <- r.URL.Query().Get("offset"):
+		default:
+		}
+		if r.URL.Query().Get("offset") == "10" {
+			_, _ = w.Write([]byte(`{"ok":true,"result":[{"update_id":10},{"update_id":11}]}`))
+			return
+		}
+		time.Sleep(10 * time.Millisecond) // long poll with nothing new
+		_, _ = w.Write([]byte(`{"ok":true,"result":[]}`))
+	}))
+	defer server.Close()
+
+	store := fileOffsetStore{path: filepath.Join(t.TempDir(), "offset.json")}
+	if err := store.Save(offsetState{Offset: 10}); err != nil {
+		t.Fatal(err)
+	}
+	tracker, _ := newUpdateTracker(store)
+	tt := &telegramTransport{client: server.Client(), base: server.URL + "/", tracker: tracker}
+	// Nothing finishes, as with a slow classification.
+	go tt.Run(func(u Update) { tracker.Begin(u.UpdateID) })
+
+	for _, want := range []string{"10", "12"} {
+		select {
+		case got := <-offsets:
+			if got != want {
+				t.Fatalf("polled offset %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no poll with offset %s", want)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// whatsappConfig holds the WhatsApp Cloud API credentials and webhook settings.
+type whatsappConfig struct {
+	APIURL        string // Graph API base including version, e.g. https://graph.facebook.com/v19.0
+	Token         string // permanent or system-user access token
+	PhoneNumberID string // sender phone number ID
+	VerifyToken   string // echoed by Meta when subscribing the webhook
+	AppSecret     string // optional, enables X-Hub-Signature-256 checks
+	Listen        string
+	Path          string
+}
+
+// whatsappConfigFromEnv reads the WhatsApp settings from environment variables.
+func whatsappConfigFromEnv() (whatsappConfig, error) {
+	cfg := whatsappConfig{
+		APIURL:        strings.TrimRight(os.Getenv("WHATSAPP_API_URL"), "/"),
+		Token:         os.Getenv("WHATSAPP_TOKEN"),
+		PhoneNumberID: os.Getenv("WHATSAPP_PHONE_NUMBER_ID"),
+		VerifyToken:   os.Getenv("WHATSAPP_VERIFY_TOKEN"),
+		AppSecret:     os.Getenv("WHATSAPP_APP_SECRET"),
+		Listen:        os.Getenv("WHATSAPP_LISTEN"),
+		Path:          os.Getenv("WHATSAPP_WEBHOOK_PATH"),
+	}
+	if cfg.Token == "" || cfg.PhoneNumberID == "" || cfg.VerifyToken == "" {
+		return cfg, fmt.Errorf("WHATSAPP_TOKEN, WHATSAPP_PHONE_NUMBER_ID and WHATSAPP_VERIFY_TOKEN must be set")
+	}
+	if cfg.APIURL == "" {
+		cfg.APIURL = "https://graph.facebook.com/v19.0"
+	}
+	if cfg.Listen == "" {
+		cfg.Listen = ":8080"
+	}
+	if cfg.Path == "" {
+		cfg.Path = "/whatsapp/webhook"
+	}
+	return cfg, nil
+}
+
+// whatsappTransport talks to the WhatsApp Cloud API. Chats are keyed by the
+// sender's wa_id (their phone number in international format).
+type whatsappTransport struct {
+	cfg    whatsappConfig
+	client *http.Client
+	seen   *recentIDs // message IDs already delivered
+}
+
+func newWhatsAppTransport(cfg whatsappConfig, client *http.Client) *whatsappTransport {
+	return &whatsappTransport{cfg: cfg, client: client, seen: newRecentIDs(4096)}
+}
+
+// recentIDs remembers the most recent message IDs, forgetting the oldest
+// once limit is reached.
+type recentIDs struct {
+	mu    sync.Mutex
+	limit int
+	ids   map[string]bool
+	order []string
+}
+
+func newRecentIDs(limit int) *recentIDs {
+	return &recentIDs{limit: limit, ids: make(map[string]bool)}
+}
+
+// Has reports whether id was recorded and not forgotten yet.
+func (r *recentIDs) Has(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ids[id]
+}
+
+// Add records id and reports whether it was new. An empty ID is always new.
+func (r *recentIDs) Add(id string) bool {
+	if id == "" {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ids[id] {
+		return false
+	}
+	if len(r.order) >= r.limit {
+		delete(r.ids, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.ids[id] = true
+	r.order = append(r.order, id)
+	return true
+}
+
+// dropDelivered removes the messages of p that were already delivered. Meta
+// sends a notification again when it is not acknowledged in time, so the same
+// message can arrive more than once.
+func (t *whatsappTransport) dropDelivered(p *waWebhookPayload) {
+	for i := range p.Entry {
+		for j := range p.Entry[i].Changes {
+			value := &p.Entry[i].Changes[j].Value
+			fresh := value.Messages[:0]
+			for _, wm := range value.Messages {
+				if t.seen.Add(wm.ID) {
+					fresh = append(fresh, wm)
+				} else {
+					log.Printf("whatsapp: skipping already delivered message %s", wm.ID)
+				}
+			}
+			value.Messages = fresh
+		}
+	}
+}
+
+// waWebhookPayload mirrors the parts of a Cloud API webhook notification we use.
+type waWebhookPayload struct {
+	Entry []struct {
+		Changes []struct {
+			Value struct {
+				Contacts []struct {
+					WaID    string `json:"wa_id"`
+					Profile struct {
+						Name string `json:"name"`
+					} `json:"profile"`
+				} `json:"contacts"`
+				Messages []waMessage `json:"messages"`
+			} `json:"value"`
+		} `json:"changes"`
+	} `json:"entry"`
+}
+
+// waMessage is a single inbound WhatsApp message.
+type waMessage struct {
+	From      string `json:"from"`
+	ID        string `json:"id"`
+	Timestamp string `json:"timestamp"`
+	Type      string `json:"type"`
+	Text      *struct {
+		Body string `json:"body"`
+	} `json:"text"`
+	Image       *waMedia `json:"image"`
+	Document    *waMedia `json:"document"`
+	Interactive *struct {
+		ButtonReply *waReply `json:"button_reply"`
+		ListReply   *waReply `json:"list_reply"`
+	} `json:"interactive"`
+}
+
+// waMedia references an uploaded image or document by media ID.
+type waMedia struct {
+	ID       string `json:"id"`
+	MimeType string `json:"mime_type"`
+	Filename string `json:"filename"`
+	Caption  string `json:"caption"`
+}
+
+// waReply is the button or list row a user picked.
+type waReply struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+func (t *whatsappTransport) Run(deliver func(Update)) error {
+	mux := http.NewServeMux()
+	mux.Handle(t.cfg.Path, t.webhookHandler(deliver))
+	server := &http.Server{Addr: t.cfg.Listen, Handler: mux}
+	log.Printf("starting telbot WhatsApp webhook on %s (path %s)...", t.cfg.Listen, t.cfg.Path)
+	return server.ListenAndServe()
+}
+
+// webhookHandler answers Meta's subscription handshake and converts inbound
+// messages into updates for deliver.
+func (t *whatsappTransport) webhookHandler(deliver func(Update)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			q := r.URL.Query()
+			if q.Get("hub.mode") != "subscribe" || q.Get("hub.verify_token") != t.cfg.VerifyToken {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			_, _ = io.WriteString(w, q.Get("hub.challenge"))
+		case http.MethodPost:
+			body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+			if err != nil {
+				http.Error(w, "read error", http.StatusBadRequest)
+				return
+			}
+			if t.cfg.AppSecret != "" && !validHubSignature(t.cfg.AppSecret, body, r.Header.Get("X-Hub-Signature-256")) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			var payload waWebhookPayload
+			if err := json.Unmarshal(body, &payload); err != nil {
+				http.Error(w, "invalid payload", http.StatusBadRequest)
+				return
+			}
+			t.dropDelivered(&payload)
+			for _, u := range whatsappUpdates(payload) {
+				deliver(u)
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// validHubSignature checks the sha256 HMAC Meta sends in X-Hub-Signature-256.
+func validHubSignature(secret string, body []byte, header string) bool {
+	sig, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil || len(sig) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// whatsappUpdates translates a webhook payload into engine updates. Status
+// notifications (sent, delivered, read) carry no messages and are ignored.
+func whatsappUpdates(p waWebhookPayload) []Update {
+	var updates []Update
+	for _, entry := range p.Entry {
+		for _, change := range entry.Changes {
+			names := make(map[string]string)
+			for _, c := range change.Value.Contacts {
+				names[c.WaID] = c.Profile.Name
+			}
+			for _, wm := range change.Value.Messages {
+				chatID, err := strconv.ParseInt(wm.From, 10, 64)
+				if err != nil {
+					log.Printf("whatsapp: unexpected sender %q: %v", wm.From, err)
+					continue
+				}
+				date, _ := strconv.ParseInt(wm.Timestamp, 10, 64)
+				from := &User{ID: int(chatID), FirstName: names[wm.From], Username: wm.From}
+				msg := &Message{
+					From: from,
+					Chat: Chat{ID: chatID, Type: "private", Username: wm.From},
+					Date: date,
+				}
+
+				switch wm.Type {
+				case "text":
+					if wm.Text != nil {
+						msg.Text = wm.Text.Body
+					}
+				case "image":
+					if wm.Image != nil {
+						msg.Text = wm.Image.Caption
+						msg.Photo = []PhotoSize{{FileID: wm.Image.ID}}
+					}
+				case "document":
+					if wm.Document != nil {
+						msg.Text = wm.Document.Caption
+						msg.Document = &Document{FileID: wm.Document.ID, FileName: wm.Document.Filename, MimeType: wm.Document.MimeType}
+					}
+				case "interactive":
+					var reply *waReply
+					if wm.Interactive != nil {
+						reply = wm.Interactive.ButtonReply
+						if reply == nil {
+							reply = wm.Interactive.ListReply
+						}
+					}
+					if reply != nil {
+						updates = append(updates, Update{CallbackQuery: &CallbackQuery{ID: wm.ID, From: from, Message: msg, Data: reply.ID}})
+						continue
+					}
+				default:
+					log.Printf("whatsapp: ignoring %s message from %s", wm.Type, wm.From)
+					continue
+				}
+				updates = append(updates, Update{Message: msg})
+			}
+		}
+	}
+	return updates
+}
+
+// SendText posts a text message; an inline keyboard becomes reply buttons
+// (up to three) or a list message.
+func (t *whatsappTransport) SendText(chatID int64, text string, opts ReplyOptions) error {
+	payload := map[string]any{
+		"messaging_product": "whatsapp",
+		"to":                strconv.FormatInt(chatID, 10),
+	}
+
+	var buttons []InlineKeyboardButton
+	if opts.ReplyMarkup != nil {
+		for _, row := range opts.ReplyMarkup.InlineKeyboard {
+			buttons = append(buttons, row...)
+		}
+	}
+
+	switch {
+	case len(buttons) == 0:
+		payload["type"] = "text"
+		payload["text"] = map[string]any{"body": text}
+	case len(buttons) <= 3:
+		var replies []map[string]any
+		for _, b := range buttons {
+			replies = append(replies, map[string]any{
+				"type":  "reply",
+				"reply": map[string]string{"id": b.CallbackData, "title": truncateRunes(b.Text, 20)},
+			})
+		}
+		payload["type"] = "interactive"
+		payload["interactive"] = map[string]any{
+			"type":   "button",
+			"body":   map[string]string{"text": text},
+			"action": map[string]any{"buttons": replies},
+		}
+	default:
+		var rows []map[string]string
+		for _, b := range buttons {
+			rows = append(rows, map[string]string{"id": b.CallbackData, "title": truncateRunes(b.Text, 24)})
+		}
+		button := opts.ListButton
+		if button == "" {
+			button = msg(defaultLocale, "choice.list_button")
+		}
+		payload["type"] = "interactive"
+		payload["interactive"] = map[string]any{
+			"type": "list",
+			"body": map[string]string{"text": text},
+			"action": map[string]any{
+				"button":   truncateRunes(button, 20),
+				"sections": []map[string]any{{"rows": rows}},
+			},
+		}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.cfg.APIURL+"/"+t.cfg.PhoneNumberID+"/messages", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+t.cfg.Token)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return newAPIError("whatsapp messages", resp.StatusCode, body)
+	}
+	return nil
+}
+
+// AnswerCallback is a no-op: WhatsApp has no acknowledgement for reply buttons.
+func (t *whatsappTransport) AnswerCallback(callbackID, text string) error {
+	return nil
+}
+
+// DownloadMedia resolves the media ID to a temporary URL and saves the file.
+func (t *whatsappTransport) DownloadMedia(ctx context.Context, msg *Message) (string, error) {
+	var mediaID string
+	switch {
+	case len(msg.Photo) > 0:
+		mediaID = msg.Photo[len(msg.Photo)-1].FileID
+	case isImageDocument(msg.Document):
+		mediaID = msg.Document.FileID
+	default:
+		return "", fmt.Errorf("message does not contain photo data")
+	}
+
+	var info struct {
+		URL      string `json:"url"`
+		MimeType string `json:"mime_type"`
+		FileSize int64  `json:"file_size"`
+	}
+	resp, err := t.get(ctx, t.cfg.APIURL+"/"+url.PathEscape(mediaID))
+	if err != nil {
+		return "", fmt.Errorf("media lookup: %w", err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	resp.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("decode media lookup: %w", err)
+	}
+	if info.URL == "" {
+		return "", fmt.Errorf("whatsapp media lookup returned no url")
+	}
+	if info.FileSize > 0 && maxDownloadBytes > 0 && info.FileSize > maxDownloadBytes {
+		return "", fmt.Errorf("file size %d exceeds max allowed %d", info.FileSize, maxDownloadBytes)
+	}
+
+	dl, err := t.get(ctx, info.URL)
+	if err != nil {
+		return "", fmt.Errorf("download media: %w", err)
+	}
+	defer dl.Body.Close()
+	data, err := readLimited(dl.Body)
+	if err != nil {
+		return "", fmt.Errorf("read photo data: %w", err)
+	}
+
+	ext := extensionForMime(info.MimeType)
+	fileName := fmt.Sprintf("%d_%d_%s%s", msg.Chat.ID, msg.Date, sanitizeFileComponent(mediaID), ext)
+	return writeAsset(fileName, data)
+}
+
+// get performs an authenticated GET against the Graph API or a media URL.
+func (t *whatsappTransport) get(ctx context.Context, target string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+t.cfg.Token)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	return resp, nil
+}
+
+// truncateRunes shortens s to at most n runes, as WhatsApp rejects long button titles.
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n])
+}
+
+// sanitizeFileComponent keeps only characters that are safe in a file name.
+func sanitizeFileComponent(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWhatsAppWebhookVerification(t *testing.T) {
+	wa := newWhatsAppTransport(whatsappConfig{VerifyToken: "verify-me"}, http.DefaultClient)
+	handler := wa.webhookHandler(func(Update) {})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?hub.mode=subscribe&hub.verify_token=verify-me&hub.challenge=12345", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "12345" {
+		t.Fatalf("expected challenge echo, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?hub.mode=subscribe&hub.verify_token=nope&hub.challenge=1", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for wrong verify token, got %d", rec.Code)
+	}
+}
+
+func TestWhatsAppInboundMessagesBecomeUpdates(t *testing.T) {
+	wa := newWhatsAppTransport(whatsappConfig{AppSecret: "app-secret"}, http.DefaultClient)
+	var got []Update
+	handler := wa.webhookHandler(func(u Update) { got = append(got, u) })
+
+	body := `{"object":"whatsapp_business_account","entry":[{"changes":[{"field":"messages","value":{
+		"contacts":[{"wa_id":"5511988887777","profile":{"name":"Maria"}}],
+		"messages":[
+			{"from":"5511988887777","id":"wamid.1","timestamp":"1700000000","type":"text","text":{"body":"oi"}},
+			{"from":"5511988887777","id":"wamid.2","timestamp":"1700000001","type":"image","image":{"id":"media-1","mime_type":"image/jpeg"}},
+			{"from":"5511988887777","id":"wamid.3","timestamp":"1700000002","type":"interactive","interactive":{"type":"button_reply","button_reply":{"id":"choice:smoker:0","title":"Sim"}}}
+		]}}]}]}`
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("X-Hub-Signature-256", "sha256=deadbeef")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden || len(got) != 0 {
+		t.Fatalf("expected bad signature to be rejected, got %d with %d updates", rec.Code, len(got))
+	}
+
+	mac := hmac.New(sha256.New, []byte("app-secret"))
+	mac.Write([]byte(body))
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	if len(got) != 3 {
+		t.Fatalf("expected three updates, got %d", len(got))
+	}
+	if m := got[0].Message; m == nil || m.Chat.ID != 5511988887777 || m.Text != "oi" || m.From.FirstName != "Maria" {
+		t.Fatalf("unexpected text update: %#v", got[0].Message)
+	}
+	if m := got[1].Message; m == nil || len(m.Photo) != 1 || m.Photo[0].FileID != "media-1" {
+		t.Fatalf("unexpected image update: %#v", got[1].Message)
+	}
+	if cq := got[2].CallbackQuery; cq == nil || cq.Data != "choice:smoker:0" || cq.Message.Chat.ID != 5511988887777 {
+		t.Fatalf("unexpected button update: %#v", got[2].CallbackQuery)
+	}
+
+	// A redelivered notification is acknowledged without handling its messages again.
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || len(got) != 3 {
+		t.Fatalf("expected the redelivery to be skipped, got %d with %d updates", rec.Code, len(got))
+	}
+}
+
+func TestRecentIDsForgetsTheOldest(t *testing.T) {
+	r := newRecentIDs(2)
+	if !r.Add("a") || !r.Add("b") || r.Add("a") {
+		t.Fatal("expected a and b to be new once")
+	}
+	r.Add("c")
+	if !r.Add("a") || r.Add("c") || !r.Add("") || !r.Add("") {
+		t.Fatal("expected a to be forgotten once c was added, and empty IDs never deduplicated")
+	}
+}
+
+func TestWhatsAppSendAndDownload(t *testing.T) {
+	originalAssets, originalMax := assetsDir, maxDownloadBytes
+	defer func() { assetsDir, maxDownloadBytes = originalAssets, originalMax }()
+	assetsDir = t.TempDir()
+	maxDownloadBytes = 1024
+
+	var sent []map[string]any
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer wa-token" {
+			t.Fatalf("missing bearer token on %s", r.URL.Path)
+		}
+		switch r.URL.Path {
+		case "/v19.0/PHONE/messages":
+			var payload map[string]any
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				t.Fatalf("decode send payload: %v", err)
+			}
+			sent = append(sent, payload)
+			_, _ = w.Write([]byte(`{"messages":[{"id":"wamid.out"}]}`))
+		case "/v19.0/media-1":
+			_, _ = w.Write([]byte(`{"url":"` + server.URL + `/download/media-1","mime_type":"image/png","file_size":3}`))
+		case "/download/media-1":
+			_, _ = w.Write([]byte("png"))
+		default:
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	wa := newWhatsAppTransport(whatsappConfig{APIURL: server.URL + "/v19.0", Token: "wa-token", PhoneNumberID: "PHONE"}, server.Client())
+
+	if err := wa.SendText(5511988887777, "Olá", ReplyOptions{}); err != nil {
+		t.Fatalf("SendText: %v", err)
+	}
+	keyboard := choiceKeyboard(Node{ID: "smoker", Options: []ConvOption{{Label: "Sim"}, {Label: "Não"}}}, "")
+	if err := wa.SendText(5511988887777, "Você fuma?", ReplyOptions{ReplyMarkup: keyboard}); err != nil {
+		t.Fatalf("SendText with keyboard: %v", err)
+	}
+	list := choiceKeyboard(Node{ID: "freq", Options: []ConvOption{{Label: "1"}, {Label: "2"}, {Label: "3"}, {Label: "4"}}}, "pt")
+	if err := wa.SendText(5511988887777, "Quantas vezes?", ReplyOptions{ReplyMarkup: list, ListButton: msg("pt", "choice.list_button")}); err != nil {
+		t.Fatalf("SendText with list: %v", err)
+	}
+	if len(sent) != 3 || sent[0]["type"] != "text" || sent[0]["to"] != "5511988887777" {
+		t.Fatalf("unexpected text payload: %v", sent)
+	}
+	if sent[1]["type"] != "interactive" {
+		t.Fatalf("expected interactive buttons, got %v", sent[1])
+	}
+	interactive, _ := sent[2]["interactive"].(map[string]any)
+	action, _ := interactive["action"].(map[string]any)
+	if interactive["type"] != "list" || action["button"] != "Opções" {
+		t.Fatalf("expected a list opened by the localized button, got %v", sent[2])
+	}
+
+	path, err := wa.DownloadMedia(context.Background(), &Message{Chat: Chat{ID: 55}, Date: 1, Photo: []PhotoSize{{FileID: "media-1"}}})
+	if err != nil {
+		t.Fatalf("DownloadMedia: %v", err)
+	}
+	if !strings.HasSuffix(path, ".png") {
+		t.Fatalf("expected png extension, got %s", path)
+	}
+	f, _ := os.Open(path)
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "png" {
+		t.Fatalf("unexpected media content %q", data)
+	}
+}
+
+func TestConversationRunsOverWhatsApp(t *testing.T) {
+	resetGlobals()
+	originalSend := sendReply
+	defer func() { sendReply = originalSend }()
+
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Text struct {
+				Body string `json:"body"`
+			} `json:"text"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		bodies = append(bodies, payload.Text.Body)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	wa := newWhatsAppTransport(whatsappConfig{APIURL: server.URL, Token: "t", PhoneNumberID: "P", VerifyToken: "v"}, server.Client())
+	sendReply = func(chatID int64, text string) error { return wa.SendText(chatID, text, ReplyOptions{}) }
+
+	nodes = map[string]Node{
+		"start": {ID: "start", Type: "start_message", Text: "Bem-vindo", SuccessTransition: strPtr("name")},
+		"name":  {ID: "name", Type: "question", Text: "Qual seu nome?"},
+	}
+	startNodeID = "start"
+
+	handler := wa.webhookHandler(handleUpdate)
+	body := `{"entry":[{"changes":[{"value":{"messages":[{"from":"551100","id":"w1","timestamp":"1","type":"text","text":{"body":"oi"}}]}}]}]}`
+	captureOutput(t, func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	})
+
+	if len(bodies) != 2 || bodies[0] != "Bem-vindo" || bodies[1] != "Qual seu nome?" {
+		t.Fatalf("unexpected replies sent to WhatsApp: %v", bodies)
+	}
+	if chatStateFor(551100).Awaiting != "name" {
+		t.Fatalf("conversation did not advance for WhatsApp chat")
+	}
+}